@@ -3,6 +3,7 @@ package cbcontext
 import (
 	"context"
 	"os"
+	"strconv"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/getsentry/raven-go"
@@ -12,6 +13,22 @@ type contextKey int
 
 const (
 	requestIDKey contextKey = iota
+	tokenIDKey
+	callerKey
+)
+
+// Caller contains information about the client that made a request.
+type Caller struct {
+	UserAgent  string
+	RemoteAddr string
+}
+
+// The keys used for the metadata returned by JobMetadata.
+const (
+	jobMetadataRequestID  = "request_id"
+	jobMetadataTokenID    = "token_id"
+	jobMetadataUserAgent  = "user_agent"
+	jobMetadataRemoteAddr = "remote_addr"
 )
 
 // FromRequestID generates a new context with the given context as its parent,
@@ -30,6 +47,79 @@ func RequestIDFromContext(ctx context.Context) (string, bool) {
 	return requestID, ok
 }
 
+// FromTokenID generates a new context with the given context as its parent,
+// and stores the ID of the token used to authenticate the request with the
+// context. The ID can be retrieved again using TokenIDFromContext.
+func FromTokenID(ctx context.Context, tokenID uint64) context.Context {
+	return context.WithValue(ctx, tokenIDKey, tokenID)
+}
+
+// TokenIDFromContext returns the token ID stored in the context with
+// FromTokenID. If no token ID is stored in the context, the second argument is
+// false. Otherwise it is true.
+func TokenIDFromContext(ctx context.Context) (uint64, bool) {
+	tokenID, ok := ctx.Value(tokenIDKey).(uint64)
+	return tokenID, ok
+}
+
+// FromCaller generates a new context with the given context as its parent,
+// and stores the given caller information with the context. The caller can be
+// retrieved again using CallerFromContext.
+func FromCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey, caller)
+}
+
+// CallerFromContext returns the caller stored in the context with FromCaller.
+// If no caller is stored in the context, the second argument is false.
+// Otherwise it is true.
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey).(Caller)
+	return caller, ok
+}
+
+// JobMetadata returns the request ID, token ID and caller stored in the
+// context, in a form that can be stored with a background job. The context can
+// be restored in the job handler using FromJobMetadata.
+func JobMetadata(ctx context.Context) map[string]string {
+	metadata := make(map[string]string)
+
+	if requestID, ok := RequestIDFromContext(ctx); ok {
+		metadata[jobMetadataRequestID] = requestID
+	}
+	if tokenID, ok := TokenIDFromContext(ctx); ok {
+		metadata[jobMetadataTokenID] = strconv.FormatUint(tokenID, 10)
+	}
+	if caller, ok := CallerFromContext(ctx); ok {
+		metadata[jobMetadataUserAgent] = caller.UserAgent
+		metadata[jobMetadataRemoteAddr] = caller.RemoteAddr
+	}
+
+	return metadata
+}
+
+// FromJobMetadata generates a new context with the given context as its
+// parent, and stores the values returned by JobMetadata with it. The metadata
+// is given as the arguments of a background job, which may contain other
+// arguments as well.
+func FromJobMetadata(ctx context.Context, args map[string]interface{}) context.Context {
+	if requestID, ok := args[jobMetadataRequestID].(string); ok {
+		ctx = FromRequestID(ctx, requestID)
+	}
+	if tokenIDString, ok := args[jobMetadataTokenID].(string); ok {
+		if tokenID, err := strconv.ParseUint(tokenIDString, 10, 64); err == nil {
+			ctx = FromTokenID(ctx, tokenID)
+		}
+	}
+
+	userAgent, hasUserAgent := args[jobMetadataUserAgent].(string)
+	remoteAddr, hasRemoteAddr := args[jobMetadataRemoteAddr].(string)
+	if hasUserAgent || hasRemoteAddr {
+		ctx = FromCaller(ctx, Caller{UserAgent: userAgent, RemoteAddr: remoteAddr})
+	}
+
+	return ctx
+}
+
 // LoggerFromContext returns a logrus.Entry with the PID of the current process
 // set as a field, and also includes every field set using the From* functions
 // this package.
@@ -39,6 +129,12 @@ func LoggerFromContext(ctx context.Context) *logrus.Entry {
 	if requestID, ok := RequestIDFromContext(ctx); ok {
 		entry = entry.WithField("request_id", requestID)
 	}
+	if tokenID, ok := TokenIDFromContext(ctx); ok {
+		entry = entry.WithField("token_id", tokenID)
+	}
+	if caller, ok := CallerFromContext(ctx); ok {
+		entry = entry.WithField("user_agent", caller.UserAgent).WithField("remote_addr", caller.RemoteAddr)
+	}
 
 	return entry
 }
@@ -59,6 +155,13 @@ func CaptureError(ctx context.Context, err error) {
 	if requestID, ok := RequestIDFromContext(ctx); ok {
 		tags["requestID"] = requestID
 	}
+	if tokenID, ok := TokenIDFromContext(ctx); ok {
+		tags["tokenID"] = strconv.FormatUint(tokenID, 10)
+	}
+	if caller, ok := CallerFromContext(ctx); ok {
+		tags["userAgent"] = caller.UserAgent
+		tags["remoteAddr"] = caller.RemoteAddr
+	}
 
 	packet := raven.NewPacket(
 		err.Error(),
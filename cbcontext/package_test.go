@@ -0,0 +1,44 @@
+package cbcontext
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJobMetadataRoundTrip(t *testing.T) {
+	ctx := FromRequestID(context.Background(), "request-id")
+	ctx = FromTokenID(ctx, 42)
+	ctx = FromCaller(ctx, Caller{UserAgent: "worker/1.0", RemoteAddr: "10.0.0.1"})
+
+	// Job arguments are stored as JSON, so all values come back as interface{}
+	args := map[string]interface{}{"payload": "instance-id"}
+	for key, value := range JobMetadata(ctx) {
+		args[key] = value
+	}
+
+	restored := FromJobMetadata(context.Background(), args)
+
+	if requestID, _ := RequestIDFromContext(restored); requestID != "request-id" {
+		t.Errorf("expected request ID %q, got %q", "request-id", requestID)
+	}
+	if tokenID, _ := TokenIDFromContext(restored); tokenID != 42 {
+		t.Errorf("expected token ID 42, got %d", tokenID)
+	}
+	if caller, _ := CallerFromContext(restored); caller.UserAgent != "worker/1.0" || caller.RemoteAddr != "10.0.0.1" {
+		t.Errorf("expected the caller to be restored, got %+v", caller)
+	}
+}
+
+func TestFromJobMetadataWithoutMetadata(t *testing.T) {
+	ctx := FromJobMetadata(context.Background(), map[string]interface{}{"payload": "instance-id"})
+
+	if _, ok := RequestIDFromContext(ctx); ok {
+		t.Error("expected no request ID")
+	}
+	if _, ok := TokenIDFromContext(ctx); ok {
+		t.Error("expected no token ID")
+	}
+	if _, ok := CallerFromContext(ctx); ok {
+		t.Error("expected no caller")
+	}
+}
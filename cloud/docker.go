@@ -0,0 +1,458 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dockerAPIVersion = "v1.25"
+
+	// dockerInstanceIDLabel is the label that all containers created by Cloud
+	// Brain have set. The value is the Cloud Brain instance ID.
+	dockerInstanceIDLabel = "cloud-brain-id"
+
+	// dockerWriteSSHKeyScript writes the key in the SSH_PUBLIC_KEY environment
+	// variable to the authorized_keys file of the travis user.
+	dockerWriteSSHKeyScript = `mkdir -p ~travis/.ssh && echo "$SSH_PUBLIC_KEY" > ~travis/.ssh/authorized_keys && chown -R travis: ~travis/.ssh && chmod 0600 ~travis/.ssh/authorized_keys`
+)
+
+func init() {
+	registerProvider("docker", "Docker", NewDockerProviderFromJSON)
+}
+
+// DockerProvider is an implementation of cloud.Provider backed by a Docker
+// Engine, where each instance is a container. It is mostly useful for
+// development and self-hosted workers.
+type DockerProvider struct {
+	client  *http.Client
+	baseURL string
+	ic      *dockerInstanceConfig
+}
+
+type dockerInstanceConfig struct {
+	Network        string
+	Privileged     bool
+	StandardCPUs   float64
+	StandardMemory int64
+	PremiumCPUs    float64
+	PremiumMemory  int64
+}
+
+// DockerProviderConfiguration contains all the configuration needed to create
+// a DockerProvider. Memory sizes are in bytes, and a CPU or memory limit of 0
+// means no limit.
+type DockerProviderConfiguration struct {
+	Endpoint       string  `json:"endpoint"`
+	Network        string  `json:"network"`
+	Privileged     bool    `json:"privileged"`
+	StandardCPUs   float64 `json:"standard_cpus"`
+	StandardMemory int64   `json:"standard_memory"`
+	PremiumCPUs    float64 `json:"premium_cpus"`
+	PremiumMemory  int64   `json:"premium_memory"`
+}
+
+// NewDockerProviderFromJSON deserializes the given jsonConfig into a
+// DockerProviderConfiguration and creates a DockerProvider from that. Used to
+// register the provider with the registry.
+func NewDockerProviderFromJSON(jsonConfig []byte) (Provider, error) {
+	var config DockerProviderConfiguration
+	err := json.Unmarshal(jsonConfig, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDockerProvider(config)
+}
+
+// NewDockerProvider creates a new DockerProvider with the given configuration.
+// The endpoint can be either a unix:// or a tcp:// URL, and defaults to the
+// local Docker socket.
+func NewDockerProvider(conf DockerProviderConfiguration) (*DockerProvider, error) {
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = "unix:///var/run/docker.sock"
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &DockerProvider{
+		ic: &dockerInstanceConfig{
+			Network:        conf.Network,
+			Privileged:     conf.Privileged,
+			StandardCPUs:   conf.StandardCPUs,
+			StandardMemory: conf.StandardMemory,
+			PremiumCPUs:    conf.PremiumCPUs,
+			PremiumMemory:  conf.PremiumMemory,
+		},
+	}
+
+	switch endpointURL.Scheme {
+	case "unix":
+		socketPath := endpointURL.Path
+		p.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+		p.baseURL = "http://docker/" + dockerAPIVersion
+	case "tcp", "http":
+		p.client = &http.Client{}
+		p.baseURL = fmt.Sprintf("http://%s/%s", endpointURL.Host, dockerAPIVersion)
+	default:
+		return nil, fmt.Errorf("unsupported docker endpoint scheme: %s", endpointURL.Scheme)
+	}
+
+	return p, nil
+}
+
+// List returns a list of all containers that were created by Cloud Brain.
+func (p *DockerProvider) List(ctx context.Context) ([]Instance, error) {
+	containers, err := p.listContainers(ctx, dockerInstanceIDLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, container := range containers {
+		instances = append(instances, container.toInstance())
+	}
+
+	return instances, nil
+}
+
+// Create creates and starts a new container with the given ID and using the
+// given attributes. The image is pulled if it isn't available locally, and the
+// public SSH key is written into the container once it's started.
+func (p *DockerProvider) Create(ctx context.Context, id string, attr CreateAttributes) (Instance, error) {
+	cpus, memory := p.ic.StandardCPUs, p.ic.StandardMemory
+	if attr.InstanceType == InstanceTypePremium {
+		cpus, memory = p.ic.PremiumCPUs, p.ic.PremiumMemory
+	}
+
+	createReq := dockerCreateContainer{
+		Image: attr.ImageName,
+		Labels: map[string]string{
+			dockerInstanceIDLabel: id,
+		},
+		HostConfig: dockerHostConfig{
+			Privileged:  p.ic.Privileged,
+			NetworkMode: p.ic.Network,
+			Memory:      memory,
+			NanoCPUs:    int64(cpus * 1e9),
+		},
+	}
+
+	query := url.Values{}
+	query.Set("name", fmt.Sprintf("testing-docker-%s", id))
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := p.do(ctx, "POST", "/containers/create?"+query.Encode(), createReq, &created)
+	if dockerErr, ok := err.(*dockerError); ok && dockerErr.StatusCode == http.StatusNotFound {
+		err = p.pullImage(ctx, attr.ImageName)
+		if err != nil {
+			return Instance{}, err
+		}
+		err = p.do(ctx, "POST", "/containers/create?"+query.Encode(), createReq, &created)
+	}
+	if err != nil {
+		return Instance{}, err
+	}
+
+	err = p.do(ctx, "POST", "/containers/"+created.ID+"/start", nil, nil)
+	if err != nil {
+		p.removeFailedContainer(created.ID)
+		return Instance{}, err
+	}
+
+	if attr.PublicSSHKey != "" {
+		err = p.exec(ctx, created.ID, []string{"SSH_PUBLIC_KEY=" + attr.PublicSSHKey}, dockerWriteSSHKeyScript)
+		if err != nil {
+			p.removeFailedContainer(created.ID)
+			return Instance{}, err
+		}
+	}
+
+	return Instance{
+		ID:         id,
+		State:      InstanceStateStarting,
+		UpstreamID: created.ID,
+	}, nil
+}
+
+// dockerCleanupTimeout is how long removeFailedContainer waits for Docker.
+const dockerCleanupTimeout = 30 * time.Second
+
+// removeFailedContainer forcibly removes a container that was created, but
+// couldn't be started or set up, so that a retry can create a container with
+// the same name. It doesn't use the context of the create, since that may be
+// what caused the failure. Errors are ignored, since the create already
+// failed.
+func (p *DockerProvider) removeFailedContainer(containerID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerCleanupTimeout)
+	defer cancel()
+
+	_ = p.do(ctx, "DELETE", "/containers/"+containerID+"?force=1&v=1", nil, nil)
+}
+
+// Get retrieves information about the container with the given ID. Returns
+// ErrInstanceNotFound if a container with the given ID wasn't found, or some
+// other error if we were unable to get information about the container.
+func (p *DockerProvider) Get(ctx context.Context, id string) (Instance, error) {
+	container, err := p.getContainer(ctx, id)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	return container.toInstance(), nil
+}
+
+// Destroy forcibly removes the container with the given ID. Returns
+// ErrInstanceNotFound if a container with the given ID wasn't found, or some
+// other error if another error occurred.
+func (p *DockerProvider) Destroy(ctx context.Context, id string) error {
+	container, err := p.getContainer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.do(ctx, "DELETE", "/containers/"+container.ID+"?force=1&v=1", nil, nil)
+	if dockerErr, ok := err.(*dockerError); ok && dockerErr.StatusCode == http.StatusNotFound {
+		return ErrInstanceNotFound
+	}
+
+	return err
+}
+
+func (p *DockerProvider) getContainer(ctx context.Context, id string) (dockerContainer, error) {
+	containers, err := p.listContainers(ctx, fmt.Sprintf("%s=%s", dockerInstanceIDLabel, id))
+	if err != nil {
+		return dockerContainer{}, err
+	}
+
+	if len(containers) == 0 {
+		return dockerContainer{}, ErrInstanceNotFound
+	}
+
+	return containers[0], nil
+}
+
+func (p *DockerProvider) listContainers(ctx context.Context, labelFilter string) ([]dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {labelFilter}})
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("all", "1")
+	query.Set("filters", string(filters))
+
+	var containers []dockerContainer
+	err = p.do(ctx, "GET", "/containers/json?"+query.Encode(), nil, &containers)
+	return containers, err
+}
+
+// pullImage pulls the given image, and returns once the pull has finished.
+func (p *DockerProvider) pullImage(ctx context.Context, image string) error {
+	query := url.Values{}
+	query.Set("fromImage", image)
+	if !strings.Contains(image, "@") && !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		query.Set("tag", "latest")
+	}
+
+	resp, err := p.request(ctx, "POST", "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The pull is only done when the progress stream ends, and errors are
+	// reported as part of the stream.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return fmt.Errorf("error pulling image %s: %s", image, message.Error)
+		}
+	}
+}
+
+// exec runs the given shell script in the container, and returns an error if
+// it couldn't be started or exited with a non-zero exit code.
+func (p *DockerProvider) exec(ctx context.Context, containerID string, env []string, script string) error {
+	var execCreated struct {
+		ID string `json:"Id"`
+	}
+	err := p.do(ctx, "POST", "/containers/"+containerID+"/exec", map[string]interface{}{
+		"Cmd":          []string{"/bin/sh", "-c", script},
+		"Env":          env,
+		"AttachStdout": true,
+		"AttachStderr": true,
+	}, &execCreated)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.request(ctx, "POST", "/exec/"+execCreated.ID+"/start", map[string]interface{}{"Detach": false})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	var execInspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	err = p.do(ctx, "GET", "/exec/"+execCreated.ID+"/json", nil, &execInspect)
+	if err != nil {
+		return err
+	}
+
+	if execInspect.ExitCode != 0 {
+		return fmt.Errorf("command in container exited with code %d", execInspect.ExitCode)
+	}
+
+	return nil
+}
+
+// do performs a request against the Docker Engine API and decodes the JSON
+// response into out, unless out is nil.
+func (p *DockerProvider) do(ctx context.Context, method, path string, in, out interface{}) error {
+	resp, err := p.request(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// request performs a request against the Docker Engine API, returning an error
+// if the status code isn't 2xx. The caller must close the response body.
+func (p *DockerProvider) request(ctx context.Context, method, path string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, p.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var message struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&message)
+		return nil, &dockerError{StatusCode: resp.StatusCode, Message: message.Message}
+	}
+
+	return resp, nil
+}
+
+type dockerHostConfig struct {
+	Privileged  bool   `json:"Privileged"`
+	NetworkMode string `json:"NetworkMode,omitempty"`
+	Memory      int64  `json:"Memory,omitempty"`
+	NanoCPUs    int64  `json:"NanoCpus,omitempty"`
+}
+
+type dockerCreateContainer struct {
+	Image      string            `json:"Image"`
+	Labels     map[string]string `json:"Labels"`
+	HostConfig dockerHostConfig  `json:"HostConfig"`
+}
+
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	State           string            `json:"State"`
+	Labels          map[string]string `json:"Labels"`
+	Created         int64             `json:"Created"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (c dockerContainer) toInstance() Instance {
+	instance := Instance{
+		ID:         c.Labels[dockerInstanceIDLabel],
+		UpstreamID: c.ID,
+	}
+	if c.Created > 0 {
+		instance.CreatedAt = time.Unix(c.Created, 0).UTC()
+	}
+
+	for _, network := range c.NetworkSettings.Networks {
+		if network.IPAddress != "" {
+			instance.IPAddress = network.IPAddress
+			break
+		}
+	}
+
+	switch c.State {
+	case "created", "restarting":
+		instance.State = InstanceStateStarting
+	case "running", "paused":
+		instance.State = InstanceStateRunning
+	case "removing":
+		instance.State = InstanceStateTerminating
+	case "exited", "dead":
+		instance.State = InstanceStateTerminated
+	}
+
+	return instance
+}
+
+type dockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker API returned status %d: %s", e.StatusCode, e.Message)
+}
@@ -0,0 +1,211 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Ensure that DockerProvider implements the Provider interface
+var _ Provider = &DockerProvider{}
+
+// fakeDockerServer is a minimal stand-in for the Docker Engine API,
+// supporting just enough of it for DockerProvider.
+type fakeDockerServer struct {
+	mutex      sync.Mutex
+	images     map[string]bool
+	containers map[string]*dockerContainer
+	names      map[string]string
+	execEnv    []string
+
+	// failStart makes starting containers fail
+	failStart bool
+
+	// forceRemoved are the IDs of the containers that were removed with
+	// force=1
+	forceRemoved []string
+}
+
+func (s *fakeDockerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion)
+
+	switch {
+	case r.Method == "POST" && path == "/images/create":
+		s.images[r.URL.Query().Get("fromImage")] = true
+		fmt.Fprint(w, `{"status": "Pulling"}`+"\n"+`{"status": "Done"}`)
+	case r.Method == "POST" && path == "/containers/create":
+		var req dockerCreateContainer
+		json.NewDecoder(r.Body).Decode(&req)
+		if !s.images[req.Image] {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "No such image"}`)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if _, ok := s.containers[s.names[name]]; ok {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"message": "The container name %q is already in use"}`, name)
+			return
+		}
+		id := fmt.Sprintf("container%d", len(s.names))
+		container := &dockerContainer{ID: id, State: "created", Labels: req.Labels}
+		s.containers[id] = container
+		s.names[name] = id
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id": %q}`, id)
+	case r.Method == "POST" && strings.HasSuffix(path, "/start") && strings.HasPrefix(path, "/containers/"):
+		if s.failStart {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"message": "driver failed programming external connectivity"}`)
+			return
+		}
+		container := s.containers[strings.Split(path, "/")[2]]
+		container.State = "running"
+		container.NetworkSettings.Networks = map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		}{"bridge": {IPAddress: "172.17.0.2"}}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && strings.HasSuffix(path, "/exec"):
+		var req struct{ Env []string }
+		json.NewDecoder(r.Body).Decode(&req)
+		s.execEnv = req.Env
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Id": "exec0"}`)
+	case r.Method == "POST" && path == "/exec/exec0/start":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET" && path == "/exec/exec0/json":
+		fmt.Fprint(w, `{"ExitCode": 0}`)
+	case r.Method == "GET" && path == "/containers/json":
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		label := strings.SplitN(filters["label"][0], "=", 2)
+		containers := []*dockerContainer{}
+		for _, container := range s.containers {
+			if value, ok := container.Labels[label[0]]; ok && (len(label) == 1 || value == label[1]) {
+				containers = append(containers, container)
+			}
+		}
+		json.NewEncoder(w).Encode(containers)
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/containers/"):
+		id := strings.TrimPrefix(path, "/containers/")
+		if r.URL.Query().Get("force") == "1" {
+			s.forceRemoved = append(s.forceRemoved, id)
+		}
+		delete(s.containers, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "page not found"}`)
+	}
+}
+
+// newFakeDockerProvider returns a DockerProvider talking to a fakeDockerServer
+// on a Unix socket, and a function that stops the server.
+func newFakeDockerProvider(t *testing.T) (*DockerProvider, *fakeDockerServer, func()) {
+	dir, err := ioutil.TempDir("", "cloud-brain-docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socketPath := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	fake := &fakeDockerServer{
+		images:     make(map[string]bool),
+		containers: make(map[string]*dockerContainer),
+		names:      make(map[string]string),
+	}
+	go http.Serve(listener, fake)
+
+	provider, err := NewDockerProvider(DockerProviderConfiguration{
+		Endpoint: "unix://" + socketPath,
+	})
+	if err != nil {
+		t.Fatalf("NewDockerProvider returned error: %v", err)
+	}
+
+	return provider, fake, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerProviderLifecycle(t *testing.T) {
+	provider, fake, stop := newFakeDockerProvider(t)
+	defer stop()
+
+	instance, err := provider.Create(context.Background(), "some-id", CreateAttributes{
+		ImageName:    "travisci/ci-garnet",
+		PublicSSHKey: "ssh-rsa AAAA",
+	})
+	if err != nil {
+		t.Fatalf("provider.Create returned error: %v", err)
+	}
+	if instance.ID != "some-id" || instance.UpstreamID != "container0" {
+		t.Errorf("unexpected instance from Create: %+v", instance)
+	}
+	if !fake.images["travisci/ci-garnet"] {
+		t.Errorf("expected image to be pulled")
+	}
+	if len(fake.execEnv) != 1 || fake.execEnv[0] != "SSH_PUBLIC_KEY=ssh-rsa AAAA" {
+		t.Errorf("expected SSH key to be passed to exec, got %v", fake.execEnv)
+	}
+
+	instances, err := provider.List(context.Background())
+	if err != nil {
+		t.Fatalf("provider.List returned error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].State != InstanceStateRunning || instances[0].IPAddress != "172.17.0.2" {
+		t.Errorf("unexpected instances from List: %+v", instances)
+	}
+
+	err = provider.Destroy(context.Background(), "some-id")
+	if err != nil {
+		t.Fatalf("provider.Destroy returned error: %v", err)
+	}
+
+	_, err = provider.Get(context.Background(), "some-id")
+	if err != ErrInstanceNotFound {
+		t.Errorf("expected ErrInstanceNotFound, got %v", err)
+	}
+}
+
+func TestDockerProviderCreateRemovesFailedContainer(t *testing.T) {
+	provider, fake, stop := newFakeDockerProvider(t)
+	defer stop()
+
+	fake.images["travisci/ci-garnet"] = true
+	fake.failStart = true
+
+	_, err := provider.Create(context.Background(), "some-id", CreateAttributes{ImageName: "travisci/ci-garnet"})
+	if err == nil {
+		t.Fatal("expected Create to fail when the container can't be started")
+	}
+	if len(fake.containers) != 0 || len(fake.forceRemoved) != 1 || fake.forceRemoved[0] != "container0" {
+		t.Errorf("expected the container to be force-removed, containers: %v, removed: %v", fake.containers, fake.forceRemoved)
+	}
+
+	fake.failStart = false
+	instance, err := provider.Create(context.Background(), "some-id", CreateAttributes{ImageName: "travisci/ci-garnet"})
+	if err != nil {
+		t.Fatalf("expected a retry to succeed, got %v", err)
+	}
+	if instance.UpstreamID != "container1" {
+		t.Errorf("unexpected instance from the retry: %+v", instance)
+	}
+}
@@ -0,0 +1,505 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	ec2APIVersion = "2016-11-15"
+
+	// ec2InstanceIDTag is the tag that all instances created by Cloud Brain
+	// are tagged with. The value is the Cloud Brain instance ID.
+	ec2InstanceIDTag = "cloud-brain-id"
+)
+
+var ec2UserData = template.Must(template.New("ec2-user-data").Parse(`#!/usr/bin/env bash
+{{ if .AutoImplode }}echo poweroff | at now + {{ .AutoImplodeMinutes }} minutes{{ end }}
+cat > ~travis/.ssh/authorized_keys <<EOF
+{{ .SSHPubKey }}
+EOF
+`))
+
+func init() {
+	registerProvider("ec2", "Amazon Elastic Compute Cloud", NewEC2ProviderFromJSON)
+}
+
+// EC2Provider is an implementation of cloud.Provider backed by Amazon Elastic
+// Compute Cloud. It talks to the EC2 Query API directly.
+type EC2Provider struct {
+	client          *http.Client
+	endpoint        string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	ic              *ec2InstanceConfig
+}
+
+type ec2InstanceConfig struct {
+	StandardInstanceType string
+	PremiumInstanceType  string
+	SubnetID             string
+	SecurityGroupIDs     []string
+	ImageOwnerID         string
+	HardTimeoutMinutes   int64
+	AutoImplode          bool
+}
+
+// EC2ProviderConfiguration contains all the configuration needed to create an
+// EC2Provider.
+type EC2ProviderConfiguration struct {
+	AccessKeyID          string        `json:"access_key_id"`
+	SecretAccessKey      string        `json:"secret_access_key"`
+	Region               string        `json:"region"`
+	Endpoint             string        `json:"endpoint"`
+	StandardInstanceType string        `json:"standard_instance_type"`
+	PremiumInstanceType  string        `json:"premium_instance_type"`
+	SubnetID             string        `json:"subnet_id"`
+	SecurityGroupIDs     []string      `json:"security_group_ids"`
+	ImageOwnerID         string        `json:"image_owner_id"`
+	AutoImplodeTime      time.Duration `json:"auto_implode_time"`
+	AutoImplode          bool          `json:"auto_implode"`
+}
+
+type ec2UserDataInfo struct {
+	AutoImplode        bool
+	AutoImplodeMinutes int64
+	SSHPubKey          string
+}
+
+// NewEC2ProviderFromJSON deserializes the given jsonConfig into an
+// EC2ProviderConfiguration and creates an EC2Provider from that. Used to
+// register the provider with the registry.
+func NewEC2ProviderFromJSON(jsonConfig []byte) (Provider, error) {
+	var config EC2ProviderConfiguration
+	err := json.Unmarshal(jsonConfig, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEC2Provider(config)
+}
+
+// NewEC2Provider creates a new EC2Provider with the given configuration. If no
+// endpoint is given, the public EC2 endpoint for the region is used.
+func NewEC2Provider(conf EC2ProviderConfiguration) (*EC2Provider, error) {
+	if conf.Region == "" {
+		return nil, fmt.Errorf("region is required")
+	}
+	if conf.AccessKeyID == "" || conf.SecretAccessKey == "" {
+		return nil, fmt.Errorf("access key ID and secret access key are required")
+	}
+
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", conf.Region)
+	}
+
+	standardInstanceType := conf.StandardInstanceType
+	if standardInstanceType == "" {
+		standardInstanceType = "c3.xlarge"
+	}
+	premiumInstanceType := conf.PremiumInstanceType
+	if premiumInstanceType == "" {
+		premiumInstanceType = "c3.2xlarge"
+	}
+
+	return &EC2Provider{
+		client:          &http.Client{Timeout: time.Minute},
+		endpoint:        endpoint,
+		region:          conf.Region,
+		accessKeyID:     conf.AccessKeyID,
+		secretAccessKey: conf.SecretAccessKey,
+		ic: &ec2InstanceConfig{
+			StandardInstanceType: standardInstanceType,
+			PremiumInstanceType:  premiumInstanceType,
+			SubnetID:             conf.SubnetID,
+			SecurityGroupIDs:     conf.SecurityGroupIDs,
+			ImageOwnerID:         conf.ImageOwnerID,
+			HardTimeoutMinutes:   int64(conf.AutoImplodeTime.Minutes()),
+			AutoImplode:          conf.AutoImplode,
+		},
+	}, nil
+}
+
+// List returns a list of all instances on EC2 that were created by Cloud
+// Brain.
+func (p *EC2Provider) List(ctx context.Context) ([]Instance, error) {
+	params := url.Values{}
+	params.Set("Filter.1.Name", "tag-key")
+	params.Set("Filter.1.Value.1", ec2InstanceIDTag)
+
+	ec2Instances, err := p.describeInstances(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, ec2Instance := range ec2Instances {
+		instances = append(instances, ec2Instance.toInstance())
+	}
+
+	return instances, nil
+}
+
+// Create creates a new instance with the given ID and using the given
+// attributes. The instance is tagged with the ID so it can be found again.
+func (p *EC2Provider) Create(ctx context.Context, id string, attr CreateAttributes) (Instance, error) {
+	imageID, err := p.findImage(ctx, attr.ImageName)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	var userData bytes.Buffer
+	err = ec2UserData.Execute(&userData, ec2UserDataInfo{
+		AutoImplode:        p.ic.AutoImplode,
+		AutoImplodeMinutes: p.ic.HardTimeoutMinutes,
+		SSHPubKey:          attr.PublicSSHKey,
+	})
+	if err != nil {
+		return Instance{}, err
+	}
+
+	instanceType := p.ic.StandardInstanceType
+	if attr.InstanceType == InstanceTypePremium {
+		instanceType = p.ic.PremiumInstanceType
+	}
+
+	params := url.Values{}
+	params.Set("ImageId", imageID)
+	params.Set("InstanceType", instanceType)
+	params.Set("MinCount", "1")
+	params.Set("MaxCount", "1")
+	params.Set("ClientToken", id)
+	params.Set("UserData", base64.StdEncoding.EncodeToString(userData.Bytes()))
+	params.Set("InstanceInitiatedShutdownBehavior", "terminate")
+	params.Set("TagSpecification.1.ResourceType", "instance")
+	params.Set("TagSpecification.1.Tag.1.Key", ec2InstanceIDTag)
+	params.Set("TagSpecification.1.Tag.1.Value", id)
+	params.Set("TagSpecification.1.Tag.2.Key", "Name")
+	params.Set("TagSpecification.1.Tag.2.Value", fmt.Sprintf("testing-ec2-%s", id))
+	if p.ic.SubnetID != "" {
+		params.Set("SubnetId", p.ic.SubnetID)
+	}
+	for i, securityGroupID := range p.ic.SecurityGroupIDs {
+		params.Set(fmt.Sprintf("SecurityGroupId.%d", i+1), securityGroupID)
+	}
+
+	var resp ec2RunInstancesResponse
+	err = p.do(ctx, "RunInstances", params, &resp)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	if len(resp.Instances) == 0 {
+		return Instance{}, fmt.Errorf("no instances returned from RunInstances")
+	}
+
+	instance := resp.Instances[0].toInstance()
+	instance.ID = id
+	instance.State = InstanceStateStarting
+
+	return instance, nil
+}
+
+// Get retrieves information about the instance with the given ID from EC2.
+// Returns ErrInstanceNotFound if an instance with the given ID wasn't found,
+// or some other error if we were unable to get information about the
+// instance.
+func (p *EC2Provider) Get(ctx context.Context, id string) (Instance, error) {
+	ec2Instance, err := p.getEC2Instance(ctx, id)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	return ec2Instance.toInstance(), nil
+}
+
+// Destroy terminates the instance with the given ID. Returns
+// ErrInstanceNotFound if an instance with the given ID wasn't found, or some
+// other error if another error occurred. Does not wait for the instance to
+// terminate.
+func (p *EC2Provider) Destroy(ctx context.Context, id string) error {
+	ec2Instance, err := p.getEC2Instance(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("InstanceId.1", ec2Instance.InstanceID)
+
+	return p.do(ctx, "TerminateInstances", params, nil)
+}
+
+func (p *EC2Provider) getEC2Instance(ctx context.Context, id string) (ec2Instance, error) {
+	params := url.Values{}
+	params.Set("Filter.1.Name", "tag:"+ec2InstanceIDTag)
+	params.Set("Filter.1.Value.1", id)
+
+	ec2Instances, err := p.describeInstances(ctx, params)
+	if err != nil {
+		return ec2Instance{}, err
+	}
+
+	// Terminated instances stay visible for a while, so prefer one that isn't
+	for _, inst := range ec2Instances {
+		if inst.State.Name != "terminated" {
+			return inst, nil
+		}
+	}
+	if len(ec2Instances) > 0 {
+		return ec2Instances[0], nil
+	}
+
+	return ec2Instance{}, ErrInstanceNotFound
+}
+
+func (p *EC2Provider) describeInstances(ctx context.Context, params url.Values) ([]ec2Instance, error) {
+	var instances []ec2Instance
+	for {
+		var resp ec2DescribeInstancesResponse
+		err := p.do(ctx, "DescribeInstances", params, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range resp.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+
+		if resp.NextToken == "" {
+			return instances, nil
+		}
+		params.Set("NextToken", resp.NextToken)
+	}
+}
+
+// findImage returns the ID of the image to boot. The name can either be an AMI
+// ID, or a name prefix in which case the last image by name is used.
+func (p *EC2Provider) findImage(ctx context.Context, name string) (string, error) {
+	if strings.HasPrefix(name, "ami-") {
+		return name, nil
+	}
+
+	params := url.Values{}
+	params.Set("Filter.1.Name", "name")
+	params.Set("Filter.1.Value.1", name+"*")
+	if p.ic.ImageOwnerID != "" {
+		params.Set("Owner.1", p.ic.ImageOwnerID)
+	}
+
+	var resp ec2DescribeImagesResponse
+	err := p.do(ctx, "DescribeImages", params, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Images) == 0 {
+		return "", fmt.Errorf("no image found with name %s", name)
+	}
+
+	imagesByName := map[string]string{}
+	imageNames := []string{}
+	for _, image := range resp.Images {
+		imagesByName[image.Name] = image.ImageID
+		imageNames = append(imageNames, image.Name)
+	}
+
+	sort.Strings(imageNames)
+
+	return imagesByName[imageNames[len(imageNames)-1]], nil
+}
+
+// do performs a signed request against the EC2 Query API and decodes the XML
+// response into out, unless out is nil.
+func (p *EC2Provider) do(ctx context.Context, action string, params url.Values, out interface{}) error {
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("Action", action)
+	form.Set("Version", ec2APIVersion)
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", p.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	p.sign(req, []byte(body), time.Now().UTC())
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ec2ErrorResponse
+		if xml.Unmarshal(respBody, &errResp) == nil && len(errResp.Errors) > 0 {
+			return &errResp.Errors[0]
+		}
+		return fmt.Errorf("%s returned status %d", action, resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(respBody, out)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request.
+func (p *EC2Provider) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/ec2/aws4_request", date, p.region)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		ec2CanonicalPath(req.URL.Path),
+		req.URL.RawQuery,
+		fmt.Sprintf("content-type:%s\nhost:%s\nx-amz-date:%s\n", req.Header.Get("Content-Type"), req.URL.Host, amzDate),
+		"content-type;host;x-amz-date",
+		ec2HexSHA256(body),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		ec2HexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := ec2HMAC([]byte("AWS4"+p.secretAccessKey), date)
+	key = ec2HMAC(key, p.region)
+	key = ec2HMAC(key, "ec2")
+	key = ec2HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(ec2HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=content-type;host;x-amz-date, Signature=%s",
+		p.accessKeyID, scope, signature,
+	))
+}
+
+func ec2CanonicalPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func ec2HexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func ec2HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+type ec2Tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type ec2Instance struct {
+	InstanceID       string    `xml:"instanceId"`
+	ImageID          string    `xml:"imageId"`
+	InstanceType     string    `xml:"instanceType"`
+	PrivateIPAddress string    `xml:"privateIpAddress"`
+	IPAddress        string    `xml:"ipAddress"`
+	Tags             []ec2Tag  `xml:"tagSet>item"`
+	AvailabilityZone string    `xml:"placement>availabilityZone"`
+	LaunchTime       time.Time `xml:"launchTime"`
+	State            struct {
+		Code int    `xml:"code"`
+		Name string `xml:"name"`
+	} `xml:"instanceState"`
+}
+
+func (i ec2Instance) toInstance() Instance {
+	instance := Instance{
+		UpstreamID: i.InstanceID,
+		IPAddress:  i.IPAddress,
+		Zone:       i.AvailabilityZone,
+		CreatedAt:  i.LaunchTime,
+	}
+	if instance.IPAddress == "" {
+		instance.IPAddress = i.PrivateIPAddress
+	}
+
+	for _, tag := range i.Tags {
+		if tag.Key == ec2InstanceIDTag {
+			instance.ID = tag.Value
+		}
+	}
+
+	switch i.State.Name {
+	case "pending":
+		instance.State = InstanceStateStarting
+	case "running":
+		instance.State = InstanceStateRunning
+	case "shutting-down", "stopping":
+		instance.State = InstanceStateTerminating
+	case "terminated", "stopped":
+		instance.State = InstanceStateTerminated
+	}
+
+	return instance
+}
+
+type ec2DescribeInstancesResponse struct {
+	Reservations []struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+type ec2RunInstancesResponse struct {
+	Instances []ec2Instance `xml:"instancesSet>item"`
+}
+
+type ec2DescribeImagesResponse struct {
+	Images []struct {
+		ImageID string `xml:"imageId"`
+		Name    string `xml:"name"`
+	} `xml:"imagesSet>item"`
+}
+
+type ec2ErrorResponse struct {
+	Errors []ec2Error `xml:"Errors>Error"`
+}
+
+type ec2Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *ec2Error) Error() string {
+	return fmt.Sprintf("ec2 error %s: %s", e.Code, e.Message)
+}
@@ -0,0 +1,161 @@
+package cloud
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Ensure that EC2Provider implements the Provider interface
+var _ Provider = &EC2Provider{}
+
+// fakeEC2Server is a minimal stand-in for the EC2 Query API, supporting just
+// enough of it for EC2Provider.
+type fakeEC2Server struct {
+	mutex     sync.Mutex
+	instances []ec2Instance
+	lastForm  map[string]string
+}
+
+func (s *fakeEC2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access-key/") {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>AuthFailure</Code><Message>bad signature</Message></Error></Errors></Response>`)
+		return
+	}
+
+	r.ParseForm()
+	s.lastForm = make(map[string]string)
+	for key := range r.PostForm {
+		s.lastForm[key] = r.PostForm.Get(key)
+	}
+
+	switch r.PostForm.Get("Action") {
+	case "DescribeImages":
+		fmt.Fprint(w, `<DescribeImagesResponse><imagesSet>
+			<item><imageId>ami-1</imageId><name>travis-ci-trusty-1</name></item>
+			<item><imageId>ami-2</imageId><name>travis-ci-trusty-2</name></item>
+		</imagesSet></DescribeImagesResponse>`)
+	case "RunInstances":
+		inst := ec2Instance{
+			InstanceID:       fmt.Sprintf("i-%d", len(s.instances)),
+			ImageID:          r.PostForm.Get("ImageId"),
+			PrivateIPAddress: "10.0.0.1",
+			Tags: []ec2Tag{
+				{Key: r.PostForm.Get("TagSpecification.1.Tag.1.Key"), Value: r.PostForm.Get("TagSpecification.1.Tag.1.Value")},
+			},
+		}
+		inst.State.Name = "pending"
+		s.instances = append(s.instances, inst)
+		s.writeXML(w, "RunInstancesResponse", ec2RunInstancesResponse{Instances: []ec2Instance{inst}})
+	case "DescribeInstances":
+		var matching []ec2Instance
+		for _, inst := range s.instances {
+			for _, tag := range inst.Tags {
+				if r.PostForm.Get("Filter.1.Name") == "tag-key" && tag.Key == r.PostForm.Get("Filter.1.Value.1") ||
+					r.PostForm.Get("Filter.1.Name") == "tag:"+tag.Key && tag.Value == r.PostForm.Get("Filter.1.Value.1") {
+					matching = append(matching, inst)
+				}
+			}
+		}
+		resp := ec2DescribeInstancesResponse{}
+		if len(matching) > 0 {
+			resp.Reservations = append(resp.Reservations, struct {
+				Instances []ec2Instance `xml:"instancesSet>item"`
+			}{Instances: matching})
+		}
+		s.writeXML(w, "DescribeInstancesResponse", resp)
+	case "TerminateInstances":
+		for i := range s.instances {
+			if s.instances[i].InstanceID == r.PostForm.Get("InstanceId.1") {
+				s.instances[i].State.Name = "shutting-down"
+			}
+		}
+		fmt.Fprint(w, `<TerminateInstancesResponse></TerminateInstancesResponse>`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidAction</Code><Message>unknown action</Message></Error></Errors></Response>`)
+	}
+}
+
+func (s *fakeEC2Server) writeXML(w http.ResponseWriter, name string, v interface{}) {
+	xml.NewEncoder(w).EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func newTestEC2Provider(t *testing.T) (*EC2Provider, *fakeEC2Server, func()) {
+	fake := &fakeEC2Server{}
+	server := httptest.NewServer(fake)
+
+	provider, err := NewEC2Provider(EC2ProviderConfiguration{
+		AccessKeyID:         "access-key",
+		SecretAccessKey:     "secret-key",
+		Region:              "us-east-1",
+		Endpoint:            server.URL + "/",
+		PremiumInstanceType: "c3.4xlarge",
+	})
+	if err != nil {
+		t.Fatalf("NewEC2Provider returned error: %v", err)
+	}
+
+	return provider, fake, server.Close
+}
+
+func TestEC2ProviderLifecycle(t *testing.T) {
+	provider, fake, closeServer := newTestEC2Provider(t)
+	defer closeServer()
+
+	instance, err := provider.Create(context.Background(), "some-id", CreateAttributes{
+		ImageName:    "travis-ci-trusty",
+		InstanceType: InstanceTypePremium,
+		PublicSSHKey: "ssh-rsa AAAA",
+	})
+	if err != nil {
+		t.Fatalf("provider.Create returned error: %v", err)
+	}
+	if instance.ID != "some-id" {
+		t.Errorf("expected ID to be %v, was %v", "some-id", instance.ID)
+	}
+	if instance.State != InstanceStateStarting {
+		t.Errorf("expected state to be %v, was %v", InstanceStateStarting, instance.State)
+	}
+	if fake.lastForm["ImageId"] != "ami-2" {
+		t.Errorf("expected newest image ami-2 to be used, was %v", fake.lastForm["ImageId"])
+	}
+	if fake.lastForm["InstanceType"] != "c3.4xlarge" {
+		t.Errorf("expected premium instance type c3.4xlarge, was %v", fake.lastForm["InstanceType"])
+	}
+
+	instances, err := provider.List(context.Background())
+	if err != nil {
+		t.Fatalf("provider.List returned error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "some-id" || instances[0].IPAddress != "10.0.0.1" {
+		t.Errorf("unexpected instances from List: %+v", instances)
+	}
+
+	err = provider.Destroy(context.Background(), "some-id")
+	if err != nil {
+		t.Fatalf("provider.Destroy returned error: %v", err)
+	}
+
+	instance, err = provider.Get(context.Background(), "some-id")
+	if err != nil {
+		t.Fatalf("provider.Get returned error: %v", err)
+	}
+	if instance.State != InstanceStateTerminating {
+		t.Errorf("expected state to be %v, was %v", InstanceStateTerminating, instance.State)
+	}
+
+	_, err = provider.Get(context.Background(), "other-id")
+	if err != ErrInstanceNotFound {
+		t.Errorf("expected ErrInstanceNotFound, got %v", err)
+	}
+}
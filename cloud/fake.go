@@ -1,101 +1,459 @@
 package cloud
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	fakeInstanceStores      = map[string]*fakeInstanceStore{}
+	fakeInstanceStoresMutex sync.Mutex
 )
 
-// FakeProvider is an in-memory Provider suitable for tests.
+func init() {
+	registerProvider("fake", "Fake", NewFakeProviderFromJSON)
+}
+
+// FakeProvider is a Provider suitable for tests and staging. The zero value
+// never injects any failures and accepts the "standard-image" image.
+//
+// The instances are kept in the memory of the process, unless RedisURL is set.
+// Then they're kept in Redis, so the create and refresh workers can run as
+// separate processes and still see the same instances.
 type FakeProvider struct {
-	instancesMutex sync.Mutex
-	instances      map[string]Instance
+	conf FakeProviderConfiguration
+
+	initOnce sync.Once
+	store    *fakeInstanceStore
+}
+
+// FakeProviderConfiguration contains the configuration for a FakeProvider.
+// The error rates are probabilities between 0 and 1 that the given operation
+// returns an error.
+type FakeProviderConfiguration struct {
+	// Namespace is used to share instances and the random number generator
+	// between FakeProviders created from the registry in the same process,
+	// since the Core recreates providers when refreshing. With RedisURL set,
+	// the instances are also shared with other processes using the same
+	// namespace.
+	Namespace string `json:"namespace"`
+
+	// RedisURL is the URL of the Redis server to keep the instances in. If
+	// empty, they only exist in the memory of the process.
+	RedisURL string `json:"redis_url"`
+
+	ListErrorRate    float64 `json:"list_error_rate"`
+	CreateErrorRate  float64 `json:"create_error_rate"`
+	GetErrorRate     float64 `json:"get_error_rate"`
+	DestroyErrorRate float64 `json:"destroy_error_rate"`
+
+	ListLatency    time.Duration `json:"list_latency"`
+	CreateLatency  time.Duration `json:"create_latency"`
+	GetLatency     time.Duration `json:"get_latency"`
+	DestroyLatency time.Duration `json:"destroy_latency"`
+
+	// Images is the list of image names that Create accepts. Defaults to
+	// just "standard-image".
+	Images []string `json:"images"`
+
+	// RunningAfter is how long after being created an instance automatically
+	// goes from starting to running. If zero, instances stay in the starting
+	// state until MarkRunning is called.
+	RunningAfter time.Duration `json:"running_after"`
+
+	// Seed is used to seed the random number generator used for the error
+	// injection, so runs can be made deterministic. If zero, the current time
+	// is used. Providers in the same namespace use the seed of the first one.
+	// The random number generator isn't shared between processes.
+	Seed int64 `json:"seed"`
+}
+
+// fakeInstanceStore holds the state shared by the FakeProviders in a
+// namespace. The random number generator is kept here too, so recreating the
+// providers doesn't reseed it and a seeded run stays deterministic.
+type fakeInstanceStore struct {
+	instances fakeInstanceStorage
+
+	randMutex sync.Mutex
+	rand      *rand.Rand
+}
+
+// fakeInstanceStorage keeps the instances of a namespace.
+type fakeInstanceStorage interface {
+	list() ([]Instance, error)
+	get(id string) (Instance, bool, error)
+	put(instance Instance) error
+	remove(id string) (bool, error)
+}
+
+// NewFakeProviderFromJSON deserializes the given jsonConfig into a
+// FakeProviderConfiguration and creates a FakeProvider from that. Used to
+// register the provider with the registry. Providers with the same namespace
+// share their instances.
+func NewFakeProviderFromJSON(jsonConfig []byte) (Provider, error) {
+	var config FakeProviderConfiguration
+	err := json.Unmarshal(jsonConfig, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewFakeProvider(config)
+
+	fakeInstanceStoresMutex.Lock()
+	defer fakeInstanceStoresMutex.Unlock()
+
+	store, ok := fakeInstanceStores[config.Namespace]
+	if !ok {
+		store = newFakeInstanceStore(config)
+		fakeInstanceStores[config.Namespace] = store
+	}
+	p.store = store
+
+	return p, nil
+}
+
+// NewFakeProvider creates a new FakeProvider with the given configuration.
+func NewFakeProvider(conf FakeProviderConfiguration) *FakeProvider {
+	return &FakeProvider{conf: conf}
+}
+
+func newFakeInstanceStore(conf FakeProviderConfiguration) *fakeInstanceStore {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	var instances fakeInstanceStorage
+	if conf.RedisURL != "" {
+		instances = newRedisFakeInstanceStorage(conf.RedisURL, conf.Namespace)
+	} else {
+		instances = &memoryFakeInstanceStorage{instances: make(map[string]Instance)}
+	}
+
+	return &fakeInstanceStore{
+		instances: instances,
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (p *FakeProvider) init() {
+	p.initOnce.Do(func() {
+		if p.store == nil {
+			p.store = newFakeInstanceStore(p.conf)
+		}
+	})
+}
+
+// shouldFail returns true with the given probability.
+func (p *FakeProvider) shouldFail(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	p.store.randMutex.Lock()
+	defer p.store.randMutex.Unlock()
+
+	return p.store.rand.Float64() < rate
 }
 
-// MarkRunning marks a VM as running and gives it a random IP address.
-func (p *FakeProvider) MarkRunning(id string) {
-	p.instancesMutex.Lock()
-	defer p.instancesMutex.Unlock()
+// fakeIPAddress returns the IP address of the running instance with the given
+// ID. It's derived from the ID, so every process reports the same address.
+func fakeIPAddress(id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	sum := h.Sum(nil)
 
-	inst := p.instances[id]
+	return fmt.Sprintf("%d.%d.%d.%d", sum[0], sum[1], sum[2], sum[3])
+}
 
-	ipAddress := make([]byte, 4)
-	rand.Read(ipAddress)
-	inst.IPAddress = fmt.Sprintf("%d.%d.%d.%d", ipAddress[0], ipAddress[1], ipAddress[2], ipAddress[3])
+// wait simulates the latency of a call, returning the error of the context if
+// it's done first.
+func (p *FakeProvider) wait(ctx context.Context, latency time.Duration) error {
+	if latency <= 0 {
+		return ctx.Err()
+	}
+
+	select {
+	case <-time.After(latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MarkRunning marks a VM as running and gives it an IP address. Returns
+// ErrInstanceNotFound if an instance with the given ID doesn't exist.
+func (p *FakeProvider) MarkRunning(id string) error {
+	p.init()
+
+	inst, ok, err := p.store.instances.get(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInstanceNotFound
+	}
+
+	inst.IPAddress = fakeIPAddress(id)
 	inst.State = InstanceStateRunning
-	p.instances[inst.ID] = inst
+	return p.store.instances.put(inst)
+}
+
+// promoteStarted returns the instance as running if it has been starting for
+// longer than RunningAfter. The state isn't stored, so it's the same in every
+// process and a destroyed instance can't be brought back.
+func (p *FakeProvider) promoteStarted(inst Instance) Instance {
+	if p.conf.RunningAfter <= 0 || inst.State != InstanceStateStarting || time.Since(inst.CreatedAt) < p.conf.RunningAfter {
+		return inst
+	}
+
+	inst.IPAddress = fakeIPAddress(inst.ID)
+	inst.State = InstanceStateRunning
+	return inst
 }
 
 // List returns all the instances in the fake provider.
-func (p *FakeProvider) List() ([]Instance, error) {
-	if rand.Intn(10) == 0 {
+func (p *FakeProvider) List(ctx context.Context) ([]Instance, error) {
+	p.init()
+	if err := p.wait(ctx, p.conf.ListLatency); err != nil {
+		return nil, err
+	}
+
+	if p.shouldFail(p.conf.ListErrorRate) {
 		return nil, fmt.Errorf("random error occurred")
 	}
 
-	p.instancesMutex.Lock()
-	defer p.instancesMutex.Unlock()
+	instances, err := p.store.instances.list()
+	if err != nil {
+		return nil, err
+	}
 
-	var instances []Instance
-	for _, instance := range p.instances {
-		instances = append(instances, instance)
+	for i := range instances {
+		instances[i] = p.promoteStarted(instances[i])
 	}
 
 	return instances, nil
 }
 
 // Create creates an instance in the fake provider.
-func (p *FakeProvider) Create(id string, attrs CreateAttributes) (Instance, error) {
-	if rand.Intn(5) == 0 {
-		return Instance{}, fmt.Errorf("random error occurred")
+func (p *FakeProvider) Create(ctx context.Context, id string, attrs CreateAttributes) (Instance, error) {
+	p.init()
+	if err := p.wait(ctx, p.conf.CreateLatency); err != nil {
+		return Instance{}, err
 	}
 
-	p.instancesMutex.Lock()
-	defer p.instancesMutex.Unlock()
+	if p.shouldFail(p.conf.CreateErrorRate) {
+		return Instance{}, fmt.Errorf("random error occurred")
+	}
 
 	if attrs.ImageName == "" {
-		return Instance{}, fmt.Errorf("image is required")
+		return Instance{}, &PermanentError{Err: fmt.Errorf("image is required")}
 	}
 
-	if attrs.ImageName == "standard-image" {
-		inst := Instance{
-			ID:    id,
-			State: InstanceStateStarting,
-		}
-		if p.instances == nil {
-			p.instances = make(map[string]Instance)
+	images := p.conf.Images
+	if len(images) == 0 {
+		images = []string{"standard-image"}
+	}
+
+	for _, image := range images {
+		if attrs.ImageName == image {
+			inst := Instance{
+				ID:        id,
+				State:     InstanceStateStarting,
+				CreatedAt: time.Now().UTC(),
+			}
+			if err := p.store.instances.put(inst); err != nil {
+				return Instance{}, err
+			}
+
+			return inst, nil
 		}
-		p.instances[inst.ID] = inst
+	}
+
+	return Instance{}, &PermanentError{Err: fmt.Errorf("unknown image")}
+}
+
+// Get returns the instance with the given ID, or ErrInstanceNotFound if the
+// instance wasn't found
+func (p *FakeProvider) Get(ctx context.Context, id string) (Instance, error) {
+	p.init()
+	if err := p.wait(ctx, p.conf.GetLatency); err != nil {
+		return Instance{}, err
+	}
+
+	if p.shouldFail(p.conf.GetErrorRate) {
+		return Instance{}, fmt.Errorf("random error occurred")
+	}
 
-		return inst, nil
+	instance, ok, err := p.store.instances.get(id)
+	if err != nil {
+		return Instance{}, err
+	}
+	if !ok {
+		return Instance{}, ErrInstanceNotFound
 	}
 
-	return Instance{}, fmt.Errorf("unknown image")
+	return p.promoteStarted(instance), nil
 }
 
-// Get returns the instance with the given ID, or an error if the instance
-// wasn't found
-func (p *FakeProvider) Get(id string) (Instance, error) {
-	p.instancesMutex.Lock()
-	defer p.instancesMutex.Unlock()
+// Destroy deletes the instance with the given ID. Returns ErrInstanceNotFound
+// if an instance with the given ID doesn't exist.
+func (p *FakeProvider) Destroy(ctx context.Context, id string) error {
+	p.init()
+	if err := p.wait(ctx, p.conf.DestroyLatency); err != nil {
+		return err
+	}
 
-	instance, ok := p.instances[id]
+	if p.shouldFail(p.conf.DestroyErrorRate) {
+		return fmt.Errorf("random error occurred")
+	}
+
+	ok, err := p.store.instances.remove(id)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return Instance{}, fmt.Errorf("instance not found")
+		return ErrInstanceNotFound
 	}
 
-	return instance, nil
+	return nil
 }
 
-// Destroy deletes the instance with the given ID. Returns an error if an
-// instance with the given ID doesn't exist.
-func (p *FakeProvider) Destroy(id string) error {
-	p.instancesMutex.Lock()
-	defer p.instancesMutex.Unlock()
+// memoryFakeInstanceStorage keeps the instances in the memory of the process.
+type memoryFakeInstanceStorage struct {
+	mutex     sync.Mutex
+	instances map[string]Instance
+}
+
+func (s *memoryFakeInstanceStorage) list() ([]Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, ok := p.instances[id]; !ok {
-		return fmt.Errorf("instance not found")
+	var instances []Instance
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
 	}
 
-	delete(p.instances, id)
+	return instances, nil
+}
+
+func (s *memoryFakeInstanceStorage) get(id string) (Instance, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instance, ok := s.instances[id]
+	return instance, ok, nil
+}
+
+func (s *memoryFakeInstanceStorage) put(instance Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.instances[instance.ID] = instance
 	return nil
 }
+
+func (s *memoryFakeInstanceStorage) remove(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.instances[id]
+	delete(s.instances, id)
+	return ok, nil
+}
+
+// redisFakeInstanceStorage keeps the instances as JSON in a Redis hash, so
+// every process using the same Redis server and namespace sees them.
+type redisFakeInstanceStorage struct {
+	pool *redis.Pool
+	key  string
+}
+
+func newRedisFakeInstanceStorage(redisURL, namespace string) *redisFakeInstanceStorage {
+	return &redisFakeInstanceStorage{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(redisURL)
+			},
+		},
+		key: "cloudbrain:fake-instances:" + namespace,
+	}
+}
+
+func (s *redisFakeInstanceStorage) list() ([]Instance, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", s.key))
+	if err != nil {
+		return nil, fmt.Errorf("error listing fake instances in redis: %v", err)
+	}
+
+	var instances []Instance
+	for _, value := range values {
+		var instance Instance
+		if err := json.Unmarshal([]byte(value), &instance); err != nil {
+			return nil, fmt.Errorf("error decoding fake instance: %v", err)
+		}
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
+
+func (s *redisFakeInstanceStorage) get(id string) (Instance, bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("HGET", s.key, id))
+	if err == redis.ErrNil {
+		return Instance{}, false, nil
+	}
+	if err != nil {
+		return Instance{}, false, fmt.Errorf("error fetching fake instance from redis: %v", err)
+	}
+
+	var instance Instance
+	if err := json.Unmarshal(value, &instance); err != nil {
+		return Instance{}, false, fmt.Errorf("error decoding fake instance: %v", err)
+	}
+
+	return instance, true, nil
+}
+
+func (s *redisFakeInstanceStorage) put(instance Instance) error {
+	value, err := json.Marshal(instance)
+	if err != nil {
+		return fmt.Errorf("error encoding fake instance: %v", err)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", s.key, instance.ID, value); err != nil {
+		return fmt.Errorf("error storing fake instance in redis: %v", err)
+	}
+
+	return nil
+}
+
+func (s *redisFakeInstanceStorage) remove(id string) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	removed, err := redis.Int(conn.Do("HDEL", s.key, id))
+	if err != nil {
+		return false, fmt.Errorf("error removing fake instance from redis: %v", err)
+	}
+
+	return removed > 0, nil
+}
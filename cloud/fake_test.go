@@ -1,6 +1,17 @@
 package cloud
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 // Ensure that FakeProvider implements the Provider interface
 var _ Provider = &FakeProvider{}
@@ -8,17 +19,17 @@ var _ Provider = &FakeProvider{}
 func TestFakeProviderCreate(t *testing.T) {
 	provider := &FakeProvider{}
 
-	_, err := provider.Create("no-image-name", CreateAttributes{ImageName: ""})
+	_, err := provider.Create(context.Background(), "no-image-name", CreateAttributes{ImageName: ""})
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
 
-	_, err = provider.Create("invalid-image-name", CreateAttributes{ImageName: "nonexistant-image"})
+	_, err = provider.Create(context.Background(), "invalid-image-name", CreateAttributes{ImageName: "nonexistant-image"})
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
 
-	instance, err := provider.Create("valid-image-name", CreateAttributes{ImageName: "standard-image"})
+	instance, err := provider.Create(context.Background(), "valid-image-name", CreateAttributes{ImageName: "standard-image"})
 	if err != nil {
 		t.Errorf("provider.Create returned error: %v", err)
 	}
@@ -30,3 +41,271 @@ func TestFakeProviderCreate(t *testing.T) {
 		t.Errorf("expected ID to be %v, was %v", "valid-image-name", instance.ID)
 	}
 }
+
+func TestFakeProviderErrorInjection(t *testing.T) {
+	provider := NewFakeProvider(FakeProviderConfiguration{
+		CreateErrorRate: 1,
+		Seed:            1,
+	})
+
+	_, err := provider.Create(context.Background(), "some-id", CreateAttributes{ImageName: "standard-image"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	_, err = provider.List(context.Background())
+	if err != nil {
+		t.Errorf("provider.List returned error: %v", err)
+	}
+}
+
+func TestFakeProviderRunningAfter(t *testing.T) {
+	provider := NewFakeProvider(FakeProviderConfiguration{
+		Images:       []string{"custom-image"},
+		RunningAfter: time.Nanosecond,
+	})
+
+	_, err := provider.Create(context.Background(), "some-id", CreateAttributes{ImageName: "custom-image"})
+	if err != nil {
+		t.Fatalf("provider.Create returned error: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	instance, err := provider.Get(context.Background(), "some-id")
+	if err != nil {
+		t.Fatalf("provider.Get returned error: %v", err)
+	}
+	if instance.State != InstanceStateRunning {
+		t.Errorf("expected state to be %v, was %v", InstanceStateRunning, instance.State)
+	}
+	if instance.IPAddress == "" {
+		t.Errorf("expected instance to have an IP address")
+	}
+}
+
+func TestFakeProviderFromJSONSharesNamespace(t *testing.T) {
+	first, err := NewProvider("fake", []byte(`{"namespace": "shared-test"}`))
+	if err != nil {
+		t.Fatalf("NewProvider returned error: %v", err)
+	}
+	second, err := NewProvider("fake", []byte(`{"namespace": "shared-test"}`))
+	if err != nil {
+		t.Fatalf("NewProvider returned error: %v", err)
+	}
+
+	_, err = first.Create(context.Background(), "some-id", CreateAttributes{ImageName: "standard-image"})
+	if err != nil {
+		t.Fatalf("provider.Create returned error: %v", err)
+	}
+
+	_, err = second.Get(context.Background(), "some-id")
+	if err != nil {
+		t.Errorf("expected instance to be visible from second provider, got %v", err)
+	}
+}
+
+func TestFakeProviderFromJSONKeepsRandomSequence(t *testing.T) {
+	config := FakeProviderConfiguration{GetErrorRate: 0.5, Seed: 42}
+	expected := NewFakeProvider(config)
+
+	for i := 0; i < 20; i++ {
+		// Recreate the provider for every call, like the Core does when
+		// refreshing
+		provider, err := NewProvider("fake", []byte(`{"namespace": "seed-test", "get_error_rate": 0.5, "seed": 42}`))
+		if err != nil {
+			t.Fatalf("NewProvider returned error: %v", err)
+		}
+
+		_, expectedErr := expected.Get(context.Background(), "some-id")
+		_, err = provider.Get(context.Background(), "some-id")
+		if (err == ErrInstanceNotFound) != (expectedErr == ErrInstanceNotFound) {
+			t.Fatalf("expected call %d to fail like a single provider with the same seed", i)
+		}
+	}
+}
+
+func TestFakeProviderLatencyHonorsContext(t *testing.T) {
+	provider := NewFakeProvider(FakeProviderConfiguration{CreateLatency: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := provider.Create(ctx, "some-id", CreateAttributes{ImageName: "standard-image"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected Create to return when the context is done, took %v", time.Since(start))
+	}
+
+	if _, err := provider.Get(context.Background(), "some-id"); err != ErrInstanceNotFound {
+		t.Errorf("expected the instance not to be created, got %v", err)
+	}
+}
+
+func TestFakeProviderRedisSharesInstances(t *testing.T) {
+	listener := serveFakeRedis(t)
+	defer listener.Close()
+
+	config := FakeProviderConfiguration{
+		Namespace:    "redis-test",
+		RedisURL:     "redis://" + listener.Addr().String(),
+		RunningAfter: time.Nanosecond,
+	}
+
+	// Providers created with NewFakeProvider don't share a store, like
+	// providers in the create and refresh worker processes
+	creator := NewFakeProvider(config)
+	refresher := NewFakeProvider(config)
+
+	_, err := creator.Create(context.Background(), "some-id", CreateAttributes{ImageName: "standard-image"})
+	if err != nil {
+		t.Fatalf("provider.Create returned error: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	instances, err := refresher.List(context.Background())
+	if err != nil {
+		t.Fatalf("provider.List returned error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "some-id" || instances[0].State != InstanceStateRunning {
+		t.Fatalf("expected the other provider to list the running instance, got %+v", instances)
+	}
+
+	instance, err := creator.Get(context.Background(), "some-id")
+	if err != nil {
+		t.Fatalf("provider.Get returned error: %v", err)
+	}
+	if instance.IPAddress != instances[0].IPAddress {
+		t.Errorf("expected both providers to report the IP address %s, got %s", instances[0].IPAddress, instance.IPAddress)
+	}
+
+	if err := refresher.Destroy(context.Background(), "some-id"); err != nil {
+		t.Fatalf("provider.Destroy returned error: %v", err)
+	}
+	if _, err := creator.Get(context.Background(), "some-id"); err != ErrInstanceNotFound {
+		t.Errorf("expected the instance destroyed by the other provider to be gone, got %v", err)
+	}
+}
+
+// serveFakeRedis starts a server that understands the Redis hash commands the
+// fake provider uses. Close the listener to stop it.
+func serveFakeRedis(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+
+	var mutex sync.Mutex
+	hashes := make(map[string]map[string]string)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRedisCommand(r)
+					if err != nil {
+						return
+					}
+
+					mutex.Lock()
+					reply := fakeRedisReply(hashes, args)
+					mutex.Unlock()
+
+					if _, err := io.WriteString(conn, reply); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix string) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasPrefix(line, prefix) {
+			return 0, fmt.Errorf("expected %q, got %q", prefix, line)
+		}
+		return strconv.Atoi(strings.TrimSpace(line[1:]))
+	}
+
+	n, err := readLine("*")
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		length, err := readLine("$")
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:length])
+	}
+
+	return args, nil
+}
+
+func fakeRedisReply(hashes map[string]map[string]string, args []string) string {
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+
+	hash := hashes[args[1]]
+	switch strings.ToUpper(args[0]) {
+	case "HSET":
+		if hash == nil {
+			hash = make(map[string]string)
+			hashes[args[1]] = hash
+		}
+		_, existed := hash[args[2]]
+		hash[args[2]] = args[3]
+		if existed {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "HGET":
+		value, ok := hash[args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "HGETALL":
+		reply := fmt.Sprintf("*%d\r\n", 2*len(hash))
+		for field, value := range hash {
+			reply += bulk(field) + bulk(value)
+		}
+		return reply
+	case "HDEL":
+		_, existed := hash[args[2]]
+		delete(hash, args[2])
+		if existed {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
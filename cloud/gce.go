@@ -5,7 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,6 +21,7 @@ import (
 	"google.golang.org/api/googleapi"
 
 	"github.com/mitchellh/multistep"
+	"github.com/travis-ci/cloud-brain/tracing"
 )
 
 var gceStartupScript = template.Must(template.New("gce-startup").Parse(`#!/usr/bin/env bash
@@ -49,34 +52,36 @@ type gceStartContext struct {
 	image            *compute.Image
 	script           string
 	bootStart        time.Time
+	zone             *gceZone
 	instance         *compute.Instance
 	instanceInsertOp *compute.Operation
-}
-
-type gceStopContext struct {
-	id               string
-	instChan         chan Instance
-	errChan          chan error
-	terminateStart   time.Time
-	instanceConfig   gceInstanceConfig
-	instance         *compute.Instance
-	instanceDeleteOp *compute.Operation
 	ctx              context.Context
 }
 
 type gceInstanceConfig struct {
-	MachineType        *compute.MachineType
-	PremiumMachineType *compute.MachineType
-	Zone               *compute.Zone
+	Zones              []*gceZone
 	Network            *compute.Network
-	DiskType           string
 	DiskSize           int64
 	HardTimeoutMinutes int64
 	AutoImplode        bool
 	Preemptible        bool
+	BootPrePollSleep   time.Duration
+	BootPollSleep      time.Duration
+	BootTimeout        time.Duration
 	SkipStopPoll       bool
 	StopPrePollSleep   time.Duration
 	StopPollSleep      time.Duration
+	StopTimeout        time.Duration
+}
+
+// gceZone contains the zone-specific configuration for one of the zones
+// instances can be created in.
+type gceZone struct {
+	Zone               *compute.Zone
+	Weight             int
+	MachineType        *compute.MachineType
+	PremiumMachineType *compute.MachineType
+	DiskType           string
 }
 
 // GCEAccountJSON represents the JSON key file received from GCE when creating a
@@ -88,19 +93,39 @@ type GCEAccountJSON struct {
 }
 
 // GCEProviderConfiguration contains all the configuration needed to create a
-// GCEProvider.
+// GCEProvider. Zone is only used if Zones is empty.
+//
+// The Boot* and Stop* settings control how the insert and delete operations
+// are polled. The timeouts default to 4 and 2 minutes, and the sleeps default
+// to 15 seconds before the first poll and 3 seconds between polls.
 type GCEProviderConfiguration struct {
-	AccountJSON         GCEAccountJSON `json:"account_json"`
-	ProjectID           string         `json:"project_id"`
-	ImageProjectID      string         `json:"image_project_id"`
-	Zone                string         `json:"zone"`
-	StandardMachineType string         `json:"standard_machine_type"`
-	PremiumMachineType  string         `json:"premium_machine_type"`
-	Network             string         `json:"network"`
-	DiskSize            int64          `json:"disk_size"`
-	AutoImplodeTime     time.Duration  `json:"auto_implode_time"`
-	AutoImplode         bool           `json:"auto_implode"`
-	Preemptible         bool           `json:"preemptible"`
+	AccountJSON         GCEAccountJSON         `json:"account_json"`
+	ProjectID           string                 `json:"project_id"`
+	ImageProjectID      string                 `json:"image_project_id"`
+	Zone                string                 `json:"zone"`
+	Zones               []GCEZoneConfiguration `json:"zones"`
+	StandardMachineType string                 `json:"standard_machine_type"`
+	PremiumMachineType  string                 `json:"premium_machine_type"`
+	Network             string                 `json:"network"`
+	DiskSize            int64                  `json:"disk_size"`
+	AutoImplodeTime     time.Duration          `json:"auto_implode_time"`
+	AutoImplode         bool                   `json:"auto_implode"`
+	Preemptible         bool                   `json:"preemptible"`
+	BootPrePollSleep    time.Duration          `json:"boot_pre_poll_sleep"`
+	BootPollSleep       time.Duration          `json:"boot_poll_sleep"`
+	BootTimeout         time.Duration          `json:"boot_timeout"`
+	SkipStopPoll        bool                   `json:"skip_stop_poll"`
+	StopPrePollSleep    time.Duration          `json:"stop_pre_poll_sleep"`
+	StopPollSleep       time.Duration          `json:"stop_poll_sleep"`
+	StopTimeout         time.Duration          `json:"stop_timeout"`
+}
+
+// GCEZoneConfiguration is a zone that instances can be created in. Zones with
+// a higher weight are more likely to be tried first when creating an
+// instance.
+type GCEZoneConfiguration struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
 }
 
 type gceStartupScriptInfo struct {
@@ -139,19 +164,40 @@ func NewGCEProvider(conf GCEProviderConfiguration) (*GCEProvider, error) {
 		return nil, err
 	}
 
-	zone, err := client.Zones.Get(conf.ProjectID, conf.Zone).Do()
-	if err != nil {
-		return nil, err
+	zoneConfigs := conf.Zones
+	if len(zoneConfigs) == 0 {
+		zoneConfigs = []GCEZoneConfiguration{{Name: conf.Zone, Weight: 1}}
 	}
 
-	machineType, err := client.MachineTypes.Get(conf.ProjectID, zone.Name, conf.StandardMachineType).Do()
-	if err != nil {
-		return nil, err
-	}
+	var zones []*gceZone
+	for _, zoneConfig := range zoneConfigs {
+		zone, err := client.Zones.Get(conf.ProjectID, zoneConfig.Name).Do()
+		if err != nil {
+			return nil, err
+		}
 
-	premiumMachineType, err := client.MachineTypes.Get(conf.ProjectID, zone.Name, conf.PremiumMachineType).Do()
-	if err != nil {
-		return nil, err
+		machineType, err := client.MachineTypes.Get(conf.ProjectID, zone.Name, conf.StandardMachineType).Do()
+		if err != nil {
+			return nil, err
+		}
+
+		premiumMachineType, err := client.MachineTypes.Get(conf.ProjectID, zone.Name, conf.PremiumMachineType).Do()
+		if err != nil {
+			return nil, err
+		}
+
+		weight := zoneConfig.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		zones = append(zones, &gceZone{
+			Zone:               zone,
+			Weight:             weight,
+			MachineType:        machineType,
+			PremiumMachineType: premiumMachineType,
+			DiskType:           fmt.Sprintf("zones/%s/diskTypes/pd-ssd", zone.Name),
+		})
 	}
 
 	network, err := client.Networks.Get(conf.ProjectID, conf.Network).Do()
@@ -166,66 +212,120 @@ func NewGCEProvider(conf GCEProviderConfiguration) (*GCEProvider, error) {
 		ic: &gceInstanceConfig{
 			Preemptible:        conf.Preemptible,
 			DiskSize:           conf.DiskSize,
-			DiskType:           fmt.Sprintf("zones/%s/diskTypes/pd-ssd", zone.Name),
-			MachineType:        machineType,
-			PremiumMachineType: premiumMachineType,
 			AutoImplode:        conf.AutoImplode,
 			HardTimeoutMinutes: int64(conf.AutoImplodeTime.Minutes()),
-			Zone:               zone,
+			Zones:              zones,
 			Network:            network,
+			BootPrePollSleep:   gceDurationOrDefault(conf.BootPrePollSleep, 15*time.Second),
+			BootPollSleep:      gceDurationOrDefault(conf.BootPollSleep, 3*time.Second),
+			BootTimeout:        gceDurationOrDefault(conf.BootTimeout, 4*time.Minute),
+			SkipStopPoll:       conf.SkipStopPoll,
+			StopPrePollSleep:   gceDurationOrDefault(conf.StopPrePollSleep, 15*time.Second),
+			StopPollSleep:      gceDurationOrDefault(conf.StopPollSleep, 3*time.Second),
+			StopTimeout:        gceDurationOrDefault(conf.StopTimeout, 2*time.Minute),
 		},
 	}, nil
 }
 
+func gceDurationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
 // List returns a list of all instances on Google Compute Engine that were
-// created by Cloud Brain.
-func (p *GCEProvider) List() ([]Instance, error) {
-	instanceList, err := p.client.Instances.List(p.projectID, p.ic.Zone.Name).Filter("name eq ^testing-gce-.+").Do()
+// created by Cloud Brain, across all zones.
+func (p *GCEProvider) List(ctx context.Context) ([]Instance, error) {
+	gceInstances, err := p.listInstances(ctx, "name eq ^testing-gce-.+")
 	if err != nil {
 		return nil, err
 	}
 
 	var instances []Instance
+	for _, gceInstance := range gceInstances {
+		instances = append(instances, gceInstanceToInstance(gceInstance))
+	}
+
+	return instances, nil
+}
 
-	for _, gceInstance := range instanceList.Items {
-		instance := Instance{
-			ID:         strings.TrimPrefix(gceInstance.Name, "testing-gce-"),
-			UpstreamID: strconv.FormatUint(gceInstance.Id, 10),
+// listInstances returns all instances matching the given filter in any zone.
+func (p *GCEProvider) listInstances(ctx context.Context, filter string) ([]*compute.Instance, error) {
+	return gceAggregatedInstances(func(pageToken string) (*compute.InstanceAggregatedList, error) {
+		call := p.client.Instances.AggregatedList(p.projectID).Filter(filter).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
 		}
+		return call.Do()
+	})
+}
 
-		for _, ni := range gceInstance.NetworkInterfaces {
-			if ni.AccessConfigs == nil {
-				continue
-			}
+// gceAggregatedInstances returns the instances on every page of an aggregated
+// list. listPage is called with the token of the page to fetch, starting with
+// an empty one for the first page, until a page has no next page token. If
+// fetching any page fails, the error is returned instead of a partial list.
+func gceAggregatedInstances(listPage func(pageToken string) (*compute.InstanceAggregatedList, error)) ([]*compute.Instance, error) {
+	var instances []*compute.Instance
+	pageToken := ""
+	for {
+		instanceList, err := listPage(pageToken)
+		if err != nil {
+			return nil, err
+		}
 
-			for _, ac := range ni.AccessConfigs {
-				if ac.NatIP != "" {
-					instance.IPAddress = ac.NatIP
-					break
-				}
-			}
+		for _, scopedList := range instanceList.Items {
+			instances = append(instances, scopedList.Instances...)
 		}
 
-		switch gceInstance.Status {
-		case "PROVISIONING", "STAGING":
-			instance.State = InstanceStateStarting
-		case "RUNNING":
-			instance.State = InstanceStateRunning
-		case "STOPPING":
-			instance.State = InstanceStateTerminating
-		case "TERMINATED":
-			instance.State = InstanceStateTerminated
+		if instanceList.NextPageToken == "" {
+			return instances, nil
 		}
+		pageToken = instanceList.NextPageToken
+	}
+}
 
-		instances = append(instances, instance)
+func gceInstanceToInstance(gceInstance *compute.Instance) Instance {
+	instance := Instance{
+		ID:         strings.TrimPrefix(gceInstance.Name, "testing-gce-"),
+		UpstreamID: strconv.FormatUint(gceInstance.Id, 10),
+		Zone:       path.Base(gceInstance.Zone),
 	}
 
-	return instances, nil
+	if createdAt, err := time.Parse(time.RFC3339, gceInstance.CreationTimestamp); err == nil {
+		instance.CreatedAt = createdAt
+	}
+
+	for _, ni := range gceInstance.NetworkInterfaces {
+		if ni.AccessConfigs == nil {
+			continue
+		}
+
+		for _, ac := range ni.AccessConfigs {
+			if ac.NatIP != "" {
+				instance.IPAddress = ac.NatIP
+				break
+			}
+		}
+	}
+
+	switch gceInstance.Status {
+	case "PROVISIONING", "STAGING":
+		instance.State = InstanceStateStarting
+	case "RUNNING":
+		instance.State = InstanceStateRunning
+	case "STOPPING":
+		instance.State = InstanceStateTerminating
+	case "TERMINATED":
+		instance.State = InstanceStateTerminated
+	}
+
+	return instance
 }
 
 // Create creates a new instance with the given ID and using the given
 // attributes.
-func (p *GCEProvider) Create(id string, attr CreateAttributes) (Instance, error) {
+func (p *GCEProvider) Create(ctx context.Context, id string, attr CreateAttributes) (Instance, error) {
 	state := &multistep.BasicStateBag{}
 
 	c := &gceStartContext{
@@ -233,13 +333,14 @@ func (p *GCEProvider) Create(id string, attr CreateAttributes) (Instance, error)
 		createAttrs: attr,
 		instChan:    make(chan Instance),
 		errChan:     make(chan error),
+		ctx:         ctx,
 	}
 
 	runner := &multistep.BasicRunner{
 		Steps: []multistep.Step{
-			&gceStartMultistepWrapper{c: c, f: p.stepGetImage},
-			&gceStartMultistepWrapper{c: c, f: p.stepRenderScript},
-			&gceStartMultistepWrapper{c: c, f: p.stepInsertInstance},
+			&gceStartMultistepWrapper{c: c, f: p.stepGetImage, name: "stepGetImage"},
+			&gceStartMultistepWrapper{c: c, f: p.stepRenderScript, name: "stepRenderScript"},
+			&gceStartMultistepWrapper{c: c, f: p.stepInsertInstance, name: "stepInsertInstance"},
 		},
 	}
 
@@ -247,7 +348,7 @@ func (p *GCEProvider) Create(id string, attr CreateAttributes) (Instance, error)
 	defer func(c *gceStartContext) {
 		if c.instance != nil && abandonedStart {
 			// TODO(sarahhodne): Can we remove this, or queue a delete job instead?
-			_, _ = p.client.Instances.Delete(p.projectID, p.ic.Zone.Name, c.instance.Name).Do()
+			_, _ = p.client.Instances.Delete(p.projectID, c.zone.Zone.Name, c.instance.Name).Do()
 		}
 	}(c)
 
@@ -262,52 +363,15 @@ func (p *GCEProvider) Create(id string, attr CreateAttributes) (Instance, error)
 	}
 }
 
-// Remove stops the instance with the given ID and terminates it.
-func (p *GCEProvider) Remove(id string) (Instance, error) {
-	state := &multistep.BasicStateBag{}
-
-	c := &gceStopContext{
-		id:       id,
-		instChan: make(chan Instance),
-		errChan:  make(chan error),
-	}
-
-	runner := &multistep.BasicRunner{
-		Steps: []multistep.Step{
-			&gceStopMultistepWrapper{c: c, f: p.stepDeleteInstance},
-		},
-	}
-
-	go runner.Run(state)
-
-	select {
-	case inst := <-c.instChan:
-		return inst, nil
-	case err := <-c.errChan:
-		return Instance{}, err
-	}
-}
-
-func (p *GCEProvider) stepDeleteInstance(c *gceStopContext) multistep.StepAction {
-	op, err := p.client.Instances.Delete(p.projectID, p.ic.Zone.Name, c.instance.Name).Do()
-	if err != nil {
-		c.errChan <- err
-		return multistep.ActionHalt
-	}
-
-	c.instanceDeleteOp = op
-	return multistep.ActionContinue
-}
-
 func (p *GCEProvider) stepGetImage(c *gceStartContext) multistep.StepAction {
-	images, err := p.client.Images.List(p.imageProjectID).Filter(fmt.Sprintf("name eq ^%s", c.createAttrs.ImageName)).Do()
+	images, err := p.client.Images.List(p.imageProjectID).Filter(fmt.Sprintf("name eq ^%s", c.createAttrs.ImageName)).Context(c.ctx).Do()
 	if err != nil {
 		c.errChan <- err
 		return multistep.ActionHalt
 	}
 
 	if len(images.Items) == 0 {
-		c.errChan <- fmt.Errorf("no image found with name %s", c.createAttrs.ImageName)
+		c.errChan <- &PermanentError{Err: fmt.Errorf("no image found with name %s", c.createAttrs.ImageName)}
 		return multistep.ActionHalt
 	}
 
@@ -340,35 +404,165 @@ func (p *GCEProvider) stepRenderScript(c *gceStartContext) multistep.StepAction
 	return multistep.ActionContinue
 }
 
+// stepInsertInstance inserts the instance into the first zone that has
+// capacity for it, trying the zones in a weighted random order. Capacity
+// errors can be returned both by the insert call and by the insert operation,
+// so the operation is waited for before moving on.
 func (p *GCEProvider) stepInsertInstance(c *gceStartContext) multistep.StepAction {
-	inst := p.buildInstance(c.id, c.createAttrs, c.image.SelfLink, c.script)
+	zones := gceZoneOrder(p.ic.Zones)
 
-	c.bootStart = time.Now().UTC()
+	for i, zone := range zones {
+		inst := p.buildInstance(c.id, c.createAttrs, c.image.SelfLink, c.script, zone)
 
-	op, err := p.client.Instances.Insert(p.projectID, p.ic.Zone.Name, inst).Do()
-	if err != nil {
-		c.errChan <- err
-		return multistep.ActionHalt
+		c.bootStart = time.Now().UTC()
+
+		op, err := p.client.Instances.Insert(p.projectID, zone.Zone.Name, inst).Context(c.ctx).Do()
+		if err == nil {
+			c.zone = zone
+			c.instance = inst
+
+			op, err = p.waitForZoneOperation(c.ctx, zone.Zone.Name, op, p.ic.BootPrePollSleep, p.ic.BootPollSleep, p.ic.BootTimeout)
+		}
+		if err != nil {
+			if gceIsCapacityError(err) && i < len(zones)-1 {
+				c.instance = nil
+				continue
+			}
+
+			c.errChan <- fmt.Errorf("error creating instance in zone %s: %v", zone.Zone.Name, err)
+			return multistep.ActionHalt
+		}
+
+		c.instanceInsertOp = op
+
+		c.instChan <- Instance{
+			ID:         c.id,
+			State:      InstanceStateStarting,
+			UpstreamID: strconv.FormatUint(op.TargetId, 10),
+			Zone:       zone.Zone.Name,
+		}
+		return multistep.ActionContinue
 	}
 
-	c.instance = inst
-	c.instanceInsertOp = op
+	c.errChan <- fmt.Errorf("no zones configured")
+	return multistep.ActionHalt
+}
+
+// gceZoneOrder returns the zones in a random order, where zones with a higher
+// weight are more likely to come first.
+func gceZoneOrder(zones []*gceZone) []*gceZone {
+	remaining := make([]*gceZone, len(zones))
+	copy(remaining, zones)
+
+	ordered := make([]*gceZone, 0, len(zones))
+	for len(remaining) > 0 {
+		totalWeight := 0
+		for _, zone := range remaining {
+			totalWeight += zone.Weight
+		}
 
-	c.instChan <- Instance{
-		ID:         c.id,
-		State:      InstanceStateStarting,
-		UpstreamID: strconv.FormatUint(inst.Id, 10),
+		n := rand.Intn(totalWeight)
+		for i, zone := range remaining {
+			n -= zone.Weight
+			if n < 0 {
+				ordered = append(ordered, zone)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
 	}
-	return multistep.ActionContinue
+
+	return ordered
+}
+
+// gceIsCapacityError returns true if the error means that the zone doesn't
+// have the resources or quota to create the instance, so another zone should
+// be tried.
+func gceIsCapacityError(err error) bool {
+	switch gceErr := err.(type) {
+	case *googleapi.Error:
+		for _, item := range gceErr.Errors {
+			if gceIsCapacityReason(item.Reason) {
+				return true
+			}
+		}
+
+		return strings.Contains(gceErr.Message, "ZONE_RESOURCE_POOL_EXHAUSTED") || strings.Contains(gceErr.Message, "QUOTA_EXCEEDED")
+	case *gceOperationError:
+		for _, item := range gceErr.op.Error.Errors {
+			if gceIsCapacityReason(item.Code) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
-func (p *GCEProvider) buildInstance(id string, createAttrs CreateAttributes, imageLink, startupScript string) *compute.Instance {
+func gceIsCapacityReason(reason string) bool {
+	switch reason {
+	case "ZONE_RESOURCE_POOL_EXHAUSTED", "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS", "QUOTA_EXCEEDED", "quotaExceeded", "resourceExhausted":
+		return true
+	}
+
+	return false
+}
+
+// gceOperationError is returned when a GCE operation finishes with errors.
+type gceOperationError struct {
+	op *compute.Operation
+}
+
+func (e *gceOperationError) Error() string {
+	var messages []string
+	for _, item := range e.op.Error.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", item.Code, item.Message))
+	}
+
+	return fmt.Sprintf("operation %s failed: %s", e.op.Name, strings.Join(messages, ", "))
+}
+
+// waitForZoneOperation polls the given zone operation until it's done, and
+// returns the finished operation. Returns a *gceOperationError if the
+// operation finished with errors, or another error if the operation couldn't
+// be polled or didn't finish within the timeout or before ctx is done.
+func (p *GCEProvider) waitForZoneOperation(parentCtx context.Context, zone string, op *compute.Operation, prePollSleep, pollSleep, timeout time.Duration) (*compute.Operation, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	sleep := prePollSleep
+	for op.Status != "DONE" {
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			if parentCtx.Err() != nil {
+				return nil, fmt.Errorf("gave up waiting for operation %s: %v", op.Name, parentCtx.Err())
+			}
+			return nil, fmt.Errorf("timed out after %v waiting for operation %s", timeout, op.Name)
+		}
+		sleep = pollSleep
+
+		var err error
+		op, err = p.client.ZoneOperations.Get(p.projectID, zone, op.Name).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return nil, &gceOperationError{op: op}
+	}
+
+	return op, nil
+}
+
+func (p *GCEProvider) buildInstance(id string, createAttrs CreateAttributes, imageLink, startupScript string, zone *gceZone) *compute.Instance {
 	var machineType *compute.MachineType
 	switch createAttrs.InstanceType {
 	case InstanceTypePremium:
-		machineType = p.ic.PremiumMachineType
+		machineType = zone.PremiumMachineType
 	default:
-		machineType = p.ic.MachineType
+		machineType = zone.MachineType
 	}
 
 	return &compute.Instance{
@@ -381,7 +575,7 @@ func (p *GCEProvider) buildInstance(id string, createAttrs CreateAttributes, ima
 				AutoDelete: true,
 				InitializeParams: &compute.AttachedDiskInitializeParams{
 					SourceImage: imageLink,
-					DiskType:    p.ic.DiskType,
+					DiskType:    zone.DiskType,
 					DiskSizeGb:  p.ic.DiskSize,
 				},
 			},
@@ -429,83 +623,78 @@ func (p *GCEProvider) buildInstance(id string, createAttrs CreateAttributes, ima
 }
 
 // Get retrieves information about the instance with the given name from Google
-// Compute Engine. Return ErrInstanceNotFound if an instance with the given ID
-// wasn't found, or some other error if we were unable to get information about
-// the instance.
-func (p *GCEProvider) Get(id string) (Instance, error) {
-	gceInstance, err := p.client.Instances.Get(p.projectID, p.ic.Zone.Name, fmt.Sprintf("testing-gce-%s", id)).Do()
+// Compute Engine, looking in all zones. Return ErrInstanceNotFound if an
+// instance with the given ID wasn't found, or some other error if we were
+// unable to get information about the instance.
+func (p *GCEProvider) Get(ctx context.Context, id string) (Instance, error) {
+	gceInstance, err := p.getInstance(ctx, id)
 	if err != nil {
-		if gceErr, ok := err.(*googleapi.Error); ok && gceErr.Code == http.StatusNotFound {
-			return Instance{}, ErrInstanceNotFound
-		}
 		return Instance{}, err
 	}
 
-	instance := Instance{
-		ID:         id,
-		UpstreamID: strconv.FormatUint(gceInstance.Id, 10),
-	}
-
-	for _, ni := range gceInstance.NetworkInterfaces {
-		if ni.AccessConfigs == nil {
-			continue
-		}
+	return gceInstanceToInstance(gceInstance), nil
+}
 
-		for _, ac := range ni.AccessConfigs {
-			if ac.NatIP != "" {
-				instance.IPAddress = ac.NatIP
-				break
-			}
-		}
+func (p *GCEProvider) getInstance(ctx context.Context, id string) (*compute.Instance, error) {
+	gceInstances, err := p.listInstances(ctx, fmt.Sprintf("name eq testing-gce-%s", id))
+	if err != nil {
+		return nil, err
 	}
 
-	switch gceInstance.Status {
-	case "PROVISIONING", "STAGING":
-		instance.State = InstanceStateStarting
-	case "RUNNING":
-		instance.State = InstanceStateRunning
-	case "STOPPING":
-		instance.State = InstanceStateTerminating
-	case "TERMINATED":
-		instance.State = InstanceStateTerminated
+	if len(gceInstances) == 0 {
+		return nil, ErrInstanceNotFound
 	}
 
-	return instance, nil
+	return gceInstances[0], nil
 }
 
 // Destroy terminates and removes the instance with the given ID. Returns
 // ErrInstanceNotFound if an instance with the given ID wasn't found, or some
-// other error if another error occurred. Does not wait for the instance to
-// terminate, will return as soon as the destroy job is enqueued with GCE.
-func (p *GCEProvider) Destroy(id string) error {
-	_, err := p.client.Instances.Delete(p.projectID, p.ic.Zone.Name, fmt.Sprintf("testing-gce-%s", id)).Do()
+// other error if another error occurred. Waits for the delete operation to
+// finish unless SkipStopPoll is set.
+func (p *GCEProvider) Destroy(ctx context.Context, id string) error {
+	gceInstance, err := p.getInstance(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	zone := path.Base(gceInstance.Zone)
+	op, err := p.client.Instances.Delete(p.projectID, zone, gceInstance.Name).Context(ctx).Do()
 	if err != nil {
 		if gceErr, ok := err.(*googleapi.Error); ok && gceErr.Code == http.StatusNotFound {
 			return ErrInstanceNotFound
 		}
+		return err
 	}
 
-	return err
-}
+	if p.ic.SkipStopPoll {
+		return nil
+	}
 
-type gceStartMultistepWrapper struct {
-	f func(*gceStartContext) multistep.StepAction
-	c *gceStartContext
+	_, err = p.waitForZoneOperation(ctx, zone, op, p.ic.StopPrePollSleep, p.ic.StopPollSleep, p.ic.StopTimeout)
+	if err != nil {
+		return fmt.Errorf("error deleting instance in zone %s: %v", zone, err)
+	}
+
+	return nil
 }
 
-type gceStopMultistepWrapper struct {
-	f func(*gceStopContext) multistep.StepAction
-	c *gceStopContext
+type gceStartMultistepWrapper struct {
+	f    func(*gceStartContext) multistep.StepAction
+	c    *gceStartContext
+	name string
 }
 
+// Run runs the step in a span of its own, so that slow steps show up in traces.
 func (gismw *gceStartMultistepWrapper) Run(multistep.StateBag) multistep.StepAction {
-	return gismw.f(gismw.c)
-}
+	parentCtx := gismw.c.ctx
+	ctx, span := tracing.StartSpan(parentCtx, "GCEProvider."+gismw.name)
+	defer span.End()
 
-func (gismw *gceStartMultistepWrapper) Cleanup(multistep.StateBag) { return }
+	gismw.c.ctx = ctx
+	defer func() { gismw.c.ctx = parentCtx }()
 
-func (gismw *gceStopMultistepWrapper) Run(multistep.StateBag) multistep.StepAction {
 	return gismw.f(gismw.c)
 }
 
-func (gismw *gceStopMultistepWrapper) Cleanup(multistep.StateBag) { return }
+func (gismw *gceStartMultistepWrapper) Cleanup(multistep.StateBag) { return }
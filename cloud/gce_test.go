@@ -1,4 +1,114 @@
 package cloud
 
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
 // Ensure that GCEProvider implements the Provider interface
 var _ Provider = &GCEProvider{}
+
+func TestGCEZoneOrder(t *testing.T) {
+	zones := []*gceZone{
+		{Zone: &compute.Zone{Name: "us-central1-a"}, Weight: 1},
+		{Zone: &compute.Zone{Name: "us-central1-b"}, Weight: 1000000},
+		{Zone: &compute.Zone{Name: "us-central1-c"}, Weight: 1},
+	}
+
+	ordered := gceZoneOrder(zones)
+	if len(ordered) != len(zones) {
+		t.Fatalf("expected %d zones, got %d", len(zones), len(ordered))
+	}
+	if ordered[0].Zone.Name != "us-central1-b" {
+		t.Errorf("expected the heaviest zone first, got %v", ordered[0].Zone.Name)
+	}
+
+	seen := make(map[string]bool)
+	for _, zone := range ordered {
+		seen[zone.Zone.Name] = true
+	}
+	if len(seen) != len(zones) {
+		t.Errorf("expected every zone exactly once, got %v", seen)
+	}
+}
+
+func TestGCEAggregatedInstancesPages(t *testing.T) {
+	pages := map[string]*compute.InstanceAggregatedList{
+		"": {
+			Items: map[string]compute.InstancesScopedList{
+				"zones/us-central1-a": {Instances: []*compute.Instance{{Name: "testing-gce-1"}}},
+				"zones/us-central1-b": {},
+			},
+			NextPageToken: "page-2",
+		},
+		"page-2": {
+			Items: map[string]compute.InstancesScopedList{
+				"zones/us-central1-b": {Instances: []*compute.Instance{{Name: "testing-gce-2"}, {Name: "testing-gce-3"}}},
+			},
+		},
+	}
+
+	var tokens []string
+	instances, err := gceAggregatedInstances(func(pageToken string) (*compute.InstanceAggregatedList, error) {
+		tokens = append(tokens, pageToken)
+		return pages[pageToken], nil
+	})
+	if err != nil {
+		t.Fatalf("gceAggregatedInstances returned error: %v", err)
+	}
+	if len(tokens) != 2 || tokens[1] != "page-2" {
+		t.Errorf("expected both pages to be fetched, got %q", tokens)
+	}
+	if len(instances) != 3 {
+		t.Errorf("expected the instances on both pages, got %d", len(instances))
+	}
+
+	_, err = gceAggregatedInstances(func(pageToken string) (*compute.InstanceAggregatedList, error) {
+		if pageToken == "page-2" {
+			return nil, fmt.Errorf("backend error")
+		}
+		return pages[pageToken], nil
+	})
+	if err == nil {
+		t.Error("expected an error for a failed page instead of a partial list")
+	}
+}
+
+func TestGCEIsCapacityError(t *testing.T) {
+	capacityErr := &googleapi.Error{
+		Code:   http.StatusServiceUnavailable,
+		Errors: []googleapi.ErrorItem{{Reason: "ZONE_RESOURCE_POOL_EXHAUSTED"}},
+	}
+	if !gceIsCapacityError(capacityErr) {
+		t.Errorf("expected %v to be a capacity error", capacityErr)
+	}
+
+	notFoundErr := &googleapi.Error{Code: http.StatusNotFound, Message: "image not found"}
+	if gceIsCapacityError(notFoundErr) {
+		t.Errorf("expected %v not to be a capacity error", notFoundErr)
+	}
+}
+
+func TestGCEOperationError(t *testing.T) {
+	opErr := &gceOperationError{op: &compute.Operation{
+		Name: "operation-1",
+		Error: &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{
+				{Code: "ZONE_RESOURCE_POOL_EXHAUSTED", Message: "The zone does not have enough resources"},
+			},
+		},
+	}}
+
+	if !gceIsCapacityError(opErr) {
+		t.Errorf("expected %v to be a capacity error", opErr)
+	}
+
+	expected := "operation operation-1 failed: ZONE_RESOURCE_POOL_EXHAUSTED: The zone does not have enough resources"
+	if opErr.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, opErr.Error())
+	}
+}
@@ -0,0 +1,584 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// openStackInstanceIDKey is the server metadata key that all servers created
+// by Cloud Brain have set. The value is the Cloud Brain instance ID.
+const openStackInstanceIDKey = "cloud-brain-id"
+
+var openStackUserData = template.Must(template.New("openstack-user-data").Parse(`#cloud-config
+users:
+  - default
+  - name: travis
+    ssh_authorized_keys:
+      - {{ .SSHPubKey }}
+{{ if .AutoImplode }}runcmd:
+  - echo poweroff | at now + {{ .AutoImplodeMinutes }} minutes
+{{ end }}`))
+
+func init() {
+	registerProvider("openstack", "OpenStack", NewOpenStackProviderFromJSON)
+}
+
+// OpenStackProvider is an implementation of cloud.Provider backed by an
+// OpenStack cloud. It authenticates using Keystone v3 and manages servers
+// through the Nova compute API.
+type OpenStackProvider struct {
+	client *http.Client
+	conf   OpenStackProviderConfiguration
+	ic     *openStackInstanceConfig
+
+	authMutex      sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+	endpoints      map[string]string
+}
+
+type openStackInstanceConfig struct {
+	StandardFlavorID   string
+	PremiumFlavorID    string
+	NetworkID          string
+	SecurityGroups     []string
+	KeyName            string
+	HardTimeoutMinutes int64
+	AutoImplode        bool
+}
+
+// OpenStackProviderConfiguration contains all the configuration needed to
+// create an OpenStackProvider.
+type OpenStackProviderConfiguration struct {
+	AuthURL           string        `json:"auth_url"`
+	Username          string        `json:"username"`
+	Password          string        `json:"password"`
+	UserDomainName    string        `json:"user_domain_name"`
+	ProjectName       string        `json:"project_name"`
+	ProjectDomainName string        `json:"project_domain_name"`
+	Region            string        `json:"region"`
+	StandardFlavor    string        `json:"standard_flavor"`
+	PremiumFlavor     string        `json:"premium_flavor"`
+	NetworkID         string        `json:"network_id"`
+	SecurityGroups    []string      `json:"security_groups"`
+	KeyName           string        `json:"key_name"`
+	AutoImplodeTime   time.Duration `json:"auto_implode_time"`
+	AutoImplode       bool          `json:"auto_implode"`
+}
+
+type openStackUserDataInfo struct {
+	AutoImplode        bool
+	AutoImplodeMinutes int64
+	SSHPubKey          string
+}
+
+// NewOpenStackProviderFromJSON deserializes the given jsonConfig into an
+// OpenStackProviderConfiguration and creates an OpenStackProvider from that.
+// Used to register the provider with the registry.
+func NewOpenStackProviderFromJSON(jsonConfig []byte) (Provider, error) {
+	var config OpenStackProviderConfiguration
+	err := json.Unmarshal(jsonConfig, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewOpenStackProvider(config)
+}
+
+// NewOpenStackProvider creates a new OpenStackProvider with the given
+// configuration. It authenticates with Keystone and resolves the configured
+// flavors, so it returns an error if the cloud can't be reached.
+func NewOpenStackProvider(conf OpenStackProviderConfiguration) (*OpenStackProvider, error) {
+	if conf.UserDomainName == "" {
+		conf.UserDomainName = "Default"
+	}
+	if conf.ProjectDomainName == "" {
+		conf.ProjectDomainName = "Default"
+	}
+
+	p := &OpenStackProvider{
+		client: &http.Client{Timeout: time.Minute},
+		conf:   conf,
+	}
+
+	standardFlavorID, err := p.findFlavor(context.Background(), conf.StandardFlavor)
+	if err != nil {
+		return nil, err
+	}
+
+	premiumFlavorID, err := p.findFlavor(context.Background(), conf.PremiumFlavor)
+	if err != nil {
+		return nil, err
+	}
+
+	p.ic = &openStackInstanceConfig{
+		StandardFlavorID:   standardFlavorID,
+		PremiumFlavorID:    premiumFlavorID,
+		NetworkID:          conf.NetworkID,
+		SecurityGroups:     conf.SecurityGroups,
+		KeyName:            conf.KeyName,
+		HardTimeoutMinutes: int64(conf.AutoImplodeTime.Minutes()),
+		AutoImplode:        conf.AutoImplode,
+	}
+
+	return p, nil
+}
+
+// List returns a list of all servers on OpenStack that were created by Cloud
+// Brain.
+func (p *OpenStackProvider) List(ctx context.Context) ([]Instance, error) {
+	servers, err := p.listServers(ctx, "^testing-openstack-")
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, server := range servers {
+		if _, ok := server.Metadata[openStackInstanceIDKey]; !ok {
+			continue
+		}
+		instances = append(instances, server.toInstance())
+	}
+
+	return instances, nil
+}
+
+// Create creates a new server with the given ID and using the given
+// attributes. The public SSH key is injected using cloud-init.
+func (p *OpenStackProvider) Create(ctx context.Context, id string, attr CreateAttributes) (Instance, error) {
+	imageID, err := p.findImage(ctx, attr.ImageName)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	var userData bytes.Buffer
+	err = openStackUserData.Execute(&userData, openStackUserDataInfo{
+		AutoImplode:        p.ic.AutoImplode,
+		AutoImplodeMinutes: p.ic.HardTimeoutMinutes,
+		SSHPubKey:          attr.PublicSSHKey,
+	})
+	if err != nil {
+		return Instance{}, err
+	}
+
+	flavorID := p.ic.StandardFlavorID
+	if attr.InstanceType == InstanceTypePremium {
+		flavorID = p.ic.PremiumFlavorID
+	}
+
+	server := openStackCreateServer{
+		Name:      fmt.Sprintf("testing-openstack-%s", id),
+		ImageRef:  imageID,
+		FlavorRef: flavorID,
+		UserData:  base64.StdEncoding.EncodeToString(userData.Bytes()),
+		KeyName:   p.ic.KeyName,
+		Metadata: map[string]string{
+			openStackInstanceIDKey: id,
+		},
+	}
+	if p.ic.NetworkID != "" {
+		server.Networks = []openStackNetwork{{UUID: p.ic.NetworkID}}
+	}
+	for _, securityGroup := range p.ic.SecurityGroups {
+		server.SecurityGroups = append(server.SecurityGroups, openStackSecurityGroup{Name: securityGroup})
+	}
+
+	var resp struct {
+		Server struct {
+			ID string `json:"id"`
+		} `json:"server"`
+	}
+	err = p.do(ctx, "POST", "compute", "/servers", map[string]interface{}{"server": server}, &resp)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	return Instance{
+		ID:         id,
+		State:      InstanceStateStarting,
+		UpstreamID: resp.Server.ID,
+	}, nil
+}
+
+// Get retrieves information about the server with the given ID from Nova.
+// Returns ErrInstanceNotFound if a server with the given ID wasn't found, or
+// some other error if we were unable to get information about the server.
+func (p *OpenStackProvider) Get(ctx context.Context, id string) (Instance, error) {
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	return server.toInstance(), nil
+}
+
+// Destroy deletes the server with the given ID. Returns ErrInstanceNotFound
+// if a server with the given ID wasn't found, or some other error if another
+// error occurred. Does not wait for the server to be deleted.
+func (p *OpenStackProvider) Destroy(ctx context.Context, id string) error {
+	server, err := p.getServer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = p.do(ctx, "DELETE", "compute", "/servers/"+server.ID, nil, nil)
+	if httpErr, ok := err.(*openStackError); ok && httpErr.StatusCode == http.StatusNotFound {
+		return ErrInstanceNotFound
+	}
+
+	return err
+}
+
+func (p *OpenStackProvider) getServer(ctx context.Context, id string) (openStackServer, error) {
+	servers, err := p.listServers(ctx, fmt.Sprintf("^testing-openstack-%s$", id))
+	if err != nil {
+		return openStackServer{}, err
+	}
+
+	for _, server := range servers {
+		if server.Metadata[openStackInstanceIDKey] == id {
+			return server, nil
+		}
+	}
+
+	return openStackServer{}, ErrInstanceNotFound
+}
+
+// listServers returns the servers with names matching the filter, following
+// the pagination links until the last page.
+func (p *OpenStackProvider) listServers(ctx context.Context, nameFilter string) ([]openStackServer, error) {
+	query := url.Values{}
+	query.Set("name", nameFilter)
+
+	var servers []openStackServer
+	for {
+		var resp struct {
+			Servers []openStackServer `json:"servers"`
+			Links   []openStackLink   `json:"servers_links"`
+		}
+		err := p.do(ctx, "GET", "compute", "/servers/detail?"+query.Encode(), nil, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		servers = append(servers, resp.Servers...)
+
+		marker := nextPageMarker(resp.Links)
+		if marker == "" || len(resp.Servers) == 0 {
+			return servers, nil
+		}
+		query.Set("marker", marker)
+	}
+}
+
+// openStackLink is a link in a paginated response from Nova.
+type openStackLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// nextPageMarker returns the marker of the next page from the links of a
+// paginated response, or an empty string if it's the last page.
+func nextPageMarker(links []openStackLink) string {
+	for _, link := range links {
+		if link.Rel != "next" {
+			continue
+		}
+
+		u, err := url.Parse(link.Href)
+		if err != nil {
+			return ""
+		}
+		return u.Query().Get("marker")
+	}
+
+	return ""
+}
+
+// findFlavor returns the ID of the flavor with the given name or ID.
+func (p *OpenStackProvider) findFlavor(ctx context.Context, nameOrID string) (string, error) {
+	var resp struct {
+		Flavors []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"flavors"`
+	}
+	err := p.do(ctx, "GET", "compute", "/flavors", nil, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	for _, flavor := range resp.Flavors {
+		if flavor.ID == nameOrID || flavor.Name == nameOrID {
+			return flavor.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no flavor found with name %s", nameOrID)
+}
+
+// findImage returns the ID of the image with the given name, looked up using
+// the Glance image API.
+func (p *OpenStackProvider) findImage(ctx context.Context, name string) (string, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	query.Set("status", "active")
+
+	var resp struct {
+		Images []struct {
+			ID string `json:"id"`
+		} `json:"images"`
+	}
+	err := p.do(ctx, "GET", "image", "/v2/images?"+query.Encode(), nil, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Images) == 0 {
+		return "", fmt.Errorf("no image found with name %s", name)
+	}
+
+	return resp.Images[0].ID, nil
+}
+
+// do performs an authenticated JSON request against the given path on the
+// endpoint for the given service type from the service catalog. If the token
+// turns out to have expired, it re-authenticates once.
+func (p *OpenStackProvider) do(ctx context.Context, method, service, path string, in, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		token, endpoints, err := p.authenticate(ctx, attempt > 0)
+		if err != nil {
+			return err
+		}
+
+		var body io.Reader
+		if in != nil {
+			encoded, err := json.Marshal(in)
+			if err != nil {
+				return err
+			}
+			body = bytes.NewReader(encoded)
+		}
+
+		req, err := http.NewRequest(method, strings.TrimSuffix(endpoints[service], "/")+path, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", token)
+
+		resp, err := p.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			continue
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return &openStackError{StatusCode: resp.StatusCode, Body: string(respBody)}
+		}
+
+		if out == nil || len(respBody) == 0 {
+			return nil
+		}
+
+		return json.Unmarshal(respBody, out)
+	}
+}
+
+// authenticate returns a valid Keystone token, requesting a new one if the
+// current one is about to expire or force is true. The public compute and image
+// endpoints are picked from the service catalog returned with the token.
+func (p *OpenStackProvider) authenticate(ctx context.Context, force bool) (string, map[string]string, error) {
+	p.authMutex.Lock()
+	defer p.authMutex.Unlock()
+
+	if !force && p.token != "" && time.Now().Add(time.Minute).Before(p.tokenExpiresAt) {
+		return p.token, p.endpoints, nil
+	}
+
+	authReq := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     p.conf.Username,
+						"password": p.conf.Password,
+						"domain":   map[string]string{"name": p.conf.UserDomainName},
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   p.conf.ProjectName,
+					"domain": map[string]string{"name": p.conf.ProjectDomainName},
+				},
+			},
+		},
+	}
+
+	encoded, err := json.Marshal(authReq)
+	if err != nil {
+		return "", nil, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(p.conf.AuthURL, "/")+"/auth/tokens", bytes.NewReader(encoded))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return "", nil, fmt.Errorf("keystone authentication failed: %v", &openStackError{StatusCode: resp.StatusCode, Body: string(respBody)})
+	}
+
+	var tokenResp struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	endpoints := make(map[string]string)
+	for _, service := range tokenResp.Token.Catalog {
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface != "public" || (p.conf.Region != "" && endpoint.Region != p.conf.Region) {
+				continue
+			}
+			endpoints[service.Type] = endpoint.URL
+		}
+	}
+
+	for _, service := range []string{"compute", "image"} {
+		if endpoints[service] == "" {
+			return "", nil, fmt.Errorf("no public %s endpoint found in the service catalog", service)
+		}
+	}
+
+	p.token = resp.Header.Get("X-Subject-Token")
+	p.tokenExpiresAt = tokenResp.Token.ExpiresAt
+	p.endpoints = endpoints
+
+	return p.token, p.endpoints, nil
+}
+
+type openStackNetwork struct {
+	UUID string `json:"uuid"`
+}
+
+type openStackSecurityGroup struct {
+	Name string `json:"name"`
+}
+
+type openStackCreateServer struct {
+	Name           string                   `json:"name"`
+	ImageRef       string                   `json:"imageRef"`
+	FlavorRef      string                   `json:"flavorRef"`
+	UserData       string                   `json:"user_data"`
+	KeyName        string                   `json:"key_name,omitempty"`
+	Metadata       map[string]string        `json:"metadata"`
+	Networks       []openStackNetwork       `json:"networks,omitempty"`
+	SecurityGroups []openStackSecurityGroup `json:"security_groups,omitempty"`
+}
+
+type openStackServer struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	Metadata  map[string]string `json:"metadata"`
+	Created   time.Time         `json:"created"`
+	Addresses map[string][]struct {
+		Addr    string `json:"addr"`
+		Version int    `json:"version"`
+		Type    string `json:"OS-EXT-IPS:type"`
+	} `json:"addresses"`
+	Fault *struct {
+		Message string `json:"message"`
+	} `json:"fault"`
+}
+
+func (s openStackServer) toInstance() Instance {
+	instance := Instance{
+		ID:         s.Metadata[openStackInstanceIDKey],
+		UpstreamID: s.ID,
+		CreatedAt:  s.Created,
+	}
+
+	// Prefer a floating IP, but fall back to a fixed IPv4 address
+	for _, addresses := range s.Addresses {
+		for _, address := range addresses {
+			if address.Version != 4 {
+				continue
+			}
+			if address.Type == "floating" || instance.IPAddress == "" {
+				instance.IPAddress = address.Addr
+			}
+		}
+	}
+
+	switch s.Status {
+	case "BUILD":
+		instance.State = InstanceStateStarting
+	case "ACTIVE":
+		instance.State = InstanceStateRunning
+	case "DELETED", "SHUTOFF", "SOFT_DELETED":
+		instance.State = InstanceStateTerminated
+	case "ERROR":
+		// The server still exists and counts against the quota, so it has
+		// to be removed
+		instance.State = InstanceStateErrored
+		if s.Fault != nil {
+			instance.ErrorReason = s.Fault.Message
+		}
+	}
+
+	return instance
+}
+
+type openStackError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *openStackError) Error() string {
+	return fmt.Sprintf("openstack API returned status %d: %s", e.StatusCode, e.Body)
+}
@@ -0,0 +1,233 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Ensure that OpenStackProvider implements the Provider interface
+var _ Provider = &OpenStackProvider{}
+
+// fakeOpenStackServer is a minimal stand-in for Keystone, Nova and Glance,
+// supporting just enough of them for OpenStackProvider.
+type fakeOpenStackServer struct {
+	url string
+
+	mutex   sync.Mutex
+	servers map[string]map[string]interface{}
+	created map[string]interface{}
+
+	// pageSize, if not zero, is the number of servers returned per page when
+	// listing servers
+	pageSize int
+}
+
+func (s *fakeOpenStackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.URL.Path == "/identity/v3/auth/tokens" {
+		w.Header().Set("X-Subject-Token", "the-token")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token": map[string]interface{}{
+				"expires_at": time.Now().Add(time.Hour),
+				"catalog": []interface{}{
+					map[string]interface{}{"type": "compute", "endpoints": []interface{}{
+						map[string]string{"interface": "public", "region": "RegionOne", "url": s.url + "/compute/v2.1"},
+					}},
+					map[string]interface{}{"type": "image", "endpoints": []interface{}{
+						map[string]string{"interface": "public", "region": "RegionOne", "url": s.url + "/image"},
+					}},
+				},
+			},
+		})
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != "the-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/compute/v2.1/flavors":
+		fmt.Fprint(w, `{"flavors": [{"id": "1", "name": "m1.medium"}, {"id": "2", "name": "m1.large"}]}`)
+	case r.Method == "GET" && r.URL.Path == "/image/v2/images":
+		fmt.Fprintf(w, `{"images": [{"id": "image-%s"}]}`, r.URL.Query().Get("name"))
+	case r.Method == "POST" && r.URL.Path == "/compute/v2.1/servers":
+		var req struct {
+			Server map[string]interface{} `json:"server"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		s.created = req.Server
+
+		id := fmt.Sprintf("server-%d", len(s.servers))
+		s.servers[id] = map[string]interface{}{
+			"id":       id,
+			"name":     req.Server["name"],
+			"status":   "BUILD",
+			"metadata": req.Server["metadata"],
+			"addresses": map[string]interface{}{
+				"private": []interface{}{
+					map[string]interface{}{"addr": "10.0.0.5", "version": 4, "OS-EXT-IPS:type": "fixed"},
+				},
+			},
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"server": map[string]string{"id": id}})
+	case r.Method == "GET" && r.URL.Path == "/compute/v2.1/servers/detail":
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Query().Get("name"), "^"), "$")
+		marker := r.URL.Query().Get("marker")
+
+		var ids []string
+		for id, server := range s.servers {
+			if strings.HasPrefix(server["name"].(string), name) && id > marker {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		resp := map[string]interface{}{}
+		if s.pageSize > 0 && len(ids) > s.pageSize {
+			ids = ids[:s.pageSize]
+			next := url.Values{}
+			next.Set("name", r.URL.Query().Get("name"))
+			next.Set("marker", ids[len(ids)-1])
+			resp["servers_links"] = []interface{}{
+				map[string]string{"rel": "next", "href": s.url + "/compute/v2.1/servers/detail?" + next.Encode()},
+			}
+		}
+
+		servers := []interface{}{}
+		for _, id := range ids {
+			servers = append(servers, s.servers[id])
+		}
+		resp["servers"] = servers
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/compute/v2.1/servers/"):
+		id := strings.TrimPrefix(r.URL.Path, "/compute/v2.1/servers/")
+		if _, ok := s.servers[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.servers, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestOpenStackProviderLifecycle(t *testing.T) {
+	fake := &fakeOpenStackServer{servers: make(map[string]map[string]interface{})}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.url = server.URL
+
+	provider, err := NewOpenStackProvider(OpenStackProviderConfiguration{
+		AuthURL:        server.URL + "/identity/v3",
+		Username:       "travis",
+		Password:       "secret",
+		ProjectName:    "ci",
+		Region:         "RegionOne",
+		StandardFlavor: "m1.medium",
+		PremiumFlavor:  "m1.large",
+	})
+	if err != nil {
+		t.Fatalf("NewOpenStackProvider returned error: %v", err)
+	}
+
+	instance, err := provider.Create(context.Background(), "some-id", CreateAttributes{
+		ImageName:    "travis-ci-trusty",
+		InstanceType: InstanceTypePremium,
+		PublicSSHKey: "ssh-rsa AAAA",
+	})
+	if err != nil {
+		t.Fatalf("provider.Create returned error: %v", err)
+	}
+	if instance.ID != "some-id" || instance.State != InstanceStateStarting {
+		t.Errorf("unexpected instance from Create: %+v", instance)
+	}
+	if fake.created["flavorRef"] != "2" {
+		t.Errorf("expected premium flavor 2, was %v", fake.created["flavorRef"])
+	}
+	if fake.created["imageRef"] != "image-travis-ci-trusty" {
+		t.Errorf("expected image image-travis-ci-trusty, was %v", fake.created["imageRef"])
+	}
+
+	instances, err := provider.List(context.Background())
+	if err != nil {
+		t.Fatalf("provider.List returned error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != "some-id" || instances[0].IPAddress != "10.0.0.5" {
+		t.Errorf("unexpected instances from List: %+v", instances)
+	}
+
+	err = provider.Destroy(context.Background(), "some-id")
+	if err != nil {
+		t.Fatalf("provider.Destroy returned error: %v", err)
+	}
+
+	_, err = provider.Get(context.Background(), "some-id")
+	if err != ErrInstanceNotFound {
+		t.Errorf("expected ErrInstanceNotFound, got %v", err)
+	}
+}
+
+func TestOpenStackProviderListPages(t *testing.T) {
+	fake := &fakeOpenStackServer{servers: make(map[string]map[string]interface{}), pageSize: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.url = server.URL
+
+	provider, err := NewOpenStackProvider(OpenStackProviderConfiguration{
+		AuthURL:        server.URL + "/identity/v3",
+		Username:       "travis",
+		Password:       "secret",
+		ProjectName:    "ci",
+		Region:         "RegionOne",
+		StandardFlavor: "m1.medium",
+		PremiumFlavor:  "m1.large",
+	})
+	if err != nil {
+		t.Fatalf("NewOpenStackProvider returned error: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := provider.Create(context.Background(), fmt.Sprintf("id-%d", i), CreateAttributes{ImageName: "travis-ci-trusty"})
+		if err != nil {
+			t.Fatalf("provider.Create returned error: %v", err)
+		}
+	}
+
+	fake.mutex.Lock()
+	fake.servers["server-3"]["status"] = "ERROR"
+	fake.servers["server-3"]["fault"] = map[string]string{"message": "No valid host was found"}
+	fake.mutex.Unlock()
+
+	instances, err := provider.List(context.Background())
+	if err != nil {
+		t.Fatalf("provider.List returned error: %v", err)
+	}
+	if len(instances) != 5 {
+		t.Fatalf("expected all 5 instances across the pages, got %+v", instances)
+	}
+
+	for _, instance := range instances {
+		if instance.ID != "id-3" {
+			continue
+		}
+		if instance.State != InstanceStateErrored || instance.ErrorReason != "No valid host was found" {
+			t.Errorf("expected the server in ERROR to be errored, got %+v", instance)
+		}
+	}
+}
@@ -1,19 +1,34 @@
 // Package cloud provides different implementations for cloud providers.
 package cloud
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 // ErrInstanceNotFound is returned as an error from Provider.Get() or
 // Provider.Destroy() if an instance with the given ID doesn't exist.
 var ErrInstanceNotFound = errors.New("could not find instance")
 
+// A PermanentError is returned from Provider.Create() if retrying the create
+// won't help, for example because the image doesn't exist.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
 // A Provider implements the methods necessary to manage Instances on a given
-// cloud provider.
+// cloud provider. The methods should give up and return an error once the
+// context is done.
 type Provider interface {
-	List() ([]Instance, error)
-	Create(id string, attr CreateAttributes) (Instance, error)
-	Get(id string) (Instance, error)
-	Destroy(id string) error
+	List(ctx context.Context) ([]Instance, error)
+	Create(ctx context.Context, id string, attr CreateAttributes) (Instance, error)
+	Get(ctx context.Context, id string) (Instance, error)
+	Destroy(ctx context.Context, id string) error
 }
 
 // An Instance is a single compute instance
@@ -23,6 +38,14 @@ type Instance struct {
 	IPAddress   string
 	UpstreamID  string
 	ErrorReason string
+
+	// Zone is the zone the instance was created in, for providers that have
+	// a concept of zones. Empty otherwise.
+	Zone string
+
+	// CreatedAt is when the provider created the instance, or the zero time
+	// if the provider doesn't report it.
+	CreatedAt time.Time
 }
 
 // CreateAttributes contains the attributes needed to start an instance.
@@ -52,6 +75,10 @@ const (
 	// InstanceStateTerminated is the state of an instance that is done
 	// terminating.
 	InstanceStateTerminated InstanceState = "terminated"
+
+	// InstanceStateErrored is the state of an instance that the provider
+	// failed to build or run, but that still exists and has to be removed.
+	InstanceStateErrored InstanceState = "errored"
 )
 
 // An InstanceType is the type of instance to start. Valid values are the
@@ -67,3 +94,14 @@ const (
 	// than the standard instance type.
 	InstanceTypePremium InstanceType = "premium"
 )
+
+// Valid returns true if the instance type is one of the InstanceType…
+// constants defined in this package.
+func (t InstanceType) Valid() bool {
+	switch t {
+	case InstanceTypeStandard, InstanceTypePremium:
+		return true
+	}
+
+	return false
+}
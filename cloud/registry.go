@@ -27,6 +27,16 @@ func registerProvider(alias, humanReadableName string, providerFunc func([]byte)
 	}
 }
 
+// ProviderRegistered returns true if a provider with the given alias has been
+// registered, i.e. if NewProvider knows how to create it.
+func ProviderRegistered(alias string) bool {
+	backendRegistryMutex.Lock()
+	defer backendRegistryMutex.Unlock()
+
+	_, ok := backendRegistry[alias]
+	return ok
+}
+
 // NewProvider creates a new provider given the alias and provider-specific
 // configuration. The alias must match what is passed to registerProvider by the
 // provider, and the configuration is passed to the provider for parsing.
@@ -2,12 +2,12 @@ package cloudbrain
 
 import (
 	"context"
-	"crypto/subtle"
-	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
@@ -17,7 +17,8 @@ import (
 	"github.com/travis-ci/cloud-brain/cbcontext"
 	"github.com/travis-ci/cloud-brain/cloud"
 	"github.com/travis-ci/cloud-brain/database"
-	"golang.org/x/crypto/scrypt"
+	"github.com/travis-ci/cloud-brain/metrics"
+	"github.com/travis-ci/cloud-brain/tracing"
 	"gopkg.in/urfave/cli.v2"
 )
 
@@ -46,9 +47,33 @@ func customVersionPrinter(c *cli.Context) {
 		VersionString, RevisionString, GeneratedString)
 }
 
-// MaxCreateRetries is the number of times the "create" job will be retried.
+// ErrIdempotencyKeyReused is returned from CreateInstance when the idempotency
+// key was already used to create an instance with different attributes.
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different instance")
+
+// MaxCreateRetries is the number of times the "create" job is attempted before
+// the instance is marked as errored.
 const MaxCreateRetries = 10
 
+const (
+	// CreateJobTimeout is how long the "create" job waits for the provider
+	// before giving up on the attempt.
+	CreateJobTimeout = 10 * time.Minute
+
+	// RemoveJobTimeout is how long the "remove" job waits for the provider
+	// before giving up on the attempt.
+	RemoveJobTimeout = 5 * time.Minute
+
+	// refreshListTimeout is how long ProviderRefresh waits for a single
+	// provider to list its instances.
+	refreshListTimeout = 2 * time.Minute
+
+	// leakedRemoveInterval is how long ProviderRefresh waits before enqueueing
+	// the removal of a leaked instance again. It's longer than
+	// RemoveJobTimeout, so the previous remove job has had time to finish.
+	leakedRemoveInterval = 2 * RemoveJobTimeout
+)
+
 // Core is used as a central manager for all Cloud Brain functionality. The HTTP
 // API and the background workers are just frontends for the Core, and calls
 // methods on Core for functionality.
@@ -57,8 +82,31 @@ type Core struct {
 	redisPool         *redis.Pool
 	redisWorkerPrefix string
 
-	cloudProvidersMutex sync.Mutex
-	cloudProviders      map[string]cloud.Provider
+	cloudProvidersMutex  sync.Mutex
+	cloudProviders       map[string]cloud.Provider
+	providerMaxLifetimes map[string]time.Duration
+
+	// When ProviderRefresh last enqueued the removal of each leaked instance,
+	// see removeLeakedInstance. Guarded by cloudProvidersMutex.
+	leakedRemovals map[string]time.Time
+
+	// The result of the last refreshProviders, reported by Ready. These have
+	// their own mutex, since cloudProvidersMutex is held while the providers
+	// are listed, which can take minutes.
+	providerStatusMutex       sync.Mutex
+	providerStatusRefreshing  bool
+	cloudProvidersRefreshedAt time.Time
+	cloudProvidersErr         error
+	cloudProviderNames        []string
+
+	orphansMutex sync.Mutex
+	orphans      map[string]Orphan
+
+	tokenCache *tokenCache
+
+	// Whether tokens can access instances with no owner, see
+	// SetUnownedInstanceAccess
+	unownedInstanceAccess bool
 }
 
 // NewCore is used to create a new Core backed by the given database and
@@ -68,13 +116,26 @@ func NewCore(db database.DB, redisPool *redis.Pool, redisWorkerPrefix string) *C
 		db:                db,
 		redisPool:         redisPool,
 		redisWorkerPrefix: redisWorkerPrefix,
+		orphans:           make(map[string]Orphan),
+		leakedRemovals:    make(map[string]time.Time),
+		tokenCache:        newTokenCache(DefaultTokenCacheSize, DefaultTokenCacheTTL),
 	}
 }
 
+// tracedDB returns the database, recording a span for every call as a child of
+// the current span in the context.
+func (c *Core) tracedDB(ctx context.Context) database.DB {
+	return database.WithTracing(ctx, c.db)
+}
+
 // GetInstance gets the instance information stored in the database for a given
-// instance ID.
+// instance ID. Instances that don't belong to the token in the context, or are
+// on providers it can't be used with, are treated as if they don't exist.
 func (c *Core) GetInstance(ctx context.Context, id string) (*Instance, error) {
-	instance, err := c.db.GetInstance(id)
+	ctx, span := tracing.StartSpan(ctx, "Core.GetInstance")
+	defer span.End()
+
+	instance, err := c.tracedDB(ctx).GetInstance(id)
 
 	if err == database.ErrInstanceNotFound {
 		return nil, nil
@@ -84,22 +145,89 @@ func (c *Core) GetInstance(ctx context.Context, id string) (*Instance, error) {
 		return nil, err
 	}
 
-	return &Instance{
-		ID:           instance.ID,
-		ProviderName: instance.ProviderName,
-		Image:        instance.Image,
-		State:        instance.State,
-		IPAddress:    instance.IPAddress,
-		UpstreamID:   instance.UpstreamID,
-		ErrorReason:  instance.ErrorReason,
-	}, nil
+	if !allowsProvider(ctx, instance.ProviderName) || !c.ownsInstance(ctx, instance) {
+		return nil, nil
+	}
+
+	return instanceFromDB(instance), nil
+}
+
+// ListInstancesAttributes contains the filters used to list instances. Zero
+// values match all instances. If AfterID is set, only instances created after
+// the instance with the given creation time and ID are returned.
+type ListInstancesAttributes struct {
+	State          string
+	ProviderName   string
+	Image          string
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	AfterCreatedAt time.Time
+	AfterID        string
+	Limit          int
+}
+
+// ListInstances returns the instances matching the given attributes, ordered
+// by creation time. Only instances that belong to the token in the context, on
+// providers it can be used with, are returned.
+func (c *Core) ListInstances(ctx context.Context, attr ListInstancesAttributes) ([]*Instance, error) {
+	ctx, span := tracing.StartSpan(ctx, "Core.ListInstances")
+	defer span.End()
+
+	var providerNames []string
+	var ownerTokenID uint64
+	var tenant string
+	if token, ok := TokenFromContext(ctx); ok {
+		if attr.ProviderName != "" && !token.AllowsProvider(attr.ProviderName) {
+			return []*Instance{}, nil
+		}
+		providerNames = token.restrictedProviders()
+
+		if !token.HasScope(ScopeInstancesAdmin) {
+			if token.Tenant != "" {
+				tenant = token.Tenant
+			} else {
+				ownerTokenID = token.ID
+			}
+		}
+	}
+
+	dbInstances, err := c.tracedDB(ctx).ListInstances(database.InstanceFilter{
+		State:          attr.State,
+		ProviderName:   attr.ProviderName,
+		Image:          attr.Image,
+		CreatedAfter:   attr.CreatedAfter,
+		CreatedBefore:  attr.CreatedBefore,
+		AfterCreatedAt: attr.AfterCreatedAt,
+		AfterID:        attr.AfterID,
+		Limit:          attr.Limit,
+		ProviderNames:  providerNames,
+		OwnerTokenID:   ownerTokenID,
+		Tenant:         tenant,
+		IncludeUnowned: c.unownedInstanceAccess,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing instances in database")
+	}
+
+	instances := make([]*Instance, 0, len(dbInstances))
+	for _, dbInstance := range dbInstances {
+		instances = append(instances, instanceFromDB(dbInstance))
+	}
+
+	return instances, nil
 }
 
-// CreateInstanceAttributes contains attributes needed to start an instance
+// CreateInstanceAttributes contains attributes needed to start an instance. An
+// empty InstanceType means cloud.InstanceTypeStandard.
 type CreateInstanceAttributes struct {
 	ImageName    string
 	InstanceType string
 	PublicSSHKey string
+
+	// IdempotencyKey is optional. If an instance was already created with
+	// the same key by the same token, or a token of the same tenant, that
+	// instance is returned instead of creating a new one.
+	IdempotencyKey string
 }
 
 //DeleteInstanceAttributes contains attributes needed to delete an instance
@@ -108,83 +236,217 @@ type DeleteInstanceAttributes struct {
 }
 
 // CreateInstance creates an instance in the database and queues off the cloud
-// create job in the background.
+// create job in the background, through the outbox. If the attributes have an
+// idempotency key that was already used, the existing instance is returned and
+// nothing is queued. Returns ErrProviderNotAllowed if the token in the context
+// can't be used with the provider, or a *QuotaExceededError if the instance
+// would exceed the quota of the token or the provider.
 func (c *Core) CreateInstance(ctx context.Context, providerName string, attr CreateInstanceAttributes) (*Instance, error) {
-	id, err := c.db.CreateInstance(database.Instance{
-		ProviderName: providerName,
-		Image:        attr.ImageName,
-		InstanceType: attr.InstanceType,
-		PublicSSHKey: attr.PublicSSHKey,
-		State:        "creating",
-	})
+	ctx, span := tracing.StartSpan(ctx, "Core.CreateInstance")
+	defer span.End()
+
+	if !allowsProvider(ctx, providerName) {
+		return nil, ErrProviderNotAllowed
+	}
+
+	instanceType := attr.InstanceType
+	if instanceType == "" {
+		instanceType = string(cloud.InstanceTypeStandard)
+	}
+
+	var ownerTokenID uint64
+	var tenant string
+	if token, ok := TokenFromContext(ctx); ok {
+		ownerTokenID = token.ID
+		tenant = token.Tenant
+	}
+
+	if attr.IdempotencyKey != "" {
+		existing, err := c.tracedDB(ctx).GetInstanceByIdempotencyKey(attr.IdempotencyKey, ownerTokenID, tenant)
+		if err == nil {
+			return c.replayedInstance(ctx, existing, providerName, attr.ImageName, instanceType)
+		}
+		if err != database.ErrInstanceNotFound {
+			return nil, errors.Wrap(err, "error looking up instance by idempotency key")
+		}
+	}
+
+	limits, err := c.quotaLimits(ctx, providerName, instanceType)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating instance in database")
+		return nil, errors.Wrap(err, "error loading quotas")
 	}
 
-	var enqueuer = work.NewEnqueuer(c.redisWorkerPrefix, c.redisPool)
+	createdAt := time.Now().UTC()
+
+	id, err := c.tracedDB(ctx).CreateInstanceWithOutboxJob(database.Instance{
+		ProviderName:   providerName,
+		Image:          attr.ImageName,
+		InstanceType:   instanceType,
+		PublicSSHKey:   attr.PublicSSHKey,
+		State:          string(InstanceStateCreating),
+		CreatedAt:      createdAt,
+		IdempotencyKey: attr.IdempotencyKey,
+		OwnerTokenID:   ownerTokenID,
+		Tenant:         tenant,
+	}, database.OutboxJob{
+		JobName:  "create",
+		Metadata: jobMetadata(ctx),
+	}, limits)
+	if quotaErr, ok := err.(*database.QuotaExceededError); ok {
+		return nil, &QuotaExceededError{Limit: quotaErr.Limit.Description}
+	}
+	if err == database.ErrDuplicateIdempotencyKey {
+		// A concurrent request with the same key won the race
+		existing, err := c.tracedDB(ctx).GetInstanceByIdempotencyKey(attr.IdempotencyKey, ownerTokenID, tenant)
+		if err != nil {
+			return nil, errors.Wrap(err, "error looking up instance by idempotency key")
+		}
 
-	_, err = enqueuer.Enqueue("create", work.Q{
-		"payload": id,
-	})
+		return c.replayedInstance(ctx, existing, providerName, attr.ImageName, instanceType)
+	}
 	if err != nil {
-		// TODO(sarahhodne): Delete the record in the database?
-		return nil, errors.Wrap(err, "error enqueueing 'create' job in the background")
+		return nil, errors.Wrap(err, "error creating instance in database")
 	}
 
+	c.recordInstanceEvent(ctx, database.InstanceEvent{
+		InstanceID: id,
+		State:      string(InstanceStateCreating),
+		CreatedAt:  createdAt,
+	})
+
 	return &Instance{
 		ID:           id,
 		ProviderName: providerName,
 		Image:        attr.ImageName,
-		State:        "creating",
+		InstanceType: instanceType,
+		State:        InstanceStateCreating,
+		OwnerTokenID: ownerTokenID,
+		Tenant:       tenant,
+		CreatedAt:    createdAt,
+		UpdatedAt:    createdAt,
 	}, nil
 }
 
+// replayedInstance returns the instance that was already created with an
+// idempotency key, as long as it was created with the same attributes and
+// belongs to the token in the context.
+func (c *Core) replayedInstance(ctx context.Context, existing database.Instance, providerName, imageName, instanceType string) (*Instance, error) {
+	if existing.ProviderName != providerName || existing.Image != imageName || existing.InstanceType != instanceType || !c.ownsInstance(ctx, existing) {
+		return nil, ErrIdempotencyKeyReused
+	}
+
+	cbcontext.LoggerFromContext(ctx).WithField("instance_id", existing.ID).Info("returning existing instance for idempotency key")
+
+	return instanceFromDB(existing), nil
+}
+
 // RemoveInstance creates an instance in the database and queues off the cloud
 // create job in the background.
 func (c *Core) RemoveInstance(ctx context.Context, attr DeleteInstanceAttributes) error {
-	inst, err := c.db.GetInstance(attr.InstanceID)
+	ctx, span := tracing.StartSpan(ctx, "Core.RemoveInstance")
+	defer span.End()
+
+	inst, err := c.tracedDB(ctx).GetInstance(attr.InstanceID)
 	if err != nil {
 		return errors.Wrap(err, "error fetching instance from DB")
 	}
 
-	if inst.State == "terminating" || inst.State == "terminated" {
+	if !allowsProvider(ctx, inst.ProviderName) {
+		return ErrProviderNotAllowed
+	}
+
+	if !c.ownsInstance(ctx, inst) {
+		return ErrNotInstanceOwner
+	}
+
+	if inst.State == string(InstanceStateTerminating) || inst.State == string(InstanceStateTerminated) {
 		return errors.Wrapf(err, "not removing instance, state is already %s", inst.State)
 	}
 
-	var enqueuer = work.NewEnqueuer(c.redisWorkerPrefix, c.redisPool)
+	return c.enqueueRemove(ctx, attr.InstanceID)
+}
 
-	_, err = enqueuer.Enqueue("remove", work.Q{
-		"payload": attr.InstanceID,
+// enqueueRemove queues off the cloud remove job for the instance with the
+// given ID in the background, through the outbox.
+func (c *Core) enqueueRemove(ctx context.Context, id string) error {
+	err := c.tracedDB(ctx).CreateOutboxJob(database.OutboxJob{
+		JobName:  "remove",
+		Payload:  id,
+		Metadata: jobMetadata(ctx),
 	})
-
 	if err != nil {
-		return errors.Wrap(err, "error enqueueing 'remove' job in the background")
+		return errors.Wrap(err, "error adding 'remove' job to the outbox")
 	}
 
 	return nil
 }
 
 // ProviderCreateInstance is used to schedule the creation of the instance with
-// the given ID on the provider selected for that instance.
+// the given ID on the provider selected for that instance. If the create
+// fails, the error is returned so the job is retried, and the instance stays
+// creating. Once the last attempt has failed, or if the provider returned a
+// *cloud.PermanentError, the instance is marked as errored and removed. If the
+// instance was removed while the provider was creating it, it's destroyed
+// again.
 func (c *Core) ProviderCreateInstance(job *work.Job) error {
-	ctx := context.TODO()
+	ctx, cancel := context.WithTimeout(jobContext(job), CreateJobTimeout)
+	defer cancel()
+	ctx, span := tracing.StartSpan(ctx, "Core.ProviderCreateInstance")
+	defer span.End()
 	id := job.Args["payload"].(string)
 
 	cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 		"instance_id": id,
 	}).Info("creating instance")
 
-	dbInstance, err := c.db.GetInstance(id)
+	dbInstance, err := c.tracedDB(ctx).GetInstance(id)
 	if err != nil {
 		return errors.Wrap(err, "error fetching instance from DB")
 	}
 
+	if dbInstance.State != string(InstanceStateCreating) {
+		// The instance was given up on or removed while this job was
+		// waiting to be retried
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"instance_id": id,
+			"state":       dbInstance.State,
+		}).Info("not creating instance that is no longer in the creating state")
+		return nil
+	}
+
+	// A job can be enqueued more than once, for example if the outbox relay
+	// fails to commit after enqueueing it. The first job to run claims the
+	// instance, and only that job and its retries create it.
+	if dbInstance.CreateJobID != job.ID {
+		claimed := false
+		if dbInstance.CreateJobID == "" {
+			err = c.updateInstance(ctx, &dbInstance, "claimed by create job", func(i *database.Instance) InstanceState {
+				claimed = i.State == string(InstanceStateCreating) && i.CreateJobID == ""
+				if claimed {
+					i.CreateJobID = job.ID
+				}
+				return InstanceState(i.State)
+			})
+			if err != nil {
+				return errors.Wrap(err, "error claiming instance in DB")
+			}
+		}
+
+		if !claimed {
+			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"instance_id": id,
+				"job_id":      job.ID,
+			}).Info("not creating instance that was claimed by another job")
+			return nil
+		}
+	}
+
 	cloudProvider, err := c.cloudProvider(dbInstance.ProviderName)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't find provider with given name: %v", dbInstance.ProviderName)
 	}
 
-	instance, err := cloudProvider.Create(id, cloud.CreateAttributes{
+	instance, err := cloudProvider.Create(ctx, id, cloud.CreateAttributes{
 		ImageName:    dbInstance.Image,
 		InstanceType: cloud.InstanceType(dbInstance.InstanceType),
 		PublicSSHKey: dbInstance.PublicSSHKey,
@@ -194,28 +456,46 @@ func (c *Core) ProviderCreateInstance(job *work.Job) error {
 			"err":         err,
 			"instance_id": id,
 		}).Error("error creating instance")
+		cbcontext.CaptureError(ctx, err)
 
-		dbInstance.State = "errored"
-		dbInstance.ErrorReason = err.Error()
+		_, permanent := err.(*cloud.PermanentError)
+		if !permanent && job.Fails+1 < MaxCreateRetries {
+			return errors.Wrap(err, "error creating instance")
+		}
 
-		err = c.db.UpdateInstance(dbInstance)
+		reason := err.Error()
+		err = c.updateInstance(ctx, &dbInstance, reason, func(i *database.Instance) InstanceState {
+			i.ErrorReason = reason
+			return InstanceStateErrored
+		})
+		if isIllegalTransition(err) {
+			// The instance was given up on or removed in the meantime
+			return nil
+		}
 		if err != nil {
 			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 				"err":         err,
 				"instance_id": id,
-				"provider_id": instance.ID,
-				"upstream_id": instance.UpstreamID,
 			}).Error("couldn't update instance in DB")
 			return err
 		}
 
-		return err
+		// The failed create may have left something behind on the
+		// provider, so remove it
+		return c.enqueueRemove(ctx, id)
 	}
 
-	dbInstance.State = "starting"
-
-	err = c.db.UpdateInstance(dbInstance)
-	if err != nil {
+	err = c.updateInstance(ctx, &dbInstance, "created on provider", func(i *database.Instance) InstanceState {
+		i.Zone = instance.Zone
+		return InstanceStateStarting
+	})
+	if isIllegalTransition(err) && isRemovedState(InstanceState(dbInstance.State)) {
+		// The instance was removed or given up on while it was being
+		// created, so the remove job found nothing to destroy. dbInstance was
+		// fetched again by updateInstance, so this is its current state.
+		return c.destroyRemovedInstance(ctx, cloudProvider, dbInstance)
+	}
+	if err != nil && !isIllegalTransition(err) {
 		return errors.Wrap(err, "couldn't update instance in DB")
 	}
 
@@ -227,17 +507,50 @@ func (c *Core) ProviderCreateInstance(job *work.Job) error {
 	return nil
 }
 
+// isRemovedState returns true if an instance in the given state was removed or
+// given up on, so it shouldn't exist on the provider.
+func isRemovedState(state InstanceState) bool {
+	return state == InstanceStateTerminating || state == InstanceStateTerminated || state == InstanceStateErrored
+}
+
+// destroyRemovedInstance destroys an instance that was created on the
+// provider after it was removed. If that fails, a remove job is enqueued so
+// it's retried.
+func (c *Core) destroyRemovedInstance(ctx context.Context, cloudProvider cloud.Provider, dbInstance database.Instance) error {
+	err := cloudProvider.Destroy(ctx, dbInstance.ID)
+	if err != nil && err != cloud.ErrInstanceNotFound {
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": dbInstance.ID,
+			"state":       dbInstance.State,
+		}).Error("error destroying instance that was removed while it was being created")
+		cbcontext.CaptureError(ctx, err)
+
+		return c.enqueueRemove(ctx, dbInstance.ID)
+	}
+
+	cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"instance_id": dbInstance.ID,
+		"state":       dbInstance.State,
+	}).Info("destroyed instance that was removed while it was being created")
+
+	return nil
+}
+
 // ProviderRemoveInstance is used to schedule the creation of the instance with
 // the given ID on the provider selected for that instance.
 func (c *Core) ProviderRemoveInstance(job *work.Job) error {
-	ctx := context.TODO()
+	ctx, cancel := context.WithTimeout(jobContext(job), RemoveJobTimeout)
+	defer cancel()
+	ctx, span := tracing.StartSpan(ctx, "Core.ProviderRemoveInstance")
+	defer span.End()
 	id := job.Args["payload"].(string)
 
 	cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 		"instance_id": id,
 	}).Info("removing instance")
 
-	dbInstance, err := c.db.GetInstance(id)
+	dbInstance, err := c.tracedDB(ctx).GetInstance(id)
 	if err != nil {
 		return errors.Wrap(err, "error fetching instance from DB")
 	}
@@ -247,19 +560,45 @@ func (c *Core) ProviderRemoveInstance(job *work.Job) error {
 		return errors.Wrapf(err, "couldn't find provider with given name: %v", dbInstance.ProviderName)
 	}
 
-	err = cloudProvider.Destroy(id)
+	err = cloudProvider.Destroy(ctx, id)
+	if err == cloud.ErrInstanceNotFound {
+		// Nothing to remove, for example because the instance was never
+		// created on the provider
+		err = c.updateInstance(ctx, &dbInstance, "not found on provider", func(i *database.Instance) InstanceState {
+			return InstanceStateTerminated
+		})
+		if err != nil && !isIllegalTransition(err) {
+			return errors.Wrap(err, "error updating instance state to terminated in DB")
+		}
+
+		return nil
+	}
 	if err != nil {
 		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 			"err":         err,
 			"instance_id": id,
 		}).Error("error removing instance")
+		cbcontext.CaptureError(ctx, err)
+
+		reason := err.Error()
+		updateErr := c.updateInstance(ctx, &dbInstance, reason, func(i *database.Instance) InstanceState {
+			i.ErrorReason = reason
+			return InstanceStateErrored
+		})
+		if updateErr != nil && !isIllegalTransition(updateErr) {
+			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"err":         updateErr,
+				"instance_id": id,
+			}).Error("couldn't update instance in DB")
+		}
 
 		return err
 	}
 
-	dbInstance.State = "terminating"
-	err = c.db.UpdateInstance(dbInstance)
-	if err != nil {
+	err = c.updateInstance(ctx, &dbInstance, "removed on provider", func(i *database.Instance) InstanceState {
+		return InstanceStateTerminating
+	})
+	if err != nil && !isIllegalTransition(err) {
 		return errors.Wrap(err, "error updating instance state to terminating in DB")
 	}
 
@@ -273,6 +612,14 @@ func (c *Core) ProviderRemoveInstance(job *work.Job) error {
 // ProviderRefresh is used to synchronize the data on all the cloud providers
 // with the data in our database.
 func (c *Core) ProviderRefresh(ctx context.Context) error {
+	ctx, span := tracing.StartSpan(ctx, "Core.ProviderRefresh")
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		metrics.RefreshDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	c.refreshProviders()
 	c.cloudProvidersMutex.Lock()
 	defer c.cloudProvidersMutex.Unlock()
@@ -280,18 +627,25 @@ func (c *Core) ProviderRefresh(ctx context.Context) error {
 	var result error
 
 	for providerName, cloudProvider := range c.cloudProviders {
-		instances, err := cloudProvider.List()
+		listCtx, cancel := context.WithTimeout(ctx, refreshListTimeout)
+		instances, err := cloudProvider.List(listCtx)
+		cancel()
 		if err != nil {
 			result = multierror.Append(result, err)
 			continue
 		}
 
 		seenIds := make(map[string]bool)
+		var orphans []cloud.Instance
 
 		for _, instance := range instances {
 			seenIds[instance.ID] = true
 
-			dbInstance, err := c.db.GetInstance(instance.ID)
+			dbInstance, err := c.tracedDB(ctx).GetInstance(instance.ID)
+			if err == database.ErrInstanceNotFound {
+				orphans = append(orphans, instance)
+				continue
+			}
 			if err != nil {
 				cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 					"err":           err,
@@ -301,13 +655,39 @@ func (c *Core) ProviderRefresh(ctx context.Context) error {
 				continue
 			}
 
-			dbInstance.State = string(instance.State)
-			dbInstance.IPAddress = instance.IPAddress
-			dbInstance.UpstreamID = instance.UpstreamID
-			dbInstance.ErrorReason = instance.ErrorReason
+			if isLeaked(dbInstance, instance) {
+				c.removeLeakedInstance(ctx, dbInstance, instance)
+				continue
+			}
+
+			providerErrored := false
+			err = c.updateInstance(ctx, &dbInstance, "refreshed from provider", func(i *database.Instance) InstanceState {
+				providerErrored = false
+				i.IPAddress = instance.IPAddress
+				i.UpstreamID = instance.UpstreamID
+				if instance.ErrorReason != "" {
+					i.ErrorReason = instance.ErrorReason
+				}
+				if instance.Zone != "" {
+					i.Zone = instance.Zone
+				}
 
-			err = c.db.UpdateInstance(dbInstance)
-			if err != nil {
+				state := InstanceState(instance.State)
+				if !state.Valid() {
+					// The provider didn't map its status to a state
+					return InstanceState(i.State)
+				}
+				if state == InstanceStateErrored {
+					current := InstanceState(i.State)
+					if current == InstanceStateErrored || current == InstanceStateTerminating || current == InstanceStateTerminated {
+						// Already errored, or being removed
+						return current
+					}
+					providerErrored = true
+				}
+				return state
+			})
+			if err != nil && !isIllegalTransition(err) {
 				cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 					"err":         err,
 					"provider":    providerName,
@@ -315,9 +695,21 @@ func (c *Core) ProviderRefresh(ctx context.Context) error {
 					"db_id":       dbInstance.ID,
 				}).Error("failed to update instance in database")
 			}
+			if err == nil && providerErrored {
+				// The instance still exists on the provider, so remove it
+				err = c.enqueueRemove(ctx, dbInstance.ID)
+				if err != nil {
+					cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+						"err":   err,
+						"db_id": dbInstance.ID,
+					}).Error("failed to enqueue remove for errored instance")
+				}
+			}
 		}
 
-		terminatingDbInstances, err := c.db.GetInstancesByState("terminating")
+		orphanCount := c.trackOrphans(providerName, orphans)
+
+		terminatingDbInstances, err := c.tracedDB(ctx).GetInstancesByState(string(InstanceStateTerminating))
 		if err != nil {
 			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 				"err":      err,
@@ -330,12 +722,16 @@ func (c *Core) ProviderRefresh(ctx context.Context) error {
 		// if the id is no longer in seenIds, it was deleted
 		// from GCE, we can now consider it terminated
 		for _, dbInstance := range terminatingDbInstances {
+			if dbInstance.ProviderName != providerName {
+				continue
+			}
+
 			_, found := seenIds[dbInstance.ID]
 			if !found {
-				dbInstance.State = "terminated"
-
-				err = c.db.UpdateInstance(dbInstance)
-				if err != nil {
+				err = c.updateInstance(ctx, &dbInstance, "no longer exists on provider", func(i *database.Instance) InstanceState {
+					return InstanceStateTerminated
+				})
+				if err != nil && !isIllegalTransition(err) {
 					cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 						"err":      err,
 						"provider": providerName,
@@ -345,35 +741,211 @@ func (c *Core) ProviderRefresh(ctx context.Context) error {
 			}
 		}
 
+		err = c.enforceMaxLifetime(ctx, providerName, c.providerMaxLifetimes[providerName])
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+
 		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
 			"provider":       providerName,
 			"instance_count": len(instances),
+			"orphan_count":   orphanCount,
 		}).Info("refreshed instances")
 	}
 
+	now := time.Now()
+	for id, enqueuedAt := range c.leakedRemovals {
+		if now.Sub(enqueuedAt) >= leakedRemoveInterval {
+			delete(c.leakedRemovals, id)
+		}
+	}
+
+	err := c.updateInstanceMetrics()
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+
 	return result
 }
 
-// CheckToken is used to check whether a given tokenID+token is in the database.
-// Returns (true, nil) iff the token is valid, (false, nil) if the token is
-// invalid, and (false, err) if an error occurred while fetching the token.
-func (c *Core) CheckToken(tokenID uint64, token string) (bool, error) {
-	salt, hash, err := c.db.GetSaltAndHashForTokenID(tokenID)
+// isLeaked returns true if the instance is starting or running on the
+// provider, even though it was terminated or errored in the database. That
+// happens if it was created after it was removed, and it would otherwise be
+// kept forever, since it can't move back to starting or running.
+func isLeaked(dbInstance database.Instance, instance cloud.Instance) bool {
+	state := InstanceState(dbInstance.State)
+	if state != InstanceStateTerminated && state != InstanceStateErrored {
+		return false
+	}
+
+	return instance.State == cloud.InstanceStateStarting || instance.State == cloud.InstanceStateRunning
+}
+
+// removeLeakedInstance enqueues the removal of a leaked instance, unless that
+// was done less than leakedRemoveInterval ago. Must be called with
+// cloudProvidersMutex held.
+func (c *Core) removeLeakedInstance(ctx context.Context, dbInstance database.Instance, instance cloud.Instance) {
+	if enqueuedAt, ok := c.leakedRemovals[dbInstance.ID]; ok && time.Since(enqueuedAt) < leakedRemoveInterval {
+		return
+	}
+
+	err := c.enqueueRemove(ctx, dbInstance.ID)
 	if err != nil {
-		return false, err
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":   err,
+			"db_id": dbInstance.ID,
+		}).Error("failed to enqueue remove for leaked instance")
+		return
 	}
+	c.leakedRemovals[dbInstance.ID] = time.Now()
+
+	cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"db_id":          dbInstance.ID,
+		"state":          dbInstance.State,
+		"provider_state": instance.State,
+	}).Warn("enqueued removal of instance that still exists on provider")
+}
 
-	decodedToken, err := hex.DecodeString(token)
+// updateInstanceMetrics sets the instance count metrics to the number of
+// instances currently in the database.
+func (c *Core) updateInstanceMetrics() error {
+	counts, err := c.db.CountInstances()
 	if err != nil {
-		return false, err
+		return errors.Wrap(err, "error counting instances")
+	}
+
+	metrics.Instances.Reset()
+	for _, count := range counts {
+		metrics.Instances.WithLabelValues(count.ProviderName, count.State).Set(float64(count.Count))
 	}
 
-	generatedHash, err := scrypt.Key(decodedToken, salt, 16384, 8, 1, 32)
+	return nil
+}
+
+// maxInstanceUpdateAttempts is the number of times updateInstance tries to
+// save an instance that keeps being updated by someone else.
+const maxInstanceUpdateAttempts = 3
+
+// updateInstance applies change to the instance and saves it in the state
+// returned by change. All instance updates go through here, so that every
+// state change is checked against the state machine and recorded in the
+// instance history. If the move isn't allowed, it's logged, nothing is saved
+// and an *IllegalTransitionError is returned. If the instance was updated by
+// someone else since it was fetched, it's fetched again and change is
+// reapplied.
+func (c *Core) updateInstance(ctx context.Context, instance *database.Instance, reason string, change func(*database.Instance) InstanceState) error {
+	for attempt := 1; ; attempt++ {
+		err := c.saveInstance(ctx, instance, reason, change)
+		if err != database.ErrInstanceVersionConflict || attempt == maxInstanceUpdateAttempts {
+			return err
+		}
+
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"instance_id": instance.ID,
+			"attempt":     attempt,
+		}).Info("instance was updated concurrently, retrying")
+
+		fresh, err := c.tracedDB(ctx).GetInstance(instance.ID)
+		if err != nil {
+			return err
+		}
+		*instance = fresh
+	}
+}
+
+func (c *Core) saveInstance(ctx context.Context, instance *database.Instance, reason string, change func(*database.Instance) InstanceState) error {
+	updated := *instance
+	previousState := InstanceState(instance.State)
+	state := change(&updated)
+
+	if !previousState.CanTransitionTo(state) {
+		err := &IllegalTransitionError{InstanceID: instance.ID, From: previousState, To: state}
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"instance_id": instance.ID,
+			"from":        previousState,
+			"to":          state,
+			"reason":      reason,
+		}).Warn("rejected illegal instance state transition")
+		return err
+	}
+
+	now := time.Now().UTC()
+	updated.State = string(state)
+	if state != previousState {
+		switch state {
+		case InstanceStateStarting:
+			updated.StartingAt = now
+		case InstanceStateRunning:
+			updated.RunningAt = now
+		case InstanceStateTerminating:
+			updated.TerminatingAt = now
+		case InstanceStateTerminated:
+			updated.TerminatedAt = now
+		case InstanceStateErrored:
+			updated.ErroredAt = now
+		}
+	}
+
+	err := c.tracedDB(ctx).UpdateInstance(updated)
 	if err != nil {
-		return false, err
+		return err
+	}
+	updated.Version++
+	*instance = updated
+
+	if state != previousState {
+		c.recordInstanceEvent(ctx, database.InstanceEvent{
+			InstanceID:    instance.ID,
+			State:         string(state),
+			PreviousState: string(previousState),
+			Reason:        reason,
+			CreatedAt:     now,
+		})
 	}
 
-	return subtle.ConstantTimeCompare(generatedHash, hash) == 1, nil
+	return nil
+}
+
+func isIllegalTransition(err error) bool {
+	_, ok := err.(*IllegalTransitionError)
+	return ok
+}
+
+// recordInstanceEvent appends the event to the instance history. The history
+// is informational, so errors are logged rather than returned.
+func (c *Core) recordInstanceEvent(ctx context.Context, event database.InstanceEvent) {
+	err := c.tracedDB(ctx).CreateInstanceEvent(event)
+	if err != nil {
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": event.InstanceID,
+			"state":       event.State,
+		}).Error("failed to record instance event")
+	}
+}
+
+// ListInstanceEvents returns the history of the instance with the given ID,
+// oldest event first.
+func (c *Core) ListInstanceEvents(ctx context.Context, id string) ([]*InstanceEvent, error) {
+	ctx, span := tracing.StartSpan(ctx, "Core.ListInstanceEvents")
+	defer span.End()
+
+	dbEvents, err := c.tracedDB(ctx).ListInstanceEvents(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing instance events in database")
+	}
+
+	events := make([]*InstanceEvent, 0, len(dbEvents))
+	for _, dbEvent := range dbEvents {
+		events = append(events, &InstanceEvent{
+			State:         dbEvent.State,
+			PreviousState: dbEvent.PreviousState,
+			Reason:        dbEvent.Reason,
+			CreatedAt:     dbEvent.CreatedAt,
+		})
+	}
+
+	return events, nil
 }
 
 // cloudProvider is used to get the provider implementation for the cloud
@@ -405,15 +977,30 @@ func (c *Core) cloudProvider(name string) (cloud.Provider, error) {
 
 // refreshProviders is used to regenerate the c.cloudProviders map with the
 // configurations stored in the database.
-func (c *Core) refreshProviders() error {
+func (c *Core) refreshProviders() (err error) {
 	c.cloudProvidersMutex.Lock()
 	defer c.cloudProvidersMutex.Unlock()
+	defer func() {
+		var names []string
+		for name := range c.cloudProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		c.providerStatusMutex.Lock()
+		c.cloudProvidersRefreshedAt = time.Now()
+		c.cloudProvidersErr = err
+		c.cloudProviderNames = names
+		c.providerStatusMutex.Unlock()
+	}()
+
 	dbCloudProviders, err := c.db.ListProviders()
 	if err != nil {
 		return err
 	}
 
 	cloudProviders := make(map[string]cloud.Provider)
+	providerMaxLifetimes := make(map[string]time.Duration)
 
 	for _, dbCloudProvider := range dbCloudProviders {
 		cloudProvider, err := cloud.NewProvider(dbCloudProvider.Type, dbCloudProvider.Config)
@@ -421,10 +1008,15 @@ func (c *Core) refreshProviders() error {
 			return err
 		}
 
-		cloudProviders[dbCloudProvider.Name] = cloudProvider
+		cloudProviders[dbCloudProvider.Name] = &instrumentedProvider{
+			name:     dbCloudProvider.Name,
+			provider: cloudProvider,
+		}
+		providerMaxLifetimes[dbCloudProvider.Name] = dbCloudProvider.MaxLifetime
 	}
 
 	c.cloudProviders = cloudProviders
+	c.providerMaxLifetimes = providerMaxLifetimes
 
 	return nil
 }
@@ -434,8 +1026,52 @@ type Instance struct {
 	ID           string
 	ProviderName string
 	Image        string
-	State        string
+	InstanceType string
+	State        InstanceState
 	IPAddress    string
 	UpstreamID   string
 	ErrorReason  string
+	Zone         string
+	OwnerTokenID uint64
+	Tenant       string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	StartingAt    time.Time
+	RunningAt     time.Time
+	TerminatingAt time.Time
+	TerminatedAt  time.Time
+	ErroredAt     time.Time
+}
+
+// InstanceEvent is a single state change in the history of an instance.
+type InstanceEvent struct {
+	State         string
+	PreviousState string
+	Reason        string
+	CreatedAt     time.Time
+}
+
+func instanceFromDB(instance database.Instance) *Instance {
+	return &Instance{
+		ID:           instance.ID,
+		ProviderName: instance.ProviderName,
+		Image:        instance.Image,
+		InstanceType: instance.InstanceType,
+		State:        InstanceState(instance.State),
+		IPAddress:    instance.IPAddress,
+		UpstreamID:   instance.UpstreamID,
+		ErrorReason:  instance.ErrorReason,
+		Zone:         instance.Zone,
+		OwnerTokenID: instance.OwnerTokenID,
+		Tenant:       instance.Tenant,
+		CreatedAt:    instance.CreatedAt,
+		UpdatedAt:    instance.UpdatedAt,
+
+		StartingAt:    instance.StartingAt,
+		RunningAt:     instance.RunningAt,
+		TerminatingAt: instance.TerminatingAt,
+		TerminatedAt:  instance.TerminatedAt,
+		ErroredAt:     instance.ErroredAt,
+	}
 }
@@ -0,0 +1,276 @@
+package cloudbrain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+// relayedJobs removes the jobs from the outbox of the database and returns
+// them.
+func relayedJobs(t *testing.T, db database.DB) []database.OutboxJob {
+	var jobs []database.OutboxJob
+	_, err := db.RelayOutboxJobs(100, func(job database.OutboxJob) error {
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RelayOutboxJobs returned error: %v", err)
+	}
+
+	return jobs
+}
+
+func TestProviderCreateInstanceRetries(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:   "fake",
+		Name:   "fake-failing",
+		Config: []byte(`{"namespace": "create-retries-test", "create_error_rate": 1}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	instance, err := core.CreateInstance(context.TODO(), "fake-failing", CreateInstanceAttributes{ImageName: "standard-image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	relayedJobs(t, db)
+
+	job := &work.Job{Args: map[string]interface{}{"payload": instance.ID}}
+	for ; job.Fails < MaxCreateRetries-1; job.Fails++ {
+		if err := core.ProviderCreateInstance(job); err == nil {
+			t.Fatalf("expected attempt %d to return an error so the job is retried", job.Fails+1)
+		}
+
+		dbInstance, err := db.GetInstance(instance.ID)
+		if err != nil {
+			t.Fatalf("GetInstance returned error: %v", err)
+		}
+		if dbInstance.State != string(InstanceStateCreating) {
+			t.Fatalf("expected the instance to stay creating while the job is retried, got %s", dbInstance.State)
+		}
+	}
+
+	if err := core.ProviderCreateInstance(job); err != nil {
+		t.Fatalf("expected the last attempt to give up, got %v", err)
+	}
+
+	dbInstance, err := db.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	if dbInstance.State != string(InstanceStateErrored) || dbInstance.ErrorReason != "random error occurred" {
+		t.Errorf("expected the instance to be errored after the last attempt, got %s (%q)", dbInstance.State, dbInstance.ErrorReason)
+	}
+
+	jobs := relayedJobs(t, db)
+	if len(jobs) != 1 || jobs[0].JobName != "remove" || jobs[0].Payload != instance.ID {
+		t.Errorf("expected a remove job for the errored instance, got %+v", jobs)
+	}
+}
+
+func TestProviderCreateInstancePermanentError(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:   "fake",
+		Name:   "fake",
+		Config: []byte(`{"namespace": "create-permanent-error-test"}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	instance, err := core.CreateInstance(context.TODO(), "fake", CreateInstanceAttributes{ImageName: "unknown-image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	relayedJobs(t, db)
+
+	if err := core.ProviderCreateInstance(&work.Job{Args: map[string]interface{}{"payload": instance.ID}}); err != nil {
+		t.Fatalf("expected a permanent error not to be retried, got %v", err)
+	}
+
+	dbInstance, err := db.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	if dbInstance.State != string(InstanceStateErrored) {
+		t.Errorf("expected the instance to be errored, got %s", dbInstance.State)
+	}
+
+	jobs := relayedJobs(t, db)
+	if len(jobs) != 1 || jobs[0].JobName != "remove" {
+		t.Errorf("expected a remove job for the errored instance, got %+v", jobs)
+	}
+}
+
+func TestProviderCreateInstanceDuplicateJob(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:   "fake",
+		Name:   "fake-failing",
+		Config: []byte(`{"namespace": "create-duplicate-test", "create_error_rate": 1}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	instance, err := core.CreateInstance(context.TODO(), "fake-failing", CreateInstanceAttributes{ImageName: "standard-image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	job := &work.Job{ID: "first", Args: map[string]interface{}{"payload": instance.ID}}
+	duplicate := &work.Job{ID: "duplicate", Args: map[string]interface{}{"payload": instance.ID}}
+
+	if err := core.ProviderCreateInstance(job); err == nil {
+		t.Fatal("expected the first job to fail and be retried")
+	}
+	if err := core.ProviderCreateInstance(duplicate); err != nil {
+		t.Errorf("expected the duplicate job to do nothing, got %v", err)
+	}
+
+	job.Fails = MaxCreateRetries - 1
+	if err := core.ProviderCreateInstance(job); err != nil {
+		t.Fatalf("expected the last attempt of the first job to give up, got %v", err)
+	}
+
+	dbInstance, err := db.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	if dbInstance.State != string(InstanceStateErrored) || dbInstance.CreateJobID != "first" {
+		t.Errorf("expected the instance to be errored by the first job, got %s (claimed by %q)", dbInstance.State, dbInstance.CreateJobID)
+	}
+}
+
+func TestProviderCreateInstanceRemovedWhileCreating(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := context.TODO()
+
+	config := []byte(`{"namespace": "create-removed-test", "create_latency": 200000000}`)
+	_, err := db.CreateProvider(database.Provider{Type: "fake", Name: "fake-slow", Config: config})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	instance, err := core.CreateInstance(ctx, "fake-slow", CreateInstanceAttributes{ImageName: "standard-image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	relayedJobs(t, db)
+
+	job := &work.Job{ID: "create", Args: map[string]interface{}{"payload": instance.ID}}
+	created := make(chan error)
+	go func() {
+		created <- core.ProviderCreateInstance(job)
+	}()
+
+	// Wait for the create job to claim the instance, after which it's blocked
+	// in the provider's Create
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		dbInstance, err := db.GetInstance(instance.ID)
+		if err != nil {
+			t.Fatalf("GetInstance returned error: %v", err)
+		}
+		if dbInstance.CreateJobID == job.ID {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("expected the create job to claim the instance")
+		}
+	}
+
+	// The remove job doesn't find anything to destroy yet
+	if err := core.RemoveInstance(ctx, DeleteInstanceAttributes{InstanceID: instance.ID}); err != nil {
+		t.Fatalf("RemoveInstance returned error: %v", err)
+	}
+	if err := core.ProviderRemoveInstance(&work.Job{Args: map[string]interface{}{"payload": instance.ID}}); err != nil {
+		t.Fatalf("ProviderRemoveInstance returned error: %v", err)
+	}
+
+	if err := <-created; err != nil {
+		t.Fatalf("ProviderCreateInstance returned error: %v", err)
+	}
+
+	dbInstance, err := db.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	if dbInstance.State != string(InstanceStateTerminated) {
+		t.Errorf("expected the instance to stay terminated, got %s", dbInstance.State)
+	}
+
+	provider, err := cloud.NewProvider("fake", config)
+	if err != nil {
+		t.Fatalf("NewProvider returned error: %v", err)
+	}
+	if _, err := provider.Get(ctx, instance.ID); err != cloud.ErrInstanceNotFound {
+		t.Errorf("expected the instance created after it was removed to be destroyed, got %v", err)
+	}
+}
+
+func TestProviderRefreshRemovesLeakedInstances(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := context.TODO()
+
+	config := []byte(`{"namespace": "refresh-leaked-test"}`)
+	_, err := db.CreateProvider(database.Provider{Type: "fake", Name: "fake-leaked", Config: config})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+	provider, err := cloud.NewProvider("fake", config)
+	if err != nil {
+		t.Fatalf("NewProvider returned error: %v", err)
+	}
+
+	leaked := make(map[string]bool)
+	for _, state := range []InstanceState{InstanceStateTerminated, InstanceStateErrored, InstanceStateTerminating} {
+		id, err := db.CreateInstance(database.Instance{ProviderName: "fake-leaked", State: string(state), ErrorReason: "create failed"})
+		if err != nil {
+			t.Fatalf("CreateInstance returned error: %v", err)
+		}
+		if _, err := provider.Create(ctx, id, cloud.CreateAttributes{ImageName: "standard-image"}); err != nil {
+			t.Fatalf("provider.Create returned error: %v", err)
+		}
+		leaked[id] = state != InstanceStateTerminating
+	}
+
+	if err := core.ProviderRefresh(ctx); err != nil {
+		t.Fatalf("ProviderRefresh returned error: %v", err)
+	}
+
+	jobs := relayedJobs(t, db)
+	removed := make(map[string]bool)
+	for _, job := range jobs {
+		if job.JobName == "remove" {
+			removed[job.Payload] = true
+		}
+	}
+	for id, expected := range leaked {
+		if removed[id] != expected {
+			t.Errorf("expected a remove job for instance %s: %v, got %+v", id, expected, jobs)
+		}
+	}
+
+	if err := core.ProviderRefresh(ctx); err != nil {
+		t.Fatalf("ProviderRefresh returned error: %v", err)
+	}
+	if jobs := relayedJobs(t, db); len(jobs) != 0 {
+		t.Errorf("expected the removals not to be enqueued again right away, got %+v", jobs)
+	}
+}
@@ -0,0 +1,180 @@
+package cloudbrain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/tracing"
+)
+
+// providerStatusMaxAge is how old the provider configurations can be before
+// Ready loads them from the database again.
+const providerStatusMaxAge = time.Minute
+
+// errProvidersNotLoaded is reported by Ready until the provider configurations
+// have been loaded for the first time.
+var errProvidersNotLoaded = fmt.Errorf("provider configurations haven't been loaded yet")
+
+// A HealthCheck is the result of checking one of the dependencies of the Core.
+// Err is nil if the check passed.
+type HealthCheck struct {
+	Name string
+	Err  error
+}
+
+// Readiness is the result of Ready.
+type Readiness struct {
+	Checks []HealthCheck
+
+	// The names of the providers that are configured, sorted by name
+	Providers []string
+}
+
+// Ready returns true if all the checks passed.
+func (r Readiness) Ready() bool {
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Ready checks that the database and Redis are reachable, and that the
+// providers are usable. If loadProviders is true, the providers must have been
+// loaded with their configurations. Loading the configurations needs the
+// database encryption key, which the HTTP API doesn't have, so otherwise only
+// the types of the providers in the database are checked.
+func (c *Core) Ready(ctx context.Context, loadProviders bool) Readiness {
+	ctx, span := tracing.StartSpan(ctx, "Core.Ready")
+	defer span.End()
+
+	readiness := Readiness{
+		Checks: []HealthCheck{
+			{Name: "database", Err: c.tracedDB(ctx).Ping()},
+			{Name: "redis", Err: c.pingRedis()},
+		},
+	}
+
+	var providersErr error
+	if loadProviders {
+		readiness.Providers, providersErr = c.providerStatus()
+	} else {
+		readiness.Providers, providersErr = c.providerTypesStatus(ctx)
+	}
+	readiness.Checks = append(readiness.Checks, HealthCheck{Name: "providers", Err: providersErr})
+
+	return readiness
+}
+
+func (c *Core) pingRedis() error {
+	if c.redisPool == nil {
+		return fmt.Errorf("no redis pool configured")
+	}
+
+	conn := c.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// providerStatus returns the names of the loaded providers and the error from
+// the last time the provider configurations were loaded. It never waits for
+// the providers to be loaded: if it's been more than providerStatusMaxAge since
+// they were last loaded, they're loaded again in the background.
+func (c *Core) providerStatus() ([]string, error) {
+	c.providerStatusMutex.Lock()
+	defer c.providerStatusMutex.Unlock()
+
+	if time.Since(c.cloudProvidersRefreshedAt) > providerStatusMaxAge && !c.providerStatusRefreshing {
+		c.providerStatusRefreshing = true
+		go func() {
+			_ = c.refreshProviders()
+
+			c.providerStatusMutex.Lock()
+			c.providerStatusRefreshing = false
+			c.providerStatusMutex.Unlock()
+		}()
+	}
+
+	if c.cloudProvidersRefreshedAt.IsZero() {
+		return nil, errProvidersNotLoaded
+	}
+
+	return c.cloudProviderNames, c.cloudProvidersErr
+}
+
+// providerTypesStatus returns the names of the providers in the database, and
+// an error if one of them has a type that isn't registered with the cloud
+// package.
+func (c *Core) providerTypesStatus(ctx context.Context) ([]string, error) {
+	providerTypes, err := c.tracedDB(ctx).ListProviderTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range providerTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !cloud.ProviderRegistered(providerTypes[name]) {
+			return names, fmt.Errorf("provider %s has unknown type %s", name, providerTypes[name])
+		}
+	}
+
+	return names, nil
+}
+
+// A Heartbeat is used by a worker loop to signal that it's still making
+// progress. A nil *Heartbeat is always alive.
+type Heartbeat struct {
+	mutex  sync.Mutex
+	last   time.Time
+	maxAge time.Duration
+}
+
+// NewHeartbeat returns a Heartbeat that's alive until maxAge has passed
+// without a call to Beat.
+func NewHeartbeat(maxAge time.Duration) *Heartbeat {
+	return &Heartbeat{
+		last:   time.Now(),
+		maxAge: maxAge,
+	}
+}
+
+// Beat records that the worker loop made progress.
+func (h *Heartbeat) Beat() {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.last = time.Now()
+}
+
+// Check returns an error if Beat hasn't been called in the last maxAge.
+func (h *Heartbeat) Check() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if since := time.Since(h.last); since > h.maxAge {
+		return fmt.Errorf("no progress in %v", since/time.Second*time.Second)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package cloudbrain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+// providersCheck returns the providers check from the readiness.
+func providersCheck(t *testing.T, readiness Readiness) HealthCheck {
+	for _, check := range readiness.Checks {
+		if check.Name == "providers" {
+			return check
+		}
+	}
+
+	t.Fatalf("expected a providers check, got %+v", readiness.Checks)
+	return HealthCheck{}
+}
+
+func TestHeartbeat(t *testing.T) {
+	heartbeat := NewHeartbeat(time.Hour)
+	if err := heartbeat.Check(); err != nil {
+		t.Errorf("expected a new heartbeat to be alive, got %v", err)
+	}
+
+	heartbeat.last = time.Now().Add(-2 * time.Hour)
+	if err := heartbeat.Check(); err == nil {
+		t.Error("expected a stale heartbeat to fail the check")
+	}
+
+	heartbeat.Beat()
+	if err := heartbeat.Check(); err != nil {
+		t.Errorf("expected the heartbeat to be alive after a beat, got %v", err)
+	}
+
+	var nilHeartbeat *Heartbeat
+	if err := nilHeartbeat.Check(); err != nil {
+		t.Errorf("expected a nil heartbeat to be alive, got %v", err)
+	}
+}
+
+func TestReadyProviderTypes(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	for _, provider := range []database.Provider{
+		{Type: "fake", Name: "fake"},
+		{Type: "docker", Name: "docker-local"},
+	} {
+		if _, err := db.CreateProvider(provider); err != nil {
+			t.Fatalf("CreateProvider returned error: %v", err)
+		}
+	}
+
+	readiness := core.Ready(context.TODO(), false)
+	if err := providersCheck(t, readiness).Err; err != nil {
+		t.Errorf("expected the providers check to pass, got %v", err)
+	}
+	if len(readiness.Providers) != 2 || readiness.Providers[0] != "docker-local" || readiness.Providers[1] != "fake" {
+		t.Errorf("expected the provider names to be listed, got %v", readiness.Providers)
+	}
+
+	if _, err := db.CreateProvider(database.Provider{Type: "unknown", Name: "broken"}); err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+	if providersCheck(t, core.Ready(context.TODO(), false)).Err == nil {
+		t.Error("expected the providers check to fail for a provider of an unknown type")
+	}
+}
+
+func TestReadyDoesntWaitForRefresh(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	if _, err := db.CreateProvider(database.Provider{Type: "fake", Name: "fake", Config: []byte(`{}`)}); err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	// ProviderRefresh holds the mutex while listing instances
+	core.cloudProvidersMutex.Lock()
+
+	done := make(chan Readiness)
+	go func() {
+		done <- core.Ready(context.TODO(), true)
+	}()
+
+	select {
+	case readiness := <-done:
+		if err := providersCheck(t, readiness).Err; err != errProvidersNotLoaded {
+			t.Errorf("expected errProvidersNotLoaded before the first load, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Ready not to wait for the providers to be loaded")
+	}
+
+	core.cloudProvidersMutex.Unlock()
+
+	// The providers are loaded in the background once the mutex is released
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		readiness := core.Ready(context.TODO(), true)
+		if providersCheck(t, readiness).Err == nil {
+			if len(readiness.Providers) != 1 || readiness.Providers[0] != "fake" {
+				t.Errorf("expected the loaded providers to be listed, got %v", readiness.Providers)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the providers to be loaded in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
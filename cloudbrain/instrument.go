@@ -0,0 +1,82 @@
+package cloudbrain
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/metrics"
+	"github.com/travis-ci/cloud-brain/tracing"
+)
+
+// InstrumentJob wraps a background job handler so that its duration and
+// failures are recorded in the job metrics under the given job name.
+func InstrumentJob(name string, handler func(*work.Job) error) func(*work.Job) error {
+	return func(job *work.Job) error {
+		start := time.Now()
+		err := handler(job)
+		metrics.JobDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.JobFailures.WithLabelValues(name).Inc()
+		}
+
+		return err
+	}
+}
+
+// instrumentedProvider wraps a cloud.Provider so that the latency and errors of
+// every call are recorded in the provider metrics, and every call is traced.
+// cloud.ErrInstanceNotFound isn't counted as an error, since it's an expected
+// answer to Get and Destroy.
+type instrumentedProvider struct {
+	name     string
+	provider cloud.Provider
+}
+
+func (p *instrumentedProvider) startSpan(ctx context.Context, operation string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(ctx, "provider."+operation)
+	span.SetAttribute("provider", p.name)
+	return ctx, span
+}
+
+func (p *instrumentedProvider) observe(operation string, start time.Time, span *tracing.Span, err error) {
+	metrics.ProviderCallDuration.WithLabelValues(p.name, operation).Observe(time.Since(start).Seconds())
+	if err != nil && err != cloud.ErrInstanceNotFound {
+		metrics.ProviderCallErrors.WithLabelValues(p.name, operation).Inc()
+		span.SetError(err)
+	}
+	span.End()
+}
+
+func (p *instrumentedProvider) List(ctx context.Context) ([]cloud.Instance, error) {
+	ctx, span := p.startSpan(ctx, "list")
+	start := time.Now()
+	instances, err := p.provider.List(ctx)
+	p.observe("list", start, span, err)
+	return instances, err
+}
+
+func (p *instrumentedProvider) Create(ctx context.Context, id string, attr cloud.CreateAttributes) (cloud.Instance, error) {
+	ctx, span := p.startSpan(ctx, "create")
+	start := time.Now()
+	instance, err := p.provider.Create(ctx, id, attr)
+	p.observe("create", start, span, err)
+	return instance, err
+}
+
+func (p *instrumentedProvider) Get(ctx context.Context, id string) (cloud.Instance, error) {
+	ctx, span := p.startSpan(ctx, "get")
+	start := time.Now()
+	instance, err := p.provider.Get(ctx, id)
+	p.observe("get", start, span, err)
+	return instance, err
+}
+
+func (p *instrumentedProvider) Destroy(ctx context.Context, id string) error {
+	ctx, span := p.startSpan(ctx, "destroy")
+	start := time.Now()
+	err := p.provider.Destroy(ctx, id)
+	p.observe("destroy", start, span, err)
+	return err
+}
@@ -0,0 +1,89 @@
+package cloudbrain
+
+import (
+	"context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+// maxLifetimeReason is the ErrorReason set on instances that are removed for
+// living longer than their provider's MaxLifetime.
+const maxLifetimeReason = "exceeded max lifetime"
+
+// maxLifetimeRetryInterval is how long enforceMaxLifetime waits after an
+// errored instance last started terminating before removing it again.
+const maxLifetimeRetryInterval = 15 * time.Minute
+
+// enforceMaxLifetime marks the instances on the given provider that were
+// created longer than maxLifetime ago as terminating, and enqueues remove jobs
+// for them. Errored instances are removed again if they haven't started
+// terminating in the last maxLifetimeRetryInterval, so an instance whose
+// removal failed isn't kept around forever. Terminating instances are left to
+// the stuck instance checks. The ErrorReason is set to maxLifetimeReason unless
+// the instance already has one. Does nothing if maxLifetime is zero.
+func (c *Core) enforceMaxLifetime(ctx context.Context, providerName string, maxLifetime time.Duration) error {
+	if maxLifetime <= 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	createdBefore := now.Add(-maxLifetime)
+
+	for _, state := range []InstanceState{InstanceStateStarting, InstanceStateRunning, InstanceStateErrored} {
+		instances, err := c.tracedDB(ctx).ListInstances(database.InstanceFilter{
+			State:         string(state),
+			ProviderName:  providerName,
+			CreatedBefore: createdBefore,
+		})
+		if err != nil {
+			return errors.Wrap(err, "error listing instances that exceeded max lifetime")
+		}
+
+		for _, instance := range instances {
+			if state == InstanceStateErrored && now.Sub(instance.TerminatingAt) < maxLifetimeRetryInterval {
+				// The removal was retried recently
+				continue
+			}
+
+			err := c.updateInstance(ctx, &instance, maxLifetimeReason, func(i *database.Instance) InstanceState {
+				if i.ErrorReason == "" {
+					// Keep the reason an errored instance failed with
+					i.ErrorReason = maxLifetimeReason
+				}
+				return InstanceStateTerminating
+			})
+			if isIllegalTransition(err) {
+				continue
+			}
+			if err != nil {
+				cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+					"err":         err,
+					"instance_id": instance.ID,
+				}).Error("failed to update instance in database")
+				continue
+			}
+
+			err = c.enqueueRemove(ctx, instance.ID)
+			if err != nil {
+				cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+					"err":         err,
+					"instance_id": instance.ID,
+				}).Error("failed to enqueue removal of instance that exceeded max lifetime")
+				continue
+			}
+
+			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"instance_id":  instance.ID,
+				"provider":     providerName,
+				"created_at":   instance.CreatedAt,
+				"max_lifetime": maxLifetime,
+			}).Info("enqueued removal of instance that exceeded max lifetime")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package cloudbrain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+func TestEnforceMaxLifetime(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := context.TODO()
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:        "fake",
+		Name:        "fake-lifetime",
+		Config:      []byte(`{"namespace": "lifetime-test", "destroy_error_rate": 1}`),
+		MaxLifetime: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	now := time.Now().UTC()
+	oldID, err := db.CreateInstance(database.Instance{ProviderName: "fake-lifetime", State: "running", CreatedAt: now.Add(-2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	youngID, err := db.CreateInstance(database.Instance{ProviderName: "fake-lifetime", State: "running", CreatedAt: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	enforce := func() []database.OutboxJob {
+		if err := core.enforceMaxLifetime(ctx, "fake-lifetime", time.Hour); err != nil {
+			t.Fatalf("enforceMaxLifetime returned error: %v", err)
+		}
+		return relayedJobs(t, db)
+	}
+	expectState := func(id string, state InstanceState) database.Instance {
+		instance, err := db.GetInstance(id)
+		if err != nil {
+			t.Fatalf("GetInstance returned error: %v", err)
+		}
+		if instance.State != string(state) {
+			t.Errorf("expected instance to be %s, got %s", state, instance.State)
+		}
+		return instance
+	}
+
+	jobs := enforce()
+	if len(jobs) != 1 || jobs[0].JobName != "remove" || jobs[0].Payload != oldID {
+		t.Fatalf("expected a remove job for the old instance, got %+v", jobs)
+	}
+	if instance := expectState(oldID, InstanceStateTerminating); instance.ErrorReason != maxLifetimeReason {
+		t.Errorf("expected the error reason to be %q, got %q", maxLifetimeReason, instance.ErrorReason)
+	}
+	expectState(youngID, InstanceStateRunning)
+
+	if jobs := enforce(); len(jobs) != 0 {
+		t.Errorf("expected no remove jobs for a terminating instance, got %+v", jobs)
+	}
+
+	// The fake provider fails to destroy the instance, so it's errored
+	if err := core.ProviderRemoveInstance(&work.Job{Args: map[string]interface{}{"payload": oldID}}); err == nil {
+		t.Fatal("expected ProviderRemoveInstance to return an error")
+	}
+	instance := expectState(oldID, InstanceStateErrored)
+	removeReason := instance.ErrorReason
+	if removeReason == maxLifetimeReason {
+		t.Fatalf("expected the error reason to be the destroy error, got %q", removeReason)
+	}
+
+	if jobs := enforce(); len(jobs) != 0 {
+		t.Errorf("expected no remove jobs right after the removal failed, got %+v", jobs)
+	}
+
+	instance.TerminatingAt = now.Add(-maxLifetimeRetryInterval)
+	if err := db.UpdateInstance(instance); err != nil {
+		t.Fatalf("UpdateInstance returned error: %v", err)
+	}
+
+	jobs = enforce()
+	if len(jobs) != 1 || jobs[0].Payload != oldID {
+		t.Errorf("expected the removal of the errored instance to be retried, got %+v", jobs)
+	}
+	if instance := expectState(oldID, InstanceStateTerminating); instance.ErrorReason != removeReason {
+		t.Errorf("expected the errored instance to keep its error reason %q, got %q", removeReason, instance.ErrorReason)
+	}
+}
@@ -0,0 +1,161 @@
+package cloudbrain
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/tracing"
+)
+
+// An Orphan is an instance that exists on a provider, but has no record in the
+// database. Orphans are found by ProviderRefresh.
+type Orphan struct {
+	ProviderName string
+	ID           string
+	UpstreamID   string
+	State        cloud.InstanceState
+
+	// CreatedAt is when the provider created the instance, or the zero time
+	// if the provider doesn't report that.
+	CreatedAt time.Time
+
+	// FirstSeenAt is when ProviderRefresh first saw the instance without a
+	// record in the database. The grace period is counted from then rather
+	// than from CreatedAt, so an instance whose record is only late to be
+	// inserted isn't destroyed the first time it's seen.
+	FirstSeenAt time.Time
+
+	// Reaped is set on the orphans returned by ReapOrphans if they were
+	// destroyed.
+	Reaped bool
+}
+
+// Age returns how long the instance has been known to be an orphan, as of now.
+func (o Orphan) Age(now time.Time) time.Duration {
+	return now.Sub(o.FirstSeenAt)
+}
+
+func orphanKey(providerName, id string) string {
+	return providerName + "/" + id
+}
+
+// trackOrphans replaces the orphans known for the given provider with the
+// given instances, keeping the time already known orphans were first seen.
+// Terminated instances are skipped, since they're already gone and some
+// providers keep listing them for a while. Returns the number of orphans.
+func (c *Core) trackOrphans(providerName string, instances []cloud.Instance) int {
+	c.orphansMutex.Lock()
+	defer c.orphansMutex.Unlock()
+
+	now := time.Now().UTC()
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.State == cloud.InstanceStateTerminated {
+			continue
+		}
+
+		key := orphanKey(providerName, instance.ID)
+		seen[key] = true
+
+		firstSeenAt := now
+		if existing, ok := c.orphans[key]; ok {
+			firstSeenAt = existing.FirstSeenAt
+		}
+
+		c.orphans[key] = Orphan{
+			ProviderName: providerName,
+			ID:           instance.ID,
+			UpstreamID:   instance.UpstreamID,
+			State:        instance.State,
+			CreatedAt:    instance.CreatedAt,
+			FirstSeenAt:  firstSeenAt,
+		}
+	}
+
+	for key, orphan := range c.orphans {
+		if orphan.ProviderName == providerName && !seen[key] {
+			delete(c.orphans, key)
+		}
+	}
+
+	return len(seen)
+}
+
+// Orphans returns the orphans found by the last ProviderRefresh, in the order
+// they were first seen.
+func (c *Core) Orphans() []Orphan {
+	c.orphansMutex.Lock()
+	defer c.orphansMutex.Unlock()
+
+	orphans := make([]Orphan, 0, len(c.orphans))
+	for _, orphan := range c.orphans {
+		orphans = append(orphans, orphan)
+	}
+
+	sort.Sort(orphansByFirstSeen(orphans))
+
+	return orphans
+}
+
+// ReapOrphans destroys the orphans that were first seen longer than the grace
+// period ago, and returns them. If dryRun is true, nothing is destroyed and
+// the orphans that would have been destroyed are returned.
+func (c *Core) ReapOrphans(ctx context.Context, gracePeriod time.Duration, dryRun bool) ([]Orphan, error) {
+	ctx, span := tracing.StartSpan(ctx, "Core.ReapOrphans")
+	defer span.End()
+
+	now := time.Now().UTC()
+
+	var reapable []Orphan
+	for _, orphan := range c.Orphans() {
+		if orphan.Age(now) >= gracePeriod {
+			reapable = append(reapable, orphan)
+		}
+	}
+
+	if dryRun {
+		return reapable, nil
+	}
+
+	var result error
+	for i, orphan := range reapable {
+		cloudProvider, err := c.cloudProvider(orphan.ProviderName)
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "couldn't find provider with given name: %v", orphan.ProviderName))
+			continue
+		}
+
+		err = cloudProvider.Destroy(ctx, orphan.ID)
+		if err != nil && err != cloud.ErrInstanceNotFound {
+			result = multierror.Append(result, errors.Wrapf(err, "error destroying orphaned instance %s", orphan.ID))
+			continue
+		}
+
+		reapable[i].Reaped = true
+
+		c.orphansMutex.Lock()
+		delete(c.orphans, orphanKey(orphan.ProviderName, orphan.ID))
+		c.orphansMutex.Unlock()
+
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"provider":    orphan.ProviderName,
+			"provider_id": orphan.ID,
+			"upstream_id": orphan.UpstreamID,
+			"age":         orphan.Age(now),
+		}).Info("reaped orphaned instance")
+	}
+
+	return reapable, result
+}
+
+type orphansByFirstSeen []Orphan
+
+func (s orphansByFirstSeen) Len() int           { return len(s) }
+func (s orphansByFirstSeen) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s orphansByFirstSeen) Less(i, j int) bool { return s[i].FirstSeenAt.Before(s[j].FirstSeenAt) }
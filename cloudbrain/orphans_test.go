@@ -0,0 +1,71 @@
+package cloudbrain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+func TestReapOrphansGracePeriod(t *testing.T) {
+	core := NewCore(database.NewMemoryDatabase(), nil, "")
+
+	// The provider created both instances long ago, but that doesn't count
+	// towards the grace period
+	now := time.Now().UTC()
+	core.trackOrphans("fake", []cloud.Instance{
+		{ID: "old", State: cloud.InstanceStateRunning, CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "new", State: cloud.InstanceStateRunning, CreatedAt: now.Add(-2 * time.Hour)},
+	})
+
+	orphans, err := core.ReapOrphans(context.TODO(), time.Hour, true)
+	if err != nil {
+		t.Fatalf("ReapOrphans returned error: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("expected orphans seen for the first time not to be reported, got %+v", orphans)
+	}
+
+	core.orphansMutex.Lock()
+	old := core.orphans[orphanKey("fake", "old")]
+	old.FirstSeenAt = now.Add(-2 * time.Hour)
+	core.orphans[orphanKey("fake", "old")] = old
+	core.orphansMutex.Unlock()
+
+	orphans, err = core.ReapOrphans(context.TODO(), time.Hour, true)
+	if err != nil {
+		t.Fatalf("ReapOrphans returned error: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != "old" || orphans[0].Reaped {
+		t.Errorf("expected only the orphan first seen long ago to be reported, got %+v", orphans)
+	}
+
+	if len(core.Orphans()) != 2 {
+		t.Errorf("expected a dry run to keep both orphans, got %+v", core.Orphans())
+	}
+
+	core.trackOrphans("fake", []cloud.Instance{{ID: "old", State: cloud.InstanceStateRunning}})
+	orphans = core.Orphans()
+	if len(orphans) != 1 || !orphans[0].FirstSeenAt.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("expected the first seen time of known orphans to be kept, got %+v", orphans)
+	}
+}
+
+func TestTrackOrphansSkipsTerminated(t *testing.T) {
+	core := NewCore(database.NewMemoryDatabase(), nil, "")
+
+	count := core.trackOrphans("ec2", []cloud.Instance{
+		{ID: "running", State: cloud.InstanceStateRunning},
+		{ID: "terminated", State: cloud.InstanceStateTerminated},
+	})
+	if count != 1 {
+		t.Errorf("expected 1 orphan, got %d", count)
+	}
+
+	orphans := core.Orphans()
+	if len(orphans) != 1 || orphans[0].ID != "running" {
+		t.Errorf("expected the terminated instance not to be an orphan, got %+v", orphans)
+	}
+}
@@ -0,0 +1,71 @@
+package cloudbrain
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gocraft/work"
+	"github.com/pkg/errors"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/database"
+	"github.com/travis-ci/cloud-brain/tracing"
+)
+
+// jobMetadata returns the metadata to store with a background job created in
+// the given context, so the job can be tied back to the request that created
+// it.
+func jobMetadata(ctx context.Context) map[string]string {
+	metadata := cbcontext.JobMetadata(ctx)
+	if traceparent := tracing.TraceparentFromContext(ctx); traceparent != "" {
+		metadata["traceparent"] = traceparent
+	}
+
+	return metadata
+}
+
+// jobContext returns the context to run the given background job in, restored
+// from the metadata stored with the job.
+func jobContext(job *work.Job) context.Context {
+	ctx := cbcontext.FromJobMetadata(context.Background(), job.Args)
+	if traceparent, ok := job.Args["traceparent"].(string); ok {
+		ctx = tracing.FromTraceparent(ctx, traceparent)
+	}
+
+	return ctx
+}
+
+// RelayOutbox enqueues up to limit jobs from the outbox in the background, and
+// returns the number of jobs that were enqueued. Jobs are only removed from the
+// outbox once they've been enqueued, so a job is enqueued at least once even if
+// Redis is unavailable when the job is created.
+func (c *Core) RelayOutbox(ctx context.Context, limit int) (int, error) {
+	ctx, span := tracing.StartSpan(ctx, "Core.RelayOutbox")
+	defer span.End()
+
+	var enqueuer = work.NewEnqueuer(c.redisWorkerPrefix, c.redisPool)
+
+	relayed, err := c.tracedDB(ctx).RelayOutboxJobs(limit, func(job database.OutboxJob) error {
+		args := work.Q{}
+		for key, value := range job.Metadata {
+			args[key] = value
+		}
+		args["payload"] = job.Payload
+
+		_, err := enqueuer.Enqueue(job.JobName, args)
+		if err != nil {
+			return errors.Wrapf(err, "error enqueueing '%s' job in the background", job.JobName)
+		}
+
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"job_name": job.JobName,
+			"payload":  job.Payload,
+		}).Debug("relayed job from the outbox")
+
+		return nil
+	})
+	if err != nil {
+		return relayed, errors.Wrap(err, "error relaying jobs from the outbox")
+	}
+
+	return relayed, nil
+}
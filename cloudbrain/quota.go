@@ -0,0 +1,114 @@
+package cloudbrain
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+// ErrInvalidQuota is returned by CreateToken if one of the limits of the quota
+// is negative.
+var ErrInvalidQuota = fmt.Errorf("invalid quota, limits can't be negative")
+
+// Quota limits the instances that can be created by a token or on a provider.
+// Zero values mean there's no limit.
+type Quota struct {
+	// MaxInstances is the number of instances that can exist at the same
+	// time, counting every instance that isn't terminated.
+	MaxInstances int
+
+	// MaxPremiumInstances is like MaxInstances, but only counts premium
+	// instances.
+	MaxPremiumInstances int
+
+	// MaxCreatesPerMinute is the number of instances that can be created in
+	// a minute.
+	MaxCreatesPerMinute int
+}
+
+func (q Quota) valid() bool {
+	return q.MaxInstances >= 0 && q.MaxPremiumInstances >= 0 && q.MaxCreatesPerMinute >= 0
+}
+
+// limits returns the limits of the quota for creating an instance of the given
+// type, counting the instances matching the filter. The key and name identify
+// who the quota belongs to, e.g. "tenant:org" and "tenant org".
+func (q Quota) limits(key, name string, filter database.InstanceFilter, instanceType string, now time.Time) []database.QuotaLimit {
+	var limits []database.QuotaLimit
+
+	if q.MaxInstances > 0 {
+		f := filter
+		f.ExcludeStates = []string{string(InstanceStateTerminated)}
+		limits = append(limits, database.QuotaLimit{
+			Key:         key,
+			Filter:      f,
+			Max:         q.MaxInstances,
+			Description: fmt.Sprintf("at most %d instances for %s", q.MaxInstances, name),
+		})
+	}
+
+	if q.MaxPremiumInstances > 0 && instanceType == string(cloud.InstanceTypePremium) {
+		f := filter
+		f.InstanceType = instanceType
+		f.ExcludeStates = []string{string(InstanceStateTerminated)}
+		limits = append(limits, database.QuotaLimit{
+			Key:         key,
+			Filter:      f,
+			Max:         q.MaxPremiumInstances,
+			Description: fmt.Sprintf("at most %d premium instances for %s", q.MaxPremiumInstances, name),
+		})
+	}
+
+	if q.MaxCreatesPerMinute > 0 {
+		f := filter
+		f.CreatedAfter = now.Add(-time.Minute)
+		limits = append(limits, database.QuotaLimit{
+			Key:         key,
+			Filter:      f,
+			Max:         q.MaxCreatesPerMinute,
+			Description: fmt.Sprintf("at most %d instances created per minute for %s", q.MaxCreatesPerMinute, name),
+		})
+	}
+
+	return limits
+}
+
+// QuotaExceededError is returned from CreateInstance when creating the
+// instance would exceed the quota of the token or the provider.
+type QuotaExceededError struct {
+	// Limit describes the limit that would be exceeded, e.g. "at most 10
+	// instances for tenant org".
+	Limit string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", e.Limit)
+}
+
+// quotaLimits returns the limits that creating an instance of the given type on
+// the provider must be within. These are the quota of the token in the
+// context, counting the instances of its tenant if it has one, and the quota
+// of the provider.
+func (c *Core) quotaLimits(ctx context.Context, providerName, instanceType string) ([]database.QuotaLimit, error) {
+	now := time.Now().UTC()
+
+	var limits []database.QuotaLimit
+	if token, ok := TokenFromContext(ctx); ok {
+		if token.Tenant != "" {
+			limits = append(limits, token.Quota.limits("tenant:"+token.Tenant, "tenant "+token.Tenant, database.InstanceFilter{Tenant: token.Tenant}, instanceType, now)...)
+		} else {
+			limits = append(limits, token.Quota.limits(fmt.Sprintf("token:%d", token.ID), fmt.Sprintf("token %d", token.ID), database.InstanceFilter{OwnerTokenID: token.ID}, instanceType, now)...)
+		}
+	}
+
+	providerQuota, err := c.tracedDB(ctx).GetProviderQuota(providerName)
+	if err != nil {
+		return nil, err
+	}
+	limits = append(limits, Quota(providerQuota).limits("provider:"+providerName, "provider "+providerName, database.InstanceFilter{ProviderName: providerName}, instanceType, now)...)
+
+	return limits, nil
+}
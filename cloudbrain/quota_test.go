@@ -0,0 +1,71 @@
+package cloudbrain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/travis-ci/cloud-brain/cloud"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+func TestCreateInstanceQuota(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:   "fake",
+		Name:   "fake-limited",
+		Config: []byte(`{"namespace": "quota-test"}`),
+		Quota:  database.Quota{MaxCreatesPerMinute: 1},
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	tenant := []context.Context{
+		FromToken(context.TODO(), &Token{ID: 1, Tenant: "org", Quota: Quota{MaxInstances: 3, MaxPremiumInstances: 1}}),
+		FromToken(context.TODO(), &Token{ID: 2, Tenant: "org", Quota: Quota{MaxInstances: 3, MaxPremiumInstances: 1}}),
+	}
+	premium := CreateInstanceAttributes{ImageName: "image", InstanceType: string(cloud.InstanceTypePremium)}
+	standard := CreateInstanceAttributes{ImageName: "image"}
+
+	if _, err := core.CreateInstance(tenant[0], "gce", premium); err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	if _, err := core.CreateInstance(tenant[1], "gce", premium); err == nil {
+		t.Error("expected the tenant's premium quota to be shared between its tokens")
+	} else if _, ok := err.(*QuotaExceededError); !ok {
+		t.Errorf("expected a *QuotaExceededError, got %v", err)
+	}
+
+	if _, err := core.CreateInstance(tenant[1], "gce", standard); err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	instance, err := core.CreateInstance(tenant[1], "gce", standard)
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	if _, err := core.CreateInstance(tenant[0], "gce", standard); err == nil {
+		t.Error("expected the tenant's instance quota to be exceeded")
+	}
+
+	dbInstance, err := db.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	dbInstance.State = string(InstanceStateTerminated)
+	if err := db.UpdateInstance(dbInstance); err != nil {
+		t.Fatalf("UpdateInstance returned error: %v", err)
+	}
+	if _, err := core.CreateInstance(tenant[0], "gce", standard); err != nil {
+		t.Errorf("expected terminated instances not to count against the quota, got %v", err)
+	}
+
+	if _, err := core.CreateInstance(context.TODO(), "fake-limited", standard); err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	_, err = core.CreateInstance(context.TODO(), "fake-limited", standard)
+	if err == nil || err.Error() != "quota exceeded: at most 1 instances created per minute for provider fake-limited" {
+		t.Errorf("expected the provider's rate limit to be exceeded, got %v", err)
+	}
+}
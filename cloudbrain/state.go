@@ -0,0 +1,98 @@
+package cloudbrain
+
+import "fmt"
+
+// InstanceState is the state of an instance as tracked by Cloud Brain. The
+// legal transitions between states are defined by CanTransitionTo.
+type InstanceState string
+
+const (
+	// InstanceStateCreating is the state of an instance that has been
+	// requested, but not yet created on the provider.
+	InstanceStateCreating InstanceState = "creating"
+
+	// InstanceStateStarting is the state of an instance that has been created
+	// on the provider, but isn't running yet.
+	InstanceStateStarting InstanceState = "starting"
+
+	// InstanceStateRunning is the state of an instance that is running.
+	InstanceStateRunning InstanceState = "running"
+
+	// InstanceStateTerminating is the state of an instance that has been
+	// removed on the provider, but hasn't disappeared yet.
+	InstanceStateTerminating InstanceState = "terminating"
+
+	// InstanceStateTerminated is the state of an instance that no longer
+	// exists on the provider.
+	InstanceStateTerminated InstanceState = "terminated"
+
+	// InstanceStateErrored is the state of an instance that couldn't be
+	// created or removed. The ErrorReason says why.
+	InstanceStateErrored InstanceState = "errored"
+)
+
+// instanceStateTransitions maps each state to the states it can move to.
+var instanceStateTransitions = map[InstanceState][]InstanceState{
+	InstanceStateCreating: {
+		InstanceStateStarting,
+		InstanceStateRunning,
+		InstanceStateTerminating,
+		InstanceStateTerminated,
+		InstanceStateErrored,
+	},
+	InstanceStateStarting: {
+		InstanceStateRunning,
+		InstanceStateTerminating,
+		InstanceStateTerminated,
+		InstanceStateErrored,
+	},
+	InstanceStateRunning: {
+		InstanceStateTerminating,
+		InstanceStateTerminated,
+		InstanceStateErrored,
+	},
+	InstanceStateTerminating: {
+		InstanceStateTerminated,
+		InstanceStateErrored,
+	},
+	InstanceStateErrored: {
+		InstanceStateTerminating,
+		InstanceStateTerminated,
+	},
+	InstanceStateTerminated: {},
+}
+
+// Valid returns true if the state is one of the InstanceState… constants
+// defined in this package.
+func (s InstanceState) Valid() bool {
+	_, ok := instanceStateTransitions[s]
+	return ok
+}
+
+// CanTransitionTo returns true if an instance in this state is allowed to move
+// to the given state. Staying in the same state is always allowed.
+func (s InstanceState) CanTransitionTo(to InstanceState) bool {
+	if s == to {
+		return true
+	}
+
+	for _, state := range instanceStateTransitions[s] {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IllegalTransitionError is returned when an instance is asked to move to a
+// state it can't move to from its current state.
+type IllegalTransitionError struct {
+	InstanceID string
+	From       InstanceState
+	To         InstanceState
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("instance %s can't move from %s to %s", e.InstanceID, e.From, e.To)
+}
@@ -0,0 +1,25 @@
+package cloudbrain
+
+import "testing"
+
+func TestInstanceStateCanTransitionTo(t *testing.T) {
+	for _, tc := range []struct {
+		from, to InstanceState
+		legal    bool
+	}{
+		{InstanceStateCreating, InstanceStateStarting, true},
+		{InstanceStateStarting, InstanceStateRunning, true},
+		{InstanceStateRunning, InstanceStateRunning, true},
+		{InstanceStateRunning, InstanceStateTerminating, true},
+		{InstanceStateTerminating, InstanceStateTerminated, true},
+		{InstanceStateErrored, InstanceStateTerminating, true},
+		{InstanceStateTerminated, InstanceStateRunning, false},
+		{InstanceStateTerminating, InstanceStateRunning, false},
+		{InstanceStateRunning, InstanceStateStarting, false},
+		{InstanceStateErrored, InstanceStateRunning, false},
+	} {
+		if legal := tc.from.CanTransitionTo(tc.to); legal != tc.legal {
+			t.Errorf("expected %s -> %s legal to be %v, got %v", tc.from, tc.to, tc.legal, legal)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package cloudbrain
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/database"
+	"github.com/travis-ci/cloud-brain/metrics"
+	"github.com/travis-ci/cloud-brain/tracing"
+)
+
+// RemediateStuckInstances finds the instances that have been in one of the
+// given states for longer than the timeout for that state, marks them as
+// errored and enqueues a remove job for them. States with a zero timeout are
+// not checked.
+func (c *Core) RemediateStuckInstances(ctx context.Context, timeouts map[InstanceState]time.Duration) error {
+	ctx, span := tracing.StartSpan(ctx, "Core.RemediateStuckInstances")
+	defer span.End()
+
+	var result error
+
+	for state, timeout := range timeouts {
+		if timeout <= 0 {
+			continue
+		}
+
+		now := time.Now().UTC()
+
+		// An instance can't have been in a state for longer than it has
+		// existed, so this narrows down the instances to check.
+		instances, err := c.tracedDB(ctx).ListInstances(database.InstanceFilter{
+			State:         string(state),
+			CreatedBefore: now.Add(-timeout),
+		})
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "error listing instances in state %s", state))
+			continue
+		}
+
+		for _, instance := range instances {
+			if now.Sub(stateEnteredAt(instance)) < timeout {
+				continue
+			}
+
+			err := c.remediateStuckInstance(ctx, instance, state, timeout)
+			if err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+
+	return result
+}
+
+func (c *Core) remediateStuckInstance(ctx context.Context, instance database.Instance, state InstanceState, timeout time.Duration) error {
+	reason := fmt.Sprintf("stuck in %s for more than %v", state, timeout)
+
+	cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"instance_id": instance.ID,
+		"provider":    instance.ProviderName,
+		"state":       state,
+		"timeout":     timeout,
+	}).Warn("instance is stuck, removing it")
+
+	// The instance is marked as errored before the remove job is enqueued,
+	// so the job can't move it to terminating first and have it overwritten
+	// with errored by a retry of this update. If the instance made progress
+	// in the meantime, it's left alone.
+	stillStuck := true
+	err := c.updateInstance(ctx, &instance, reason, func(i *database.Instance) InstanceState {
+		stillStuck = InstanceState(i.State) == state
+		if !stillStuck {
+			return InstanceState(i.State)
+		}
+
+		i.ErrorReason = reason
+		return InstanceStateErrored
+	})
+	if isIllegalTransition(err) || err == nil && !stillStuck {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error marking stuck instance %s as errored", instance.ID)
+	}
+
+	metrics.StuckInstances.WithLabelValues(instance.ProviderName, string(state)).Inc()
+
+	return c.enqueueRemove(ctx, instance.ID)
+}
+
+// stateEnteredAt returns when the instance entered its current state. Falls
+// back to the last update time for instances from before the per-state
+// timestamps were tracked.
+func stateEnteredAt(instance database.Instance) time.Time {
+	var enteredAt time.Time
+	switch InstanceState(instance.State) {
+	case InstanceStateCreating:
+		enteredAt = instance.CreatedAt
+	case InstanceStateStarting:
+		enteredAt = instance.StartingAt
+	case InstanceStateRunning:
+		enteredAt = instance.RunningAt
+	case InstanceStateTerminating:
+		enteredAt = instance.TerminatingAt
+	case InstanceStateTerminated:
+		enteredAt = instance.TerminatedAt
+	case InstanceStateErrored:
+		enteredAt = instance.ErroredAt
+	}
+
+	if enteredAt.IsZero() {
+		return instance.UpdatedAt
+	}
+	return enteredAt
+}
@@ -0,0 +1,117 @@
+package cloudbrain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+func TestRemediateStuckInstances(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:   "fake",
+		Name:   "fake-stuck",
+		Config: []byte(`{"namespace": "stuck-test"}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	now := time.Now().UTC()
+	old := now.Add(-2 * time.Hour)
+	instances := map[string]database.Instance{
+		"creating":         {State: "creating", CreatedAt: old},
+		"starting":         {State: "starting", CreatedAt: old, StartingAt: now.Add(-20 * time.Minute)},
+		"recently started": {State: "starting", CreatedAt: old, StartingAt: now.Add(-time.Minute)},
+		"terminating":      {State: "terminating", CreatedAt: old, TerminatingAt: now.Add(-20 * time.Minute)},
+		"running":          {State: "running", CreatedAt: old, RunningAt: old},
+	}
+	ids := make(map[string]string)
+	for name, instance := range instances {
+		instance.ProviderName = "fake-stuck"
+		id, err := db.CreateInstance(instance)
+		if err != nil {
+			t.Fatalf("CreateInstance returned error: %v", err)
+		}
+		ids[name] = id
+	}
+
+	err = core.RemediateStuckInstances(context.TODO(), map[InstanceState]time.Duration{
+		InstanceStateCreating:    time.Hour,
+		InstanceStateStarting:    15 * time.Minute,
+		InstanceStateTerminating: 15 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("RemediateStuckInstances returned error: %v", err)
+	}
+
+	removed := make(map[string]bool)
+	for _, job := range relayedJobs(t, db) {
+		if job.JobName == "remove" {
+			removed[job.Payload] = true
+		}
+	}
+
+	for name, id := range ids {
+		instance, err := db.GetInstance(id)
+		if err != nil {
+			t.Fatalf("GetInstance returned error: %v", err)
+		}
+
+		stuck := name == "creating" || name == "starting" || name == "terminating"
+		if stuck {
+			if instance.State != string(InstanceStateErrored) || instance.ErrorReason == "" {
+				t.Errorf("expected the %s instance to be errored with a reason, got %s (%q)", name, instance.State, instance.ErrorReason)
+			}
+		} else if instance.State != instances[name].State {
+			t.Errorf("expected the %s instance to be left alone, got %s", name, instance.State)
+		}
+		if removed[id] != stuck {
+			t.Errorf("expected a remove job for the %s instance: %v, got %v", name, stuck, removed[id])
+		}
+	}
+
+	// The remove job runs after the instance was marked as errored, so the
+	// instance ends up terminated rather than errored
+	if err := core.ProviderRemoveInstance(&work.Job{Args: map[string]interface{}{"payload": ids["starting"]}}); err != nil {
+		t.Fatalf("ProviderRemoveInstance returned error: %v", err)
+	}
+	instance, err := db.GetInstance(ids["starting"])
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	if instance.State != string(InstanceStateTerminated) {
+		t.Errorf("expected the removed instance to be terminated, got %s", instance.State)
+	}
+}
+
+func TestRemediateStuckInstancesDisabled(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	id, err := db.CreateInstance(database.Instance{ProviderName: "fake", State: "creating", CreatedAt: time.Now().UTC().Add(-24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	err = core.RemediateStuckInstances(context.TODO(), map[InstanceState]time.Duration{InstanceStateCreating: 0})
+	if err != nil {
+		t.Fatalf("RemediateStuckInstances returned error: %v", err)
+	}
+
+	instance, err := db.GetInstance(id)
+	if err != nil {
+		t.Fatalf("GetInstance returned error: %v", err)
+	}
+	if instance.State != string(InstanceStateCreating) {
+		t.Errorf("expected a zero timeout to disable the check, got %s", instance.State)
+	}
+	if jobs := relayedJobs(t, db); len(jobs) != 0 {
+		t.Errorf("expected no remove jobs, got %+v", jobs)
+	}
+}
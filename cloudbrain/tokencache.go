@@ -0,0 +1,235 @@
+package cloudbrain
+
+import (
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/database"
+	"github.com/travis-ci/cloud-brain/metrics"
+)
+
+const (
+	// DefaultTokenCacheSize is the number of verified tokens the Core caches
+	// by default.
+	DefaultTokenCacheSize = 1000
+
+	// DefaultTokenCacheTTL is how long the Core caches a verified token by
+	// default.
+	DefaultTokenCacheTTL = 10 * time.Second
+)
+
+// tokenCacheKey identifies a token and the secret it was verified with. Only
+// a hash of the secret is kept, so the cache doesn't hold any secrets.
+type tokenCacheKey struct {
+	tokenID    uint64
+	secretHash [sha256.Size]byte
+}
+
+func newTokenCacheKey(tokenID uint64, secret string) tokenCacheKey {
+	return tokenCacheKey{
+		tokenID:    tokenID,
+		secretHash: sha256.Sum256([]byte(secret)),
+	}
+}
+
+type tokenCacheEntry struct {
+	token     database.Token
+	expiresAt time.Time
+}
+
+// tokenCache holds the tokens CheckToken has verified, so the secret of a
+// token isn't hashed with scrypt and the token isn't fetched from the database
+// on every request. Entries expire after the TTL, and at most size entries
+// are kept. A cache with a zero size or TTL doesn't cache anything.
+type tokenCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[tokenCacheKey]tokenCacheEntry
+}
+
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[tokenCacheKey]tokenCacheEntry),
+	}
+}
+
+func (tc *tokenCache) enabled() bool {
+	return tc.size > 0 && tc.ttl > 0
+}
+
+// get returns the cached token for the key, if it hasn't expired.
+func (tc *tokenCache) get(key tokenCacheKey) (database.Token, bool) {
+	if !tc.enabled() {
+		return database.Token{}, false
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	entry, ok := tc.entries[key]
+	if ok && !time.Now().Before(entry.expiresAt) {
+		delete(tc.entries, key)
+		ok = false
+	}
+
+	if ok {
+		metrics.TokenCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		metrics.TokenCacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	return entry.token, ok
+}
+
+// add caches the token for the key. If the cache is full, expired entries are
+// removed first, and then the entry that expires first.
+func (tc *tokenCache) add(key tokenCacheKey, token database.Token) {
+	if !tc.enabled() {
+		return
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	now := time.Now()
+	if _, ok := tc.entries[key]; !ok && len(tc.entries) >= tc.size {
+		var oldestKey tokenCacheKey
+		var oldest time.Time
+		for k, entry := range tc.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(tc.entries, k)
+				continue
+			}
+			if oldest.IsZero() || entry.expiresAt.Before(oldest) {
+				oldestKey, oldest = k, entry.expiresAt
+			}
+		}
+
+		if len(tc.entries) >= tc.size {
+			delete(tc.entries, oldestKey)
+		}
+	}
+
+	tc.entries[key] = tokenCacheEntry{
+		token:     token,
+		expiresAt: now.Add(tc.ttl),
+	}
+}
+
+// setLastUsed records when the cached token for the key was last used, without
+// changing when the entry expires.
+func (tc *tokenCache) setLastUsed(key tokenCacheKey, lastUsedAt time.Time) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if entry, ok := tc.entries[key]; ok {
+		entry.token.LastUsedAt = lastUsedAt
+		tc.entries[key] = entry
+	}
+}
+
+// invalidate removes the entries for the token with the given ID, whatever
+// secret they were verified with.
+func (tc *tokenCache) invalidate(tokenID uint64) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	for key := range tc.entries {
+		if key.tokenID == tokenID {
+			delete(tc.entries, key)
+		}
+	}
+}
+
+// clear removes all entries from the cache.
+func (tc *tokenCache) clear() {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.entries = make(map[tokenCacheKey]tokenCacheEntry)
+}
+
+// SetTokenCache changes how many verified tokens CheckToken caches and for how
+// long, emptying the cache. A zero size or TTL disables the cache. It must be
+// called before the Core is used.
+//
+// A token that's revoked or rotated with a Core is removed from its cache
+// immediately, and from the caches of the Cores that are running
+// ListenForTokenInvalidations if the Core has a Redis pool. Otherwise, or if
+// the invalidation is lost, a revoked token or the old secret of a rotated
+// token keeps working for up to the TTL.
+func (c *Core) SetTokenCache(size int, ttl time.Duration) {
+	c.tokenCache = newTokenCache(size, ttl)
+}
+
+func (c *Core) tokenInvalidationsChannel() string {
+	return c.redisWorkerPrefix + ":token-invalidations"
+}
+
+// invalidateToken removes the token with the given ID from the cache, and
+// publishes the ID so other processes remove it from their caches too.
+func (c *Core) invalidateToken(ctx context.Context, tokenID uint64) {
+	c.tokenCache.invalidate(tokenID)
+
+	if c.redisPool == nil {
+		return
+	}
+
+	conn := c.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", c.tokenInvalidationsChannel(), strconv.FormatUint(tokenID, 10))
+	if err != nil {
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"err":      err,
+			"token_id": tokenID,
+		}).Error("failed to publish token invalidation, it stays cached by other processes until it expires")
+	}
+}
+
+// ListenForTokenInvalidations removes the tokens that other processes revoke
+// or rotate from the cache as they're published in Redis. The cache is emptied
+// once subscribed, since invalidations published before then are lost. It
+// blocks until the subscription fails, which is always returned as an error.
+func (c *Core) ListenForTokenInvalidations(ctx context.Context) error {
+	conn := redis.PubSubConn{Conn: c.redisPool.Get()}
+	defer conn.Close()
+
+	err := conn.Subscribe(c.tokenInvalidationsChannel())
+	if err != nil {
+		return errors.Wrap(err, "error subscribing to token invalidations")
+	}
+
+	for {
+		switch msg := conn.Receive().(type) {
+		case redis.Subscription:
+			if msg.Kind == "subscribe" {
+				c.tokenCache.clear()
+			}
+		case redis.Message:
+			c.handleTokenInvalidation(ctx, msg.Data)
+		case error:
+			return errors.Wrap(msg, "error receiving token invalidations")
+		}
+	}
+}
+
+func (c *Core) handleTokenInvalidation(ctx context.Context, data []byte) {
+	tokenID, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		cbcontext.LoggerFromContext(ctx).WithField("data", string(data)).Error("ignoring invalid token invalidation")
+		return
+	}
+
+	c.tokenCache.invalidate(tokenID)
+}
@@ -0,0 +1,100 @@
+package cloudbrain
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+func TestCheckTokenCache(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := context.TODO()
+
+	tokenID, secret := insertTestToken(t, db, database.Token{Scopes: []string{ScopeInstancesRead}})
+	if _, err := core.CheckToken(ctx, tokenID, secret); err != nil {
+		t.Fatalf("expected the token to be valid, got %v", err)
+	}
+
+	// Revoking the token in the database directly, like another process
+	// would, isn't seen until the cache entry expires
+	if err := db.RevokeToken(tokenID); err != nil {
+		t.Fatalf("RevokeToken returned error: %v", err)
+	}
+	if _, err := core.CheckToken(ctx, tokenID, secret); err != nil {
+		t.Errorf("expected the cached token to be valid, got %v", err)
+	}
+	if _, err := core.CheckToken(ctx, tokenID, "00"+secret[2:]); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for a wrong secret, got %v", err)
+	}
+
+	core.tokenCache.mutex.Lock()
+	for key, entry := range core.tokenCache.entries {
+		entry.expiresAt = time.Now().Add(-time.Second)
+		core.tokenCache.entries[key] = entry
+	}
+	core.tokenCache.mutex.Unlock()
+
+	if _, err := core.CheckToken(ctx, tokenID, secret); err != ErrTokenRevoked {
+		t.Errorf("expected ErrTokenRevoked after the cache entry expired, got %v", err)
+	}
+
+	// Revoking the token with the Core removes it from the cache right away
+	tokenID, secret = insertTestToken(t, db, database.Token{Scopes: []string{ScopeInstancesRead}})
+	if _, err := core.CheckToken(ctx, tokenID, secret); err != nil {
+		t.Fatalf("expected the token to be valid, got %v", err)
+	}
+	if err := core.RevokeToken(ctx, tokenID); err != nil {
+		t.Fatalf("RevokeToken returned error: %v", err)
+	}
+	if _, err := core.CheckToken(ctx, tokenID, secret); err != ErrTokenRevoked {
+		t.Errorf("expected ErrTokenRevoked for a token revoked with the Core, got %v", err)
+	}
+}
+
+func TestHandleTokenInvalidation(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := context.TODO()
+
+	tokenID, secret := insertTestToken(t, db, database.Token{Scopes: []string{ScopeInstancesRead}})
+	if _, err := core.CheckToken(ctx, tokenID, secret); err != nil {
+		t.Fatalf("expected the token to be valid, got %v", err)
+	}
+
+	core.handleTokenInvalidation(ctx, []byte("not a token ID"))
+	if _, ok := core.tokenCache.get(newTokenCacheKey(tokenID, secret)); !ok {
+		t.Error("expected an invalid message to be ignored")
+	}
+
+	core.handleTokenInvalidation(ctx, []byte(strconv.FormatUint(tokenID, 10)))
+	if _, ok := core.tokenCache.get(newTokenCacheKey(tokenID, secret)); ok {
+		t.Error("expected the invalidated token to be removed from the cache")
+	}
+}
+
+func TestTokenCacheSize(t *testing.T) {
+	cache := newTokenCache(2, time.Minute)
+
+	for i := uint64(1); i <= 3; i++ {
+		cache.add(newTokenCacheKey(i, "secret"), database.Token{ID: i})
+	}
+
+	if len(cache.entries) != 2 {
+		t.Errorf("expected the cache to hold 2 entries, got %d", len(cache.entries))
+	}
+	if _, ok := cache.get(newTokenCacheKey(3, "secret")); !ok {
+		t.Error("expected the last token added to be cached")
+	}
+	if _, ok := cache.get(newTokenCacheKey(3, "other secret")); ok {
+		t.Error("expected a different secret not to be cached")
+	}
+
+	cache.invalidate(3)
+	if _, ok := cache.get(newTokenCacheKey(3, "secret")); ok {
+		t.Error("expected the token to be removed from the cache")
+	}
+}
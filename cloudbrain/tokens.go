@@ -0,0 +1,453 @@
+package cloudbrain
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/database"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The scopes a token can have.
+const (
+	// ScopeInstancesRead allows getting and listing instances
+	ScopeInstancesRead = "instances:read"
+
+	// ScopeInstancesWrite allows creating and removing instances
+	ScopeInstancesWrite = "instances:write"
+
+	// ScopeInstancesAdmin allows getting, listing and removing the instances
+	// of every token and tenant, not just the token's own
+	ScopeInstancesAdmin = "instances:admin"
+
+	// ScopeProvidersAdmin allows using every provider, regardless of the
+	// providers the token is restricted to
+	ScopeProvidersAdmin = "providers:admin"
+
+	// ScopeTokensAdmin allows creating, listing, revoking and rotating tokens
+	ScopeTokensAdmin = "tokens:admin"
+)
+
+// Scopes are all the valid token scopes.
+var Scopes = []string{
+	ScopeInstancesRead,
+	ScopeInstancesWrite,
+	ScopeInstancesAdmin,
+	ScopeProvidersAdmin,
+	ScopeTokensAdmin,
+}
+
+// tokenLastUsedResolution is how often the last use of a token is written to
+// the database, so that not every request causes a write.
+const tokenLastUsedResolution = time.Minute
+
+var (
+	// ErrInvalidToken is returned by CheckToken if the token doesn't exist or
+	// the secret doesn't match.
+	ErrInvalidToken = fmt.Errorf("invalid token")
+
+	// ErrTokenRevoked is returned by CheckToken if the token has been revoked.
+	ErrTokenRevoked = fmt.Errorf("token has been revoked")
+
+	// ErrTokenExpired is returned by CheckToken if the token has expired.
+	ErrTokenExpired = fmt.Errorf("token has expired")
+
+	// ErrProviderNotAllowed is returned if the token in the context can't be
+	// used with the requested provider.
+	ErrProviderNotAllowed = fmt.Errorf("token isn't allowed to use this provider")
+
+	// ErrNotInstanceOwner is returned if the instance doesn't belong to the
+	// token in the context or its tenant.
+	ErrNotInstanceOwner = fmt.Errorf("instance belongs to another token")
+
+	// ErrTokenNotFound is returned by the token management methods if there's
+	// no token with the given ID.
+	ErrTokenNotFound = fmt.Errorf("token not found")
+
+	// ErrInvalidScope is returned by CreateToken if one of the scopes isn't
+	// one of Scopes.
+	ErrInvalidScope = fmt.Errorf("invalid scope, must be one of %s", strings.Join(Scopes, ", "))
+)
+
+// A Token is an API token. The secret part of the token isn't included.
+type Token struct {
+	ID          uint64
+	Description string
+	Scopes      []string
+
+	// Providers are the names of the providers the token can be used with. If
+	// empty, the token can be used with all providers.
+	Providers []string
+
+	// Tenant is the tenant the token belongs to. Tokens with the same tenant
+	// share their instances. If empty, the token only has access to the
+	// instances it created.
+	Tenant string
+
+	// Quota limits the instances the token can create. If the token has a
+	// tenant, the instances of the whole tenant count against it.
+	Quota Quota
+
+	ExpiresAt  time.Time
+	Revoked    bool
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
+
+// HasScope returns true if the token has the given scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsProvider returns true if the token can be used with the provider with
+// the given name.
+func (t *Token) AllowsProvider(providerName string) bool {
+	providers := t.restrictedProviders()
+	if len(providers) == 0 {
+		return true
+	}
+
+	for _, name := range providers {
+		if name == providerName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// owns returns true if the instance was created by the token or another token
+// with the same tenant, or if the token has the instances:admin scope.
+func (t *Token) owns(instance database.Instance) bool {
+	if t.HasScope(ScopeInstancesAdmin) {
+		return true
+	}
+
+	if t.Tenant != "" {
+		return instance.Tenant == t.Tenant
+	}
+
+	return instance.OwnerTokenID == t.ID
+}
+
+// restrictedProviders returns the providers the token is restricted to, or nil
+// if it can be used with all providers.
+func (t *Token) restrictedProviders() []string {
+	if t.HasScope(ScopeProvidersAdmin) {
+		return nil
+	}
+
+	return t.Providers
+}
+
+// ValidScope returns true if the given scope is one of Scopes.
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type contextKey int
+
+const tokenKey contextKey = iota
+
+// FromToken generates a new context with the given context as its parent, and
+// stores the token the request was authenticated with in it. The token can be
+// retrieved again using TokenFromContext, and its ID using
+// cbcontext.TokenIDFromContext.
+func FromToken(ctx context.Context, token *Token) context.Context {
+	ctx = cbcontext.FromTokenID(ctx, token.ID)
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// TokenFromContext returns the token stored in the context with FromToken. If
+// no token is stored in the context, the second argument is false. Otherwise
+// it is true.
+func TokenFromContext(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(tokenKey).(*Token)
+	return token, ok
+}
+
+// allowsProvider returns true if the context has no token, as for background
+// jobs, or if the token in it can be used with the given provider.
+func allowsProvider(ctx context.Context, providerName string) bool {
+	token, ok := TokenFromContext(ctx)
+	return !ok || token.AllowsProvider(providerName)
+}
+
+// ownsInstance returns true if the context has no token, or if the token in it
+// owns the instance. Instances with no owner are owned by every token while
+// unowned instance access is allowed.
+func (c *Core) ownsInstance(ctx context.Context, instance database.Instance) bool {
+	if c.unownedInstanceAccess && instance.OwnerTokenID == 0 && instance.Tenant == "" {
+		return true
+	}
+
+	token, ok := TokenFromContext(ctx)
+	return !ok || token.owns(instance)
+}
+
+// SetUnownedInstanceAccess changes whether tokens can access the instances
+// that have no owner, because they were created before owners were recorded.
+// Allowing it keeps those instances usable by the workers that created them,
+// until they're gone. It must be called before the Core is used.
+func (c *Core) SetUnownedInstanceAccess(allowed bool) {
+	c.unownedInstanceAccess = allowed
+}
+
+// CheckToken is used to check whether a given tokenID+token is in the
+// database, and can be used. Returns the token iff it's valid,
+// ErrInvalidToken, ErrTokenRevoked or ErrTokenExpired if it can't be used,
+// and another error if an error occurred while fetching the token. Tokens
+// that have been verified are cached, see SetTokenCache.
+func (c *Core) CheckToken(ctx context.Context, tokenID uint64, secret string) (*Token, error) {
+	key := newTokenCacheKey(tokenID, secret)
+	dbToken, ok := c.tokenCache.get(key)
+	if !ok {
+		var err error
+		dbToken, err = c.verifyToken(ctx, tokenID, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		c.tokenCache.add(key, dbToken)
+	}
+
+	if dbToken.Revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	now := time.Now().UTC()
+	if !dbToken.ExpiresAt.IsZero() && !now.Before(dbToken.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	if now.Sub(dbToken.LastUsedAt) >= tokenLastUsedResolution {
+		err := c.tracedDB(ctx).UpdateTokenLastUsed(tokenID, now)
+		if err != nil {
+			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"err":      err,
+				"token_id": tokenID,
+			}).Error("failed to record token use")
+		} else {
+			dbToken.LastUsedAt = now
+			c.tokenCache.setLastUsed(key, now)
+		}
+	}
+
+	return tokenFromDB(dbToken), nil
+}
+
+// verifyToken fetches the token with the given ID from the database, and checks
+// that the secret matches its hash. Returns ErrInvalidToken if there's no such
+// token or the secret doesn't match.
+func (c *Core) verifyToken(ctx context.Context, tokenID uint64, secret string) (database.Token, error) {
+	dbToken, err := c.tracedDB(ctx).GetToken(tokenID)
+	if err == database.ErrTokenNotFound {
+		return database.Token{}, ErrInvalidToken
+	}
+	if err != nil {
+		return database.Token{}, errors.Wrap(err, "error fetching token")
+	}
+
+	decodedSecret, err := hex.DecodeString(secret)
+	if err != nil {
+		return database.Token{}, ErrInvalidToken
+	}
+
+	generatedHash, err := scrypt.Key(decodedSecret, dbToken.Salt, 16384, 8, 1, 32)
+	if err != nil {
+		return database.Token{}, errors.Wrap(err, "error hashing token")
+	}
+
+	if subtle.ConstantTimeCompare(generatedHash, dbToken.Hash) != 1 {
+		return database.Token{}, ErrInvalidToken
+	}
+
+	return dbToken, nil
+}
+
+// CreateTokenAttributes contains the attributes of a token to create. A zero
+// ExpiresAt means the token doesn't expire.
+type CreateTokenAttributes struct {
+	Description string
+	Scopes      []string
+	Providers   []string
+	Tenant      string
+	Quota       Quota
+	ExpiresAt   time.Time
+}
+
+// CreateToken generates a token and stores its salt and hash in the database.
+// Returns the token and its value on the id-secret form, which is the only
+// time the secret is available.
+func (c *Core) CreateToken(ctx context.Context, attr CreateTokenAttributes) (*Token, string, error) {
+	for _, scope := range attr.Scopes {
+		if !ValidScope(scope) {
+			return nil, "", ErrInvalidScope
+		}
+	}
+
+	if !attr.Quota.valid() {
+		return nil, "", ErrInvalidQuota
+	}
+
+	secret, salt, hash, err := generateTokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := c.tracedDB(ctx).InsertToken(database.Token{
+		Description: attr.Description,
+		Salt:        salt,
+		Hash:        hash,
+		Scopes:      attr.Scopes,
+		Providers:   attr.Providers,
+		Tenant:      attr.Tenant,
+		Quota:       database.Quota(attr.Quota),
+		ExpiresAt:   attr.ExpiresAt,
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error inserting token into database")
+	}
+
+	dbToken, err := c.tracedDB(ctx).GetToken(id)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error fetching created token")
+	}
+
+	cbcontext.LoggerFromContext(ctx).WithField("created_token_id", id).Info("created token")
+
+	return tokenFromDB(dbToken), formatToken(id, secret), nil
+}
+
+// ListTokens returns all the tokens, ordered by ID.
+func (c *Core) ListTokens(ctx context.Context) ([]*Token, error) {
+	dbTokens, err := c.tracedDB(ctx).ListTokens()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing tokens in database")
+	}
+
+	tokens := make([]*Token, 0, len(dbTokens))
+	for _, dbToken := range dbTokens {
+		tokens = append(tokens, tokenFromDB(dbToken))
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken revokes the token with the given ID, so it can't be used
+// anymore. Returns ErrTokenNotFound if there's no such token.
+func (c *Core) RevokeToken(ctx context.Context, tokenID uint64) error {
+	err := c.tracedDB(ctx).RevokeToken(tokenID)
+	if err == database.ErrTokenNotFound {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "error revoking token in database")
+	}
+
+	c.invalidateToken(ctx, tokenID)
+
+	cbcontext.LoggerFromContext(ctx).WithField("revoked_token_id", tokenID).Info("revoked token")
+
+	return nil
+}
+
+// RotateToken generates a new secret for the token with the given ID, keeping
+// its scopes, providers and expiry. The old secret stops working immediately.
+// Returns the new value of the token on the id-secret form, ErrTokenNotFound
+// if there's no such token or ErrTokenRevoked if it's been revoked.
+func (c *Core) RotateToken(ctx context.Context, tokenID uint64) (string, error) {
+	dbToken, err := c.tracedDB(ctx).GetToken(tokenID)
+	if err == database.ErrTokenNotFound {
+		return "", ErrTokenNotFound
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error fetching token")
+	}
+
+	if dbToken.Revoked {
+		return "", ErrTokenRevoked
+	}
+
+	secret, salt, hash, err := generateTokenSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = c.tracedDB(ctx).UpdateTokenSecret(tokenID, salt, hash)
+	if err == database.ErrTokenNotFound {
+		return "", ErrTokenNotFound
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error updating token in database")
+	}
+
+	c.invalidateToken(ctx, tokenID)
+
+	cbcontext.LoggerFromContext(ctx).WithField("rotated_token_id", tokenID).Info("rotated token")
+
+	return formatToken(tokenID, secret), nil
+}
+
+// generateTokenSecret generates a random secret and salt, and returns them
+// together with the hash of the secret.
+func generateTokenSecret() (secret, salt, hash []byte, err error) {
+	salt = make([]byte, 32)
+	secret = make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "couldn't generate a random salt")
+	}
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "couldn't generate a random token")
+	}
+
+	hash, err = scrypt.Key(secret, salt, 16384, 8, 1, 32)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "couldn't hash token")
+	}
+
+	return secret, salt, hash, nil
+}
+
+// formatToken returns the value of a token on the id-secret form, as passed
+// in the Authorization header.
+func formatToken(id uint64, secret []byte) string {
+	return fmt.Sprintf("%d-%s", id, hex.EncodeToString(secret))
+}
+
+func tokenFromDB(token database.Token) *Token {
+	return &Token{
+		ID:          token.ID,
+		Description: token.Description,
+		Scopes:      token.Scopes,
+		Providers:   token.Providers,
+		Tenant:      token.Tenant,
+		Quota:       Quota(token.Quota),
+		ExpiresAt:   token.ExpiresAt,
+		Revoked:     token.Revoked,
+		LastUsedAt:  token.LastUsedAt,
+		CreatedAt:   token.CreatedAt,
+	}
+}
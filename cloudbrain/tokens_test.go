@@ -0,0 +1,240 @@
+package cloudbrain
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/database"
+	"golang.org/x/crypto/scrypt"
+)
+
+func insertTestToken(t *testing.T, db database.DB, token database.Token) (uint64, string) {
+	secret := []byte("0123456789abcdef")
+	token.Salt = []byte("salt")
+
+	var err error
+	token.Hash, err = scrypt.Key(secret, token.Salt, 16384, 8, 1, 32)
+	if err != nil {
+		t.Fatalf("scrypt.Key returned error: %v", err)
+	}
+
+	id, err := db.InsertToken(token)
+	if err != nil {
+		t.Fatalf("InsertToken returned error: %v", err)
+	}
+
+	return id, hex.EncodeToString(secret)
+}
+
+func TestCheckToken(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := context.TODO()
+
+	validID, secret := insertTestToken(t, db, database.Token{Scopes: []string{ScopeInstancesRead}})
+	revokedID, _ := insertTestToken(t, db, database.Token{Revoked: true})
+	expiredID, _ := insertTestToken(t, db, database.Token{ExpiresAt: time.Now().Add(-time.Minute)})
+
+	token, err := core.CheckToken(ctx, validID, secret)
+	if err != nil {
+		t.Fatalf("expected the token to be valid, got %v", err)
+	}
+	if !token.HasScope(ScopeInstancesRead) || token.HasScope(ScopeInstancesWrite) {
+		t.Errorf("expected the token to only have the %s scope, got %v", ScopeInstancesRead, token.Scopes)
+	}
+	if token.LastUsedAt.IsZero() {
+		t.Error("expected the token use to be recorded")
+	}
+
+	if _, err := core.CheckToken(ctx, validID, "00"+secret[2:]); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for a wrong secret, got %v", err)
+	}
+	if _, err := core.CheckToken(ctx, 1000, secret); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for an unknown token, got %v", err)
+	}
+	if _, err := core.CheckToken(ctx, revokedID, secret); err != ErrTokenRevoked {
+		t.Errorf("expected ErrTokenRevoked, got %v", err)
+	}
+	if _, err := core.CheckToken(ctx, expiredID, secret); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestTokenProviderRestriction(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+
+	for _, providerName := range []string{"gce-org", "gce-com"} {
+		_, err := db.CreateInstance(database.Instance{ProviderName: providerName, State: string(InstanceStateRunning), Tenant: "org"})
+		if err != nil {
+			t.Fatalf("CreateInstance returned error: %v", err)
+		}
+	}
+
+	ctx := FromToken(context.TODO(), &Token{ID: 1, Tenant: "org", Providers: []string{"gce-org"}})
+
+	instances, err := core.ListInstances(ctx, ListInstancesAttributes{})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ProviderName != "gce-org" {
+		t.Errorf("expected only the gce-org instance, got %+v", instances)
+	}
+
+	_, err = core.CreateInstance(ctx, "gce-com", CreateInstanceAttributes{ImageName: "image"})
+	if err != ErrProviderNotAllowed {
+		t.Errorf("expected ErrProviderNotAllowed, got %v", err)
+	}
+
+	admin := FromToken(context.TODO(), &Token{ID: 2, Tenant: "org", Scopes: []string{ScopeProvidersAdmin}, Providers: []string{"gce-org"}})
+	instances, err = core.ListInstances(admin, ListInstancesAttributes{})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Errorf("expected the %s scope to allow all providers, got %+v", ScopeProvidersAdmin, instances)
+	}
+}
+
+func TestRotateAndRevokeToken(t *testing.T) {
+	core := NewCore(database.NewMemoryDatabase(), nil, "")
+	ctx := context.TODO()
+
+	token, value, err := core.CreateToken(ctx, CreateTokenAttributes{Scopes: []string{ScopeInstancesRead}})
+	if err != nil {
+		t.Fatalf("CreateToken returned error: %v", err)
+	}
+
+	rotated, err := core.RotateToken(ctx, token.ID)
+	if err != nil {
+		t.Fatalf("RotateToken returned error: %v", err)
+	}
+
+	secret := value[strings.Index(value, "-")+1:]
+	if _, err := core.CheckToken(ctx, token.ID, secret); err != ErrInvalidToken {
+		t.Errorf("expected the old secret to be invalid after rotating, got %v", err)
+	}
+
+	rotatedSecret := rotated[strings.Index(rotated, "-")+1:]
+	if _, err := core.CheckToken(ctx, token.ID, rotatedSecret); err != nil {
+		t.Errorf("expected the new secret to be valid, got %v", err)
+	}
+
+	if err := core.RevokeToken(ctx, token.ID); err != nil {
+		t.Fatalf("RevokeToken returned error: %v", err)
+	}
+	if _, err := core.CheckToken(ctx, token.ID, rotatedSecret); err != ErrTokenRevoked {
+		t.Errorf("expected ErrTokenRevoked after revoking, got %v", err)
+	}
+	if _, err := core.RotateToken(ctx, token.ID); err != ErrTokenRevoked {
+		t.Errorf("expected a revoked token not to be rotated, got %v", err)
+	}
+
+	if _, _, err := core.CreateToken(ctx, CreateTokenAttributes{Scopes: []string{"instances:everything"}}); err != ErrInvalidScope {
+		t.Errorf("expected ErrInvalidScope, got %v", err)
+	}
+}
+
+func TestInstanceOwnership(t *testing.T) {
+	core := NewCore(database.NewMemoryDatabase(), nil, "")
+
+	owner := FromToken(context.TODO(), &Token{ID: 1})
+	sameTenant := []context.Context{
+		FromToken(context.TODO(), &Token{ID: 2, Tenant: "org"}),
+		FromToken(context.TODO(), &Token{ID: 3, Tenant: "org"}),
+	}
+	other := FromToken(context.TODO(), &Token{ID: 4, Tenant: "com"})
+	admin := FromToken(context.TODO(), &Token{ID: 5, Scopes: []string{ScopeInstancesAdmin}})
+
+	owned, err := core.CreateInstance(owner, "gce", CreateInstanceAttributes{ImageName: "image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	shared, err := core.CreateInstance(sameTenant[0], "gce", CreateInstanceAttributes{ImageName: "image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		ctx      context.Context
+		id       string
+		expected bool
+	}{
+		{owner, owned.ID, true},
+		{owner, shared.ID, false},
+		{sameTenant[1], shared.ID, true},
+		{sameTenant[1], owned.ID, false},
+		{other, shared.ID, false},
+		{admin, owned.ID, true},
+		{admin, shared.ID, true},
+	} {
+		instance, err := core.GetInstance(tc.ctx, tc.id)
+		if err != nil {
+			t.Fatalf("GetInstance returned error: %v", err)
+		}
+		if (instance != nil) != tc.expected {
+			token, _ := TokenFromContext(tc.ctx)
+			t.Errorf("expected token %d to see instance %s: %v", token.ID, tc.id, tc.expected)
+		}
+	}
+
+	if err := core.RemoveInstance(other, DeleteInstanceAttributes{InstanceID: shared.ID}); err != ErrNotInstanceOwner {
+		t.Errorf("expected ErrNotInstanceOwner, got %v", err)
+	}
+
+	instances, err := core.ListInstances(sameTenant[1], ListInstancesAttributes{})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ID != shared.ID {
+		t.Errorf("expected only the tenant's instance, got %+v", instances)
+	}
+
+	instances, err = core.ListInstances(admin, ListInstancesAttributes{})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Errorf("expected the %s scope to list all instances, got %+v", ScopeInstancesAdmin, instances)
+	}
+}
+
+func TestUnownedInstanceAccess(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := NewCore(db, nil, "")
+	ctx := FromToken(context.TODO(), &Token{ID: 1, Tenant: "org"})
+
+	// Instances created before owners were recorded have neither an owner
+	// token nor a tenant
+	id, err := db.CreateInstance(database.Instance{ProviderName: "gce", Image: "image", State: "running"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	for _, allowed := range []bool{false, true} {
+		core.SetUnownedInstanceAccess(allowed)
+
+		instance, err := core.GetInstance(ctx, id)
+		if err != nil {
+			t.Fatalf("GetInstance returned error: %v", err)
+		}
+		if (instance != nil) != allowed {
+			t.Errorf("expected the unowned instance to be visible: %v, got %+v", allowed, instance)
+		}
+
+		instances, err := core.ListInstances(ctx, ListInstancesAttributes{})
+		if err != nil {
+			t.Fatalf("ListInstances returned error: %v", err)
+		}
+		if (len(instances) == 1) != allowed {
+			t.Errorf("expected the unowned instance to be listed: %v, got %+v", allowed, instances)
+		}
+	}
+
+	if err := core.RemoveInstance(ctx, DeleteInstanceAttributes{InstanceID: id}); err != nil {
+		t.Errorf("expected the unowned instance to be removable, got %v", err)
+	}
+}
@@ -1,4 +0,0 @@
-#/bin/sh
-sleep 8
-bin/cloudbrain-create-token
-
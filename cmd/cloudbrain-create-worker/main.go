@@ -17,6 +17,8 @@ import (
 	"github.com/travis-ci/cloud-brain/cbcontext"
 	"github.com/travis-ci/cloud-brain/cloudbrain"
 	"github.com/travis-ci/cloud-brain/database"
+	cbhttp "github.com/travis-ci/cloud-brain/http"
+	"github.com/travis-ci/cloud-brain/tracing"
 	"gopkg.in/urfave/cli.v2"
 )
 
@@ -65,6 +67,16 @@ func main() {
 				Usage:   "The database encryption key, hex-encoded",
 				EnvVars: []string{"CLOUDBRAIN_DATABASE_ENCRYPTION_KEY"},
 			},
+			&cli.StringFlag{
+				Name:    "metrics-addr",
+				Usage:   "The address to serve Prometheus metrics and the health checks on, e.g. \":9090\". Nothing is served if empty",
+				EnvVars: []string{"CLOUDBRAIN_METRICS_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "otlp-endpoint",
+				Usage:   "The OTLP/HTTP endpoint of the OpenTelemetry collector to send traces to, e.g. \"http://localhost:4318\". Traces aren't recorded if empty",
+				EnvVars: []string{"CLOUDBRAIN_OTLP_ENDPOINT"},
+			},
 		},
 	}
 
@@ -116,10 +128,18 @@ func mainAction(c *cli.Context) error {
 	redisWorkerPrefix := c.String("redis-worker-prefix")
 	core := cloudbrain.NewCore(db, redisPool, redisWorkerPrefix)
 
+	var traceExporter *tracing.OTLPExporter
+	if c.String("otlp-endpoint") != "" {
+		traceExporter = tracing.NewOTLPExporter(ctx, c.String("otlp-endpoint"), c.App.Name)
+		tracing.SetExporter(traceExporter)
+	}
+
+	cbhttp.ListenAndServeStatus(ctx, c.String("metrics-addr"), core, nil)
+
 	log.Print("starting worker pool")
 
 	workerPool := work.NewWorkerPool(struct{}{}, 1, redisWorkerPrefix, redisPool)
-	workerPool.JobWithOptions("create", work.JobOptions{MaxFails: 10}, core.ProviderCreateInstance)
+	workerPool.JobWithOptions("create", work.JobOptions{MaxFails: cloudbrain.MaxCreateRetries}, cloudbrain.InstrumentJob("create", core.ProviderCreateInstance))
 	workerPool.Start()
 
 	signalChan := make(chan os.Signal, 1)
@@ -130,5 +150,9 @@ func mainAction(c *cli.Context) error {
 
 	workerPool.Stop()
 
+	if traceExporter != nil {
+		traceExporter.Flush()
+	}
+
 	return nil
 }
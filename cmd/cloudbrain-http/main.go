@@ -15,6 +15,7 @@ import (
 	"github.com/travis-ci/cloud-brain/cloudbrain"
 	"github.com/travis-ci/cloud-brain/database"
 	cbhttp "github.com/travis-ci/cloud-brain/http"
+	"github.com/travis-ci/cloud-brain/tracing"
 	"gopkg.in/urfave/cli.v2"
 )
 
@@ -58,6 +59,11 @@ func main() {
 				Usage:   "The URL for the PostgreSQL database to use",
 				EnvVars: []string{"CLOUDBRAIN_DATABASE_URL", "DATABASE_URL"},
 			},
+			&cli.StringFlag{
+				Name:    "otlp-endpoint",
+				Usage:   "The OTLP/HTTP endpoint of the OpenTelemetry collector to send traces to, e.g. \"http://localhost:4318\". Traces aren't recorded if empty",
+				EnvVars: []string{"CLOUDBRAIN_OTLP_ENDPOINT"},
+			},
 			&cli.StringFlag{
 				Name:  "addr",
 				Usage: "host:port to listen to",
@@ -70,6 +76,29 @@ func main() {
 				}(),
 				EnvVars: []string{"CLOUDBRAIN_ADDR"},
 			},
+			&cli.StringFlag{
+				Name:    "metrics-addr",
+				Usage:   "The address to serve Prometheus metrics on, e.g. \":9090\". Keep it private, since the metrics aren't authenticated. Nothing is served if empty",
+				EnvVars: []string{"CLOUDBRAIN_METRICS_ADDR"},
+			},
+			&cli.IntFlag{
+				Name:    "token-cache-size",
+				Usage:   "How many verified tokens to cache, so they aren't verified with scrypt on every request",
+				Value:   cloudbrain.DefaultTokenCacheSize,
+				EnvVars: []string{"CLOUDBRAIN_TOKEN_CACHE_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    "token-cache-ttl",
+				Usage:   "How long to cache verified tokens, 0 to disable the cache. Tokens revoked or rotated without publishing the invalidation in Redis keep working for up to this long",
+				Value:   cloudbrain.DefaultTokenCacheTTL,
+				EnvVars: []string{"CLOUDBRAIN_TOKEN_CACHE_TTL"},
+			},
+			&cli.BoolFlag{
+				Name:    "unowned-instance-access",
+				Usage:   "Let every token access the instances created before owners were recorded. Disable once those instances are gone",
+				Value:   true,
+				EnvVars: []string{"CLOUDBRAIN_UNOWNED_INSTANCE_ACCESS"},
+			},
 			&cli.StringSliceFlag{
 				Name:    "auth-token",
 				Usage:   "authentication token(s) to accept",
@@ -117,6 +146,22 @@ func mainAction(c *cli.Context) error {
 
 	redisWorkerPrefix := c.String("redis-worker-prefix")
 	core := cloudbrain.NewCore(db, redisPool, redisWorkerPrefix)
+	core.SetTokenCache(c.Int("token-cache-size"), c.Duration("token-cache-ttl"))
+	core.SetUnownedInstanceAccess(c.Bool("unowned-instance-access"))
+
+	if c.String("otlp-endpoint") != "" {
+		tracing.SetExporter(tracing.NewOTLPExporter(ctx, c.String("otlp-endpoint"), c.App.Name))
+	}
+
+	cbhttp.ListenAndServeStatus(ctx, c.String("metrics-addr"), nil, nil)
+
+	go func() {
+		for {
+			err := core.ListenForTokenInvalidations(ctx)
+			cbcontext.LoggerFromContext(ctx).WithField("err", err).Error("stopped listening for token invalidations, emptying the token cache when resubscribed")
+			time.Sleep(time.Second)
+		}
+	}()
 
 	err = http.ListenAndServe(c.String("addr"), cbhttp.Handler(ctx, core, c.StringSlice("auth-token")))
 	if err != nil {
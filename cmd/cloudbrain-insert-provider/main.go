@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	_ "github.com/lib/pq"
 	"github.com/travis-ci/cloud-brain/cloud"
@@ -14,14 +16,120 @@ import (
 	"gopkg.in/urfave/cli.v2"
 )
 
+// gceFlags are the flags of the gce subcommand. They're also accepted without
+// a subcommand, which inserts a GCE provider like before other provider types
+// were supported.
+var gceFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "gce-account-json",
+		Usage:   "A path pointing to the GCE account JSON file",
+		EnvVars: []string{"CLOUDBRAIN_GCE_ACCOUNT_JSON"},
+	},
+	&cli.StringFlag{
+		Name:    "gce-project-id",
+		Usage:   "The GCE project ID for the project to boot instances in",
+		EnvVars: []string{"CLOUDBRAIN_GCE_PROJECT_ID"},
+	},
+	&cli.StringFlag{
+		Name:    "gce-image-project-id",
+		Usage:   "The GCE project ID for the project containing the build environment images",
+		EnvVars: []string{"CLOUDBRAIN_GCE_IMAGE_PROJECT_ID"},
+	},
+	&cli.StringFlag{
+		Name:    "gce-zone",
+		Usage:   "The GCE zone to boot instances in",
+		Value:   "us-central1-a",
+		EnvVars: []string{"CLOUDBRAIN_GCE_ZONE"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "gce-zones",
+		Usage:   "The GCE zones to boot instances in, as name:weight, overrides gce-zone",
+		EnvVars: []string{"CLOUDBRAIN_GCE_ZONES"},
+	},
+	&cli.StringFlag{
+		Name:    "gce-standard-machine-type",
+		Usage:   "The machine type to use for 'standard' instances",
+		Value:   "n1-standard-2",
+		EnvVars: []string{"CLOUDBRAIN_GCE_STANDARD_MACHINE_TYPE"},
+	},
+	&cli.StringFlag{
+		Name:    "gce-premium-machine-type",
+		Usage:   "The machine type to use for 'premium' instances",
+		Value:   "n1-standard-4",
+		EnvVars: []string{"CLOUDBRAIN_GCE_PREMIUM_MACHINE_TYPE"},
+	},
+	&cli.StringFlag{
+		Name:    "gce-network",
+		Usage:   "The GCE network to connect instances to",
+		Value:   "default",
+		EnvVars: []string{"CLOUDBRAIN_GCE_NETWORK"},
+	},
+	&cli.IntFlag{
+		Name:    "gce-disk-size",
+		Usage:   "The GCE disk size in GiB",
+		Value:   30,
+		EnvVars: []string{"CLOUDBRAIN_GCE_DISK_SIZE"},
+	},
+	&cli.BoolFlag{
+		Name:    "gce-auto-implode",
+		Usage:   "Enable to make the instance power off after gce-auto-implode-time if it's still running",
+		EnvVars: []string{"CLOUDBRAIN_GCE_AUTO_IMPLODE"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-auto-implode-time",
+		Usage:   "How long to wait before auto-imploding. Will be rounded down to the nearest minute.",
+		EnvVars: []string{"CLOUDBRAIN_GCE_AUTO_IMPLODE_TIME"},
+	},
+	&cli.BoolFlag{
+		Name:    "gce-preemptible",
+		Usage:   "Enable to use GCE preemptible instances",
+		EnvVars: []string{"CLOUDBRAIN_GCE_PREEMPTIBLE"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-boot-pre-poll-sleep",
+		Usage:   "How long to wait before polling the insert operation for the first time",
+		EnvVars: []string{"CLOUDBRAIN_GCE_BOOT_PRE_POLL_SLEEP"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-boot-poll-sleep",
+		Usage:   "How long to wait between polling the insert operation",
+		EnvVars: []string{"CLOUDBRAIN_GCE_BOOT_POLL_SLEEP"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-boot-timeout",
+		Usage:   "How long to wait for the insert operation to finish",
+		EnvVars: []string{"CLOUDBRAIN_GCE_BOOT_TIMEOUT"},
+	},
+	&cli.BoolFlag{
+		Name:    "gce-skip-stop-poll",
+		Usage:   "Enable to not wait for the delete operation to finish",
+		EnvVars: []string{"CLOUDBRAIN_GCE_SKIP_STOP_POLL"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-stop-pre-poll-sleep",
+		Usage:   "How long to wait before polling the delete operation for the first time",
+		EnvVars: []string{"CLOUDBRAIN_GCE_STOP_PRE_POLL_SLEEP"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-stop-poll-sleep",
+		Usage:   "How long to wait between polling the delete operation",
+		EnvVars: []string{"CLOUDBRAIN_GCE_STOP_POLL_SLEEP"},
+	},
+	&cli.DurationFlag{
+		Name:    "gce-stop-timeout",
+		Usage:   "How long to wait for the delete operation to finish",
+		EnvVars: []string{"CLOUDBRAIN_GCE_STOP_TIMEOUT"},
+	},
+}
+
 func main() {
 	app := &cli.App{
 		Name:      "cloudbrain-insert-provider",
 		Version:   cloudbrain.VersionString,
 		Copyright: cloudbrain.CopyrightString,
 		Usage:     "Insert configuration for a provider into the database",
-		Action:    mainAction,
-		Flags: []cli.Flag{
+		Action:    gceAction,
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:    "database-url",
 				Usage:   "The URL for the PostgreSQL database to use",
@@ -37,65 +145,298 @@ func main() {
 				Usage:   "The name to assign to the provider being added",
 				EnvVars: []string{"CLOUDBRAIN_PROVIDER_NAME"},
 			},
-			&cli.StringFlag{
-				Name:    "gce-account-json",
-				Usage:   "A path pointing to the GCE account JSON file",
-				EnvVars: []string{"CLOUDBRAIN_GCE_ACCOUNT_JSON"},
-			},
-			&cli.StringFlag{
-				Name:    "gce-project-id",
-				Usage:   "The GCE project ID for the project to boot instances in",
-				EnvVars: []string{"CLOUDBRAIN_GCE_PROJECT_ID"},
-			},
-			&cli.StringFlag{
-				Name:    "gce-image-project-id",
-				Usage:   "The GCE project ID for the project containing the build environment images",
-				EnvVars: []string{"CLOUDBRAIN_GCE_IMAGE_PROJECT_ID"},
+			&cli.DurationFlag{
+				Name:    "max-lifetime",
+				Usage:   "How long instances are allowed to live before they're removed, 0 for no limit",
+				EnvVars: []string{"CLOUDBRAIN_MAX_LIFETIME"},
 			},
-			&cli.StringFlag{
-				Name:    "gce-zone",
-				Usage:   "The GCE zone to boot instances in",
-				Value:   "us-central1-a",
-				EnvVars: []string{"CLOUDBRAIN_GCE_ZONE"},
+			&cli.IntFlag{
+				Name:    "max-instances",
+				Usage:   "How many instances that aren't terminated the provider can have at the same time, 0 for no limit",
+				EnvVars: []string{"CLOUDBRAIN_MAX_INSTANCES"},
 			},
-			&cli.StringFlag{
-				Name:    "gce-standard-machine-type",
-				Usage:   "The machine type to use for 'standard' instances",
-				Value:   "n1-standard-2",
-				EnvVars: []string{"CLOUDBRAIN_GCE_STANDARD_MACHINE_TYPE"},
+			&cli.IntFlag{
+				Name:    "max-premium-instances",
+				Usage:   "Like --max-instances, but only counting premium instances",
+				EnvVars: []string{"CLOUDBRAIN_MAX_PREMIUM_INSTANCES"},
 			},
-			&cli.StringFlag{
-				Name:    "gce-premium-machine-type",
-				Usage:   "The machine type to use for 'premium' instances",
-				Value:   "n1-standard-4",
-				EnvVars: []string{"CLOUDBRAIN_GCE_PREMIUM_MACHINE_TYPE"},
+			&cli.IntFlag{
+				Name:    "max-creates-per-minute",
+				Usage:   "How many instances can be created on the provider in a minute, 0 for no limit",
+				EnvVars: []string{"CLOUDBRAIN_MAX_CREATES_PER_MINUTE"},
 			},
-			&cli.StringFlag{
-				Name:    "gce-network",
-				Usage:   "The GCE network to connect instances to",
-				Value:   "default",
-				EnvVars: []string{"CLOUDBRAIN_GCE_NETWORK"},
+		}, gceFlags...),
+		Commands: []*cli.Command{
+			{
+				Name:   "gce",
+				Usage:  "Insert a Google Compute Engine provider, the default if no subcommand is given",
+				Action: gceAction,
+				Flags:  gceFlags,
 			},
-			&cli.IntFlag{
-				Name:    "gce-disk-size",
-				Usage:   "The GCE disk size in GiB",
-				Value:   30,
-				EnvVars: []string{"CLOUDBRAIN_GCE_DISK_SIZE"},
+			{
+				Name:   "ec2",
+				Usage:  "Insert an Amazon EC2 provider",
+				Action: ec2Action,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "ec2-access-key-id",
+						Usage:   "The AWS access key ID to use",
+						EnvVars: []string{"CLOUDBRAIN_EC2_ACCESS_KEY_ID"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-secret-access-key",
+						Usage:   "The AWS secret access key to use",
+						EnvVars: []string{"CLOUDBRAIN_EC2_SECRET_ACCESS_KEY"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-region",
+						Usage:   "The EC2 region to boot instances in",
+						Value:   "us-east-1",
+						EnvVars: []string{"CLOUDBRAIN_EC2_REGION"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-endpoint",
+						Usage:   "The EC2 API endpoint to use, defaults to the public endpoint for the region",
+						EnvVars: []string{"CLOUDBRAIN_EC2_ENDPOINT"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-standard-instance-type",
+						Usage:   "The instance type to use for 'standard' instances",
+						Value:   "c3.xlarge",
+						EnvVars: []string{"CLOUDBRAIN_EC2_STANDARD_INSTANCE_TYPE"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-premium-instance-type",
+						Usage:   "The instance type to use for 'premium' instances",
+						Value:   "c3.2xlarge",
+						EnvVars: []string{"CLOUDBRAIN_EC2_PREMIUM_INSTANCE_TYPE"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-subnet-id",
+						Usage:   "The VPC subnet to boot instances in",
+						EnvVars: []string{"CLOUDBRAIN_EC2_SUBNET_ID"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "ec2-security-group-id",
+						Usage:   "The security group(s) to put instances in",
+						EnvVars: []string{"CLOUDBRAIN_EC2_SECURITY_GROUP_ID"},
+					},
+					&cli.StringFlag{
+						Name:    "ec2-image-owner-id",
+						Usage:   "The account ID owning the build environment images",
+						EnvVars: []string{"CLOUDBRAIN_EC2_IMAGE_OWNER_ID"},
+					},
+					&cli.BoolFlag{
+						Name:    "ec2-auto-implode",
+						Usage:   "Enable to make the instance terminate after ec2-auto-implode-time if it's still running",
+						EnvVars: []string{"CLOUDBRAIN_EC2_AUTO_IMPLODE"},
+					},
+					&cli.DurationFlag{
+						Name:    "ec2-auto-implode-time",
+						Usage:   "How long to wait before auto-imploding. Will be rounded down to the nearest minute.",
+						EnvVars: []string{"CLOUDBRAIN_EC2_AUTO_IMPLODE_TIME"},
+					},
+				},
 			},
-			&cli.BoolFlag{
-				Name:    "gce-auto-implode",
-				Usage:   "Enable to make the instance power off after gce-auto-implode-time if it's still running",
-				EnvVars: []string{"CLOUDBRAIN_GCE_AUTO_IMPLODE"},
+			{
+				Name:   "openstack",
+				Usage:  "Insert an OpenStack provider",
+				Action: openStackAction,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "openstack-auth-url",
+						Usage:   "The Keystone v3 URL, e.g. https://keystone.example.com:5000/v3",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_AUTH_URL", "OS_AUTH_URL"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-username",
+						Usage:   "The OpenStack user to authenticate as",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_USERNAME", "OS_USERNAME"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-password",
+						Usage:   "The password for the OpenStack user",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_PASSWORD", "OS_PASSWORD"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-user-domain-name",
+						Usage:   "The domain the OpenStack user belongs to",
+						Value:   "Default",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_USER_DOMAIN_NAME", "OS_USER_DOMAIN_NAME"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-project-name",
+						Usage:   "The OpenStack project to boot instances in",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_PROJECT_NAME", "OS_PROJECT_NAME"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-project-domain-name",
+						Usage:   "The domain the OpenStack project belongs to",
+						Value:   "Default",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_PROJECT_DOMAIN_NAME", "OS_PROJECT_DOMAIN_NAME"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-region",
+						Usage:   "The OpenStack region to boot instances in",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_REGION", "OS_REGION_NAME"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-standard-flavor",
+						Usage:   "The flavor name or ID to use for 'standard' instances",
+						Value:   "m1.medium",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_STANDARD_FLAVOR"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-premium-flavor",
+						Usage:   "The flavor name or ID to use for 'premium' instances",
+						Value:   "m1.large",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_PREMIUM_FLAVOR"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-network-id",
+						Usage:   "The UUID of the network to connect instances to",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_NETWORK_ID"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "openstack-security-group",
+						Usage:   "The security group(s) to put instances in",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_SECURITY_GROUP"},
+					},
+					&cli.StringFlag{
+						Name:    "openstack-key-name",
+						Usage:   "The name of a Nova keypair to add to instances, in addition to the per-instance key",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_KEY_NAME"},
+					},
+					&cli.BoolFlag{
+						Name:    "openstack-auto-implode",
+						Usage:   "Enable to make the instance power off after openstack-auto-implode-time if it's still running",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_AUTO_IMPLODE"},
+					},
+					&cli.DurationFlag{
+						Name:    "openstack-auto-implode-time",
+						Usage:   "How long to wait before auto-imploding. Will be rounded down to the nearest minute.",
+						EnvVars: []string{"CLOUDBRAIN_OPENSTACK_AUTO_IMPLODE_TIME"},
+					},
+				},
 			},
-			&cli.DurationFlag{
-				Name:    "gce-auto-implode-time",
-				Usage:   "How long to wait before auto-imploding. Will be rounded down to the nearest minute.",
-				EnvVars: []string{"CLOUDBRAIN_GCE_AUTO_IMPLODE_TIME"},
+			{
+				Name:   "docker",
+				Usage:  "Insert a Docker provider, where instances are containers",
+				Action: dockerAction,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "docker-endpoint",
+						Usage:   "The Docker Engine endpoint, as a unix:// or tcp:// URL",
+						Value:   "unix:///var/run/docker.sock",
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_ENDPOINT"},
+					},
+					&cli.StringFlag{
+						Name:    "docker-network",
+						Usage:   "The Docker network to connect containers to",
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_NETWORK"},
+					},
+					&cli.BoolFlag{
+						Name:    "docker-privileged",
+						Usage:   "Enable to run containers in privileged mode",
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_PRIVILEGED"},
+					},
+					&cli.Float64Flag{
+						Name:    "docker-standard-cpus",
+						Usage:   "The number of CPUs to give 'standard' containers, 0 for no limit",
+						Value:   2,
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_STANDARD_CPUS"},
+					},
+					&cli.Int64Flag{
+						Name:    "docker-standard-memory",
+						Usage:   "The memory limit in bytes for 'standard' containers, 0 for no limit",
+						Value:   4 * 1024 * 1024 * 1024,
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_STANDARD_MEMORY"},
+					},
+					&cli.Float64Flag{
+						Name:    "docker-premium-cpus",
+						Usage:   "The number of CPUs to give 'premium' containers, 0 for no limit",
+						Value:   4,
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_PREMIUM_CPUS"},
+					},
+					&cli.Int64Flag{
+						Name:    "docker-premium-memory",
+						Usage:   "The memory limit in bytes for 'premium' containers, 0 for no limit",
+						Value:   8 * 1024 * 1024 * 1024,
+						EnvVars: []string{"CLOUDBRAIN_DOCKER_PREMIUM_MEMORY"},
+					},
+				},
 			},
-			&cli.BoolFlag{
-				Name:    "gce-preemptible",
-				Usage:   "Enable to use GCE preemptible instances",
-				EnvVars: []string{"CLOUDBRAIN_GCE_PREEMPTIBLE"},
+			{
+				Name:   "fake",
+				Usage:  "Insert a fake provider, for staging and integration tests",
+				Action: fakeAction,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "fake-namespace",
+						Usage:   "Fake providers with the same namespace share instances",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_NAMESPACE"},
+					},
+					&cli.StringFlag{
+						Name:    "fake-redis-url",
+						Usage:   "The Redis server to keep the instances in, so all processes see them. Defaults to the memory of each process",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_REDIS_URL"},
+					},
+					&cli.Float64Flag{
+						Name:    "fake-list-error-rate",
+						Usage:   "The probability (0-1) that a list call returns an error",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_LIST_ERROR_RATE"},
+					},
+					&cli.DurationFlag{
+						Name:    "fake-list-latency",
+						Usage:   "How long a list call takes",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_LIST_LATENCY"},
+					},
+					&cli.Float64Flag{
+						Name:    "fake-create-error-rate",
+						Usage:   "The probability (0-1) that a create call returns an error",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_CREATE_ERROR_RATE"},
+					},
+					&cli.DurationFlag{
+						Name:    "fake-create-latency",
+						Usage:   "How long a create call takes",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_CREATE_LATENCY"},
+					},
+					&cli.Float64Flag{
+						Name:    "fake-get-error-rate",
+						Usage:   "The probability (0-1) that a get call returns an error",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_GET_ERROR_RATE"},
+					},
+					&cli.DurationFlag{
+						Name:    "fake-get-latency",
+						Usage:   "How long a get call takes",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_GET_LATENCY"},
+					},
+					&cli.Float64Flag{
+						Name:    "fake-destroy-error-rate",
+						Usage:   "The probability (0-1) that a destroy call returns an error",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_DESTROY_ERROR_RATE"},
+					},
+					&cli.DurationFlag{
+						Name:    "fake-destroy-latency",
+						Usage:   "How long a destroy call takes",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_DESTROY_LATENCY"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "fake-image",
+						Usage:   "The image name(s) to accept, defaults to standard-image",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_IMAGE"},
+					},
+					&cli.DurationFlag{
+						Name:    "fake-running-after",
+						Usage:   "How long after being created instances become running, 0 to never",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_RUNNING_AFTER"},
+					},
+					&cli.Int64Flag{
+						Name:    "fake-seed",
+						Usage:   "The seed for the random error injection, 0 to use the current time",
+						EnvVars: []string{"CLOUDBRAIN_FAKE_SEED"},
+					},
+				},
 			},
 		},
 	}
@@ -107,34 +448,27 @@ func main() {
 	}
 }
 
-func mainAction(c *cli.Context) error {
-	if c.String("database-url") == "" {
-		return fmt.Errorf("error: the DATABASE_URL environment variable must be set")
-	}
-	pgdb, err := sql.Open("postgres", c.String("database-url"))
-	if err != nil {
-		return fmt.Errorf("error: could not connect to the database: %v", err)
-	}
-
-	var encryptionKey [32]byte
-	keySlice, err := hex.DecodeString(c.String("database-encryption-key"))
-	if err != nil {
-		return fmt.Errorf("error: couldn't decode the database encryption key: %v", err)
-	}
-	copy(encryptionKey[:], keySlice[0:32])
-
-	db := database.NewPostgresDB(encryptionKey, pgdb)
-
+func gceAction(c *cli.Context) error {
 	accountJSON, err := loadGoogleAccountJSON(c.String("gce-account-json"))
 	if err != nil {
 		return fmt.Errorf("error: couldn't load GCE account JSON file: %v", err)
 	}
 
-	providerConfig := cloud.GCEProviderConfiguration{
+	var zones []cloud.GCEZoneConfiguration
+	for _, zone := range c.StringSlice("gce-zones") {
+		zoneConfig, err := parseGCEZone(zone)
+		if err != nil {
+			return err
+		}
+		zones = append(zones, zoneConfig)
+	}
+
+	return insertProvider(c, "gce", cloud.GCEProviderConfiguration{
 		AccountJSON:         accountJSON,
 		ProjectID:           c.String("gce-project-id"),
 		ImageProjectID:      c.String("gce-image-project-id"),
 		Zone:                c.String("gce-zone"),
+		Zones:               zones,
 		StandardMachineType: c.String("gce-standard-machine-type"),
 		PremiumMachineType:  c.String("gce-premium-machine-type"),
 		Network:             c.String("gce-network"),
@@ -142,7 +476,116 @@ func mainAction(c *cli.Context) error {
 		AutoImplode:         c.Bool("gce-auto-implode"),
 		AutoImplodeTime:     c.Duration("gce-auto-implode-time"),
 		Preemptible:         c.Bool("gce-preemptible"),
+		BootPrePollSleep:    c.Duration("gce-boot-pre-poll-sleep"),
+		BootPollSleep:       c.Duration("gce-boot-poll-sleep"),
+		BootTimeout:         c.Duration("gce-boot-timeout"),
+		SkipStopPoll:        c.Bool("gce-skip-stop-poll"),
+		StopPrePollSleep:    c.Duration("gce-stop-pre-poll-sleep"),
+		StopPollSleep:       c.Duration("gce-stop-poll-sleep"),
+		StopTimeout:         c.Duration("gce-stop-timeout"),
+	})
+}
+
+// parseGCEZone parses a zone in the name:weight format. The weight is optional
+// and defaults to 1.
+func parseGCEZone(zone string) (cloud.GCEZoneConfiguration, error) {
+	parts := strings.SplitN(zone, ":", 2)
+	if len(parts) == 1 {
+		return cloud.GCEZoneConfiguration{Name: parts[0], Weight: 1}, nil
+	}
+
+	weight, err := strconv.Atoi(parts[1])
+	if err != nil || weight < 1 {
+		return cloud.GCEZoneConfiguration{}, fmt.Errorf("error: invalid weight for GCE zone %q", zone)
+	}
+
+	return cloud.GCEZoneConfiguration{Name: parts[0], Weight: weight}, nil
+}
+
+func ec2Action(c *cli.Context) error {
+	return insertProvider(c, "ec2", cloud.EC2ProviderConfiguration{
+		AccessKeyID:          c.String("ec2-access-key-id"),
+		SecretAccessKey:      c.String("ec2-secret-access-key"),
+		Region:               c.String("ec2-region"),
+		Endpoint:             c.String("ec2-endpoint"),
+		StandardInstanceType: c.String("ec2-standard-instance-type"),
+		PremiumInstanceType:  c.String("ec2-premium-instance-type"),
+		SubnetID:             c.String("ec2-subnet-id"),
+		SecurityGroupIDs:     c.StringSlice("ec2-security-group-id"),
+		ImageOwnerID:         c.String("ec2-image-owner-id"),
+		AutoImplode:          c.Bool("ec2-auto-implode"),
+		AutoImplodeTime:      c.Duration("ec2-auto-implode-time"),
+	})
+}
+
+func openStackAction(c *cli.Context) error {
+	return insertProvider(c, "openstack", cloud.OpenStackProviderConfiguration{
+		AuthURL:           c.String("openstack-auth-url"),
+		Username:          c.String("openstack-username"),
+		Password:          c.String("openstack-password"),
+		UserDomainName:    c.String("openstack-user-domain-name"),
+		ProjectName:       c.String("openstack-project-name"),
+		ProjectDomainName: c.String("openstack-project-domain-name"),
+		Region:            c.String("openstack-region"),
+		StandardFlavor:    c.String("openstack-standard-flavor"),
+		PremiumFlavor:     c.String("openstack-premium-flavor"),
+		NetworkID:         c.String("openstack-network-id"),
+		SecurityGroups:    c.StringSlice("openstack-security-group"),
+		KeyName:           c.String("openstack-key-name"),
+		AutoImplode:       c.Bool("openstack-auto-implode"),
+		AutoImplodeTime:   c.Duration("openstack-auto-implode-time"),
+	})
+}
+
+func dockerAction(c *cli.Context) error {
+	return insertProvider(c, "docker", cloud.DockerProviderConfiguration{
+		Endpoint:       c.String("docker-endpoint"),
+		Network:        c.String("docker-network"),
+		Privileged:     c.Bool("docker-privileged"),
+		StandardCPUs:   c.Float64("docker-standard-cpus"),
+		StandardMemory: c.Int64("docker-standard-memory"),
+		PremiumCPUs:    c.Float64("docker-premium-cpus"),
+		PremiumMemory:  c.Int64("docker-premium-memory"),
+	})
+}
+
+func fakeAction(c *cli.Context) error {
+	return insertProvider(c, "fake", cloud.FakeProviderConfiguration{
+		Namespace:        c.String("fake-namespace"),
+		RedisURL:         c.String("fake-redis-url"),
+		ListErrorRate:    c.Float64("fake-list-error-rate"),
+		CreateErrorRate:  c.Float64("fake-create-error-rate"),
+		GetErrorRate:     c.Float64("fake-get-error-rate"),
+		DestroyErrorRate: c.Float64("fake-destroy-error-rate"),
+		ListLatency:      c.Duration("fake-list-latency"),
+		CreateLatency:    c.Duration("fake-create-latency"),
+		GetLatency:       c.Duration("fake-get-latency"),
+		DestroyLatency:   c.Duration("fake-destroy-latency"),
+		Images:           c.StringSlice("fake-image"),
+		RunningAfter:     c.Duration("fake-running-after"),
+		Seed:             c.Int64("fake-seed"),
+	})
+}
+
+// insertProvider JSON-encodes the given provider configuration and stores it
+// in the database under the name given by the provider-name flag.
+func insertProvider(c *cli.Context, providerType string, providerConfig interface{}) error {
+	if c.String("database-url") == "" {
+		return fmt.Errorf("error: the DATABASE_URL environment variable must be set")
+	}
+	pgdb, err := sql.Open("postgres", c.String("database-url"))
+	if err != nil {
+		return fmt.Errorf("error: could not connect to the database: %v", err)
+	}
+
+	var encryptionKey [32]byte
+	keySlice, err := hex.DecodeString(c.String("database-encryption-key"))
+	if err != nil {
+		return fmt.Errorf("error: couldn't decode the database encryption key: %v", err)
 	}
+	copy(encryptionKey[:], keySlice[0:32])
+
+	db := database.NewPostgresDB(encryptionKey, pgdb)
 
 	jsonConfig, err := json.Marshal(providerConfig)
 	if err != nil {
@@ -155,9 +598,15 @@ func mainAction(c *cli.Context) error {
 	}
 
 	id, err := db.CreateProvider(database.Provider{
-		Type:   "gce",
-		Name:   providerName,
-		Config: jsonConfig,
+		Type:        providerType,
+		Name:        providerName,
+		Config:      jsonConfig,
+		MaxLifetime: c.Duration("max-lifetime"),
+		Quota: database.Quota{
+			MaxInstances:        c.Int("max-instances"),
+			MaxPremiumInstances: c.Int("max-premium-instances"),
+			MaxCreatesPerMinute: c.Int("max-creates-per-minute"),
+		},
 	})
 
 	if err != nil {
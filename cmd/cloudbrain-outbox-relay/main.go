@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	_ "github.com/lib/pq"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/cloudbrain"
+	"github.com/travis-ci/cloud-brain/database"
+	cbhttp "github.com/travis-ci/cloud-brain/http"
+	"github.com/travis-ci/cloud-brain/tracing"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:      "cloudbrain-outbox-relay",
+		Version:   cloudbrain.VersionString,
+		Copyright: cloudbrain.CopyrightString,
+		Usage:     "Enqueue the background jobs stored in the database outbox",
+		Action:    mainAction,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "redis-url",
+				EnvVars: []string{"CLOUDBRAIN_REDIS_URL", "REDIS_URL"},
+			},
+			&cli.IntFlag{
+				Name:    "redis-max-idle",
+				Value:   3,
+				Usage:   "The maximum number of idle Redis connections",
+				EnvVars: []string{"CLOUDBRAIN_REDIS_MAX_IDLE"},
+			},
+			&cli.IntFlag{
+				Name:    "redis-max-active",
+				Value:   5,
+				Usage:   "The maximum number of active Redis connections",
+				EnvVars: []string{"CLOUDBRAIN_REDIS_MAX_ACTIVE"},
+			},
+			&cli.DurationFlag{
+				Name:    "redis-idle-timeout",
+				Value:   3 * time.Minute,
+				EnvVars: []string{"CLOUDBRAIN_REDIS_IDLE_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-worker-prefix",
+				Value:   "cloud-brain:worker",
+				Usage:   "The Redis key prefix to use for keys used by the background workers",
+				EnvVars: []string{"CLOUDBRAIN_REDIS_WORKER_PREFIX"},
+			},
+			&cli.StringFlag{
+				Name:    "database-url",
+				Usage:   "The URL for the PostgreSQL database to use",
+				EnvVars: []string{"CLOUDBRAIN_DATABASE_URL", "DATABASE_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-addr",
+				Usage:   "The address to serve Prometheus metrics and the health checks on, e.g. \":9090\". Nothing is served if empty",
+				EnvVars: []string{"CLOUDBRAIN_METRICS_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "otlp-endpoint",
+				Usage:   "The OTLP/HTTP endpoint of the OpenTelemetry collector to send traces to, e.g. \"http://localhost:4318\". Traces aren't recorded if empty",
+				EnvVars: []string{"CLOUDBRAIN_OTLP_ENDPOINT"},
+			},
+			&cli.DurationFlag{
+				Name:    "poll-interval",
+				Usage:   "The interval at which to check the outbox for new jobs",
+				Value:   time.Second,
+				EnvVars: []string{"CLOUDBRAIN_OUTBOX_POLL_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "liveness-timeout",
+				Usage:   "How long the relay loop can go without making progress before /healthz fails",
+				Value:   5 * time.Minute,
+				EnvVars: []string{"CLOUDBRAIN_LIVENESS_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "batch-size",
+				Usage:   "The maximum number of jobs to enqueue per database transaction",
+				Value:   100,
+				EnvVars: []string{"CLOUDBRAIN_OUTBOX_BATCH_SIZE"},
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func mainAction(c *cli.Context) error {
+	ctx := context.Background()
+	logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true})
+
+	if c.String("redis-url") == "" {
+		cbcontext.LoggerFromContext(ctx).Fatal("redis-url flag is required")
+	}
+	redisURL := c.String("redis-url")
+	redisPool := &redis.Pool{
+		MaxIdle:     c.Int("redis-max-idle"),
+		MaxActive:   c.Int("redis-max-active"),
+		IdleTimeout: c.Duration("redis-idle-timeout"),
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(redisURL)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	if c.String("database-url") == "" {
+		cbcontext.LoggerFromContext(ctx).Fatal("database-url flag is required")
+	}
+	pgdb, err := sql.Open("postgres", c.String("database-url"))
+	if err != nil {
+		cbcontext.LoggerFromContext(ctx).WithField("err", err).Fatal("couldn't connect to postgres")
+	}
+
+	// The outbox isn't encrypted, so no encryption key is needed
+	db := database.NewPostgresDB([32]byte{}, pgdb)
+
+	redisWorkerPrefix := c.String("redis-worker-prefix")
+	core := cloudbrain.NewCore(db, redisPool, redisWorkerPrefix)
+
+	if c.String("otlp-endpoint") != "" {
+		tracing.SetExporter(tracing.NewOTLPExporter(ctx, c.String("otlp-endpoint"), c.App.Name))
+	}
+
+	// The relay has no encryption key to load the providers with, so only
+	// its liveness is served
+	heartbeat := cloudbrain.NewHeartbeat(c.Duration("liveness-timeout"))
+	cbhttp.ListenAndServeStatus(ctx, c.String("metrics-addr"), nil, heartbeat)
+
+	batchSize := c.Int("batch-size")
+
+	var errorCount uint
+	for {
+		heartbeat.Beat()
+
+		relayed, err := core.RelayOutbox(ctx, batchSize)
+		if err != nil {
+			errorCount++
+		} else {
+			errorCount = 0
+		}
+
+		if relayed > 0 {
+			cbcontext.LoggerFromContext(ctx).WithField("count", relayed).Info("relayed jobs from the outbox")
+		}
+
+		// A full batch means there are probably more jobs waiting
+		if err == nil && relayed == batchSize {
+			continue
+		}
+
+		sleepTime := c.Duration("poll-interval") * time.Duration(errorCount+1)
+		if sleepTime > time.Minute {
+			sleepTime = time.Minute
+		}
+
+		if err != nil {
+			cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"err":          err,
+				"backoff_time": sleepTime,
+			}).Error("an error occurred when relaying jobs")
+		}
+
+		time.Sleep(sleepTime)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"text/tabwriter"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -14,6 +15,8 @@ import (
 	"github.com/travis-ci/cloud-brain/cbcontext"
 	"github.com/travis-ci/cloud-brain/cloudbrain"
 	"github.com/travis-ci/cloud-brain/database"
+	cbhttp "github.com/travis-ci/cloud-brain/http"
+	"github.com/travis-ci/cloud-brain/tracing"
 	"gopkg.in/urfave/cli.v2"
 )
 
@@ -62,12 +65,66 @@ func main() {
 				Usage:   "The database encryption key, hex-encoded",
 				EnvVars: []string{"CLOUDBRAIN_DATABASE_ENCRYPTION_KEY"},
 			},
+			&cli.StringFlag{
+				Name:    "metrics-addr",
+				Usage:   "The address to serve Prometheus metrics and the health checks on, e.g. \":9090\". Nothing is served if empty",
+				EnvVars: []string{"CLOUDBRAIN_METRICS_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "otlp-endpoint",
+				Usage:   "The OTLP/HTTP endpoint of the OpenTelemetry collector to send traces to, e.g. \"http://localhost:4318\". Traces aren't recorded if empty",
+				EnvVars: []string{"CLOUDBRAIN_OTLP_ENDPOINT"},
+			},
 			&cli.DurationFlag{
 				Name:    "refresh-interval",
 				Usage:   "The interval at which to refresh the cached instances",
 				Value:   5 * time.Second,
 				EnvVars: []string{"CLOUDBRAIN_REFRESH_INTERVAL"},
 			},
+			&cli.DurationFlag{
+				Name:    "liveness-timeout",
+				Usage:   "How long the refresh loop can go without making progress before /healthz fails",
+				Value:   15 * time.Minute,
+				EnvVars: []string{"CLOUDBRAIN_LIVENESS_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "reap-orphans",
+				Usage:   "Destroy instances on the providers that have no record in the database",
+				EnvVars: []string{"CLOUDBRAIN_REAP_ORPHANS"},
+			},
+			&cli.BoolFlag{
+				Name:    "reap-orphans-dry-run",
+				Usage:   "Log the orphaned instances that would be destroyed, without destroying them",
+				EnvVars: []string{"CLOUDBRAIN_REAP_ORPHANS_DRY_RUN"},
+			},
+			&cli.DurationFlag{
+				Name:    "orphan-grace-period",
+				Usage:   "How long an instance must have been seen as an orphan before it's destroyed",
+				Value:   time.Hour,
+				EnvVars: []string{"CLOUDBRAIN_ORPHAN_GRACE_PERIOD"},
+			},
+			&cli.DurationFlag{
+				Name:    "creating-timeout",
+				Usage:   "How long an instance can be creating before it's considered stuck and removed, 0 to disable",
+				Value:   30 * time.Minute,
+				EnvVars: []string{"CLOUDBRAIN_CREATING_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "starting-timeout",
+				Usage:   "How long an instance can be starting before it's considered stuck and removed, 0 to disable",
+				Value:   15 * time.Minute,
+				EnvVars: []string{"CLOUDBRAIN_STARTING_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "terminating-timeout",
+				Usage:   "How long an instance can be terminating before the removal is retried, 0 to disable",
+				Value:   15 * time.Minute,
+				EnvVars: []string{"CLOUDBRAIN_TERMINATING_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:  "orphan-report",
+				Usage: "Refresh once, print the orphaned instances and exit",
+			},
 		},
 	}
 
@@ -119,8 +176,33 @@ func mainAction(c *cli.Context) error {
 	redisWorkerPrefix := c.String("redis-worker-prefix")
 	core := cloudbrain.NewCore(db, redisPool, redisWorkerPrefix)
 
+	if c.String("otlp-endpoint") != "" {
+		tracing.SetExporter(tracing.NewOTLPExporter(ctx, c.String("otlp-endpoint"), c.App.Name))
+	}
+
+	heartbeat := cloudbrain.NewHeartbeat(c.Duration("liveness-timeout"))
+	cbhttp.ListenAndServeStatus(ctx, c.String("metrics-addr"), core, heartbeat)
+
+	if c.Bool("orphan-report") {
+		err := core.ProviderRefresh(ctx)
+		if err != nil {
+			cbcontext.LoggerFromContext(ctx).WithField("err", err).Error("an error occurred when refreshing")
+		}
+
+		printOrphanReport(core.Orphans())
+		return err
+	}
+
+	stuckTimeouts := map[cloudbrain.InstanceState]time.Duration{
+		cloudbrain.InstanceStateCreating:    c.Duration("creating-timeout"),
+		cloudbrain.InstanceStateStarting:    c.Duration("starting-timeout"),
+		cloudbrain.InstanceStateTerminating: c.Duration("terminating-timeout"),
+	}
+
 	var errorCount uint
 	for {
+		heartbeat.Beat()
+
 		err := core.ProviderRefresh(ctx)
 		if err != nil {
 			errorCount++
@@ -128,6 +210,15 @@ func mainAction(c *cli.Context) error {
 			errorCount = 0
 		}
 
+		stuckErr := core.RemediateStuckInstances(ctx, stuckTimeouts)
+		if stuckErr != nil {
+			cbcontext.LoggerFromContext(ctx).WithField("err", stuckErr).Error("an error occurred when removing stuck instances")
+		}
+
+		if c.Bool("reap-orphans") || c.Bool("reap-orphans-dry-run") {
+			reapOrphans(ctx, core, c.Duration("orphan-grace-period"), c.Bool("reap-orphans-dry-run"))
+		}
+
 		// TODO(sarahhodne): Make this configurable
 		sleepTime := c.Duration("refresh-interval") * time.Duration(errorCount+1)
 		if sleepTime > 5*time.Minute {
@@ -145,3 +236,43 @@ func mainAction(c *cli.Context) error {
 	}
 
 }
+
+func reapOrphans(ctx context.Context, core *cloudbrain.Core, gracePeriod time.Duration, dryRun bool) {
+	orphans, err := core.ReapOrphans(ctx, gracePeriod, dryRun)
+	if err != nil {
+		cbcontext.LoggerFromContext(ctx).WithField("err", err).Error("an error occurred when reaping orphans")
+	}
+
+	if !dryRun {
+		return
+	}
+
+	now := time.Now()
+	for _, orphan := range orphans {
+		cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"provider":    orphan.ProviderName,
+			"provider_id": orphan.ID,
+			"upstream_id": orphan.UpstreamID,
+			"age":         orphan.Age(now),
+		}).Info("would reap orphaned instance")
+	}
+}
+
+// printOrphanReport prints the orphans with how long ago the provider created
+// them. The grace period is counted from when a running refresh worker first
+// sees an orphan, so the report can't say which ones would be reaped; use
+// --reap-orphans-dry-run for that.
+func printOrphanReport(orphans []cloudbrain.Orphan) {
+	now := time.Now()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tID\tUPSTREAM ID\tSTATE\tCREATED")
+	for _, orphan := range orphans {
+		created := "unknown"
+		if !orphan.CreatedAt.IsZero() {
+			created = fmt.Sprintf("%v ago", now.Sub(orphan.CreatedAt)/time.Second*time.Second)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orphan.ProviderName, orphan.ID, orphan.UpstreamID, orphan.State, created)
+	}
+	w.Flush()
+}
@@ -76,6 +76,18 @@ func mainAction(c *cli.Context) error {
 	fmt.Printf("ID: %v\n", provider.ID)
 	fmt.Printf("Type: %v\n", provider.Type)
 	fmt.Printf("Name: %v\n", provider.Name)
+	if provider.MaxLifetime > 0 {
+		fmt.Printf("Max lifetime: %v\n", provider.MaxLifetime)
+	}
+	if provider.Quota.MaxInstances > 0 {
+		fmt.Printf("Max instances: %d\n", provider.Quota.MaxInstances)
+	}
+	if provider.Quota.MaxPremiumInstances > 0 {
+		fmt.Printf("Max premium instances: %d\n", provider.Quota.MaxPremiumInstances)
+	}
+	if provider.Quota.MaxCreatesPerMinute > 0 {
+		fmt.Printf("Max creates per minute: %d\n", provider.Quota.MaxCreatesPerMinute)
+	}
 	fmt.Printf("Config:\n%s\n", provider.Config)
 
 	return nil
@@ -0,0 +1,3 @@
+#/bin/sh
+sleep 8
+bin/cloudbrain-token create "docker-compose"
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	_ "github.com/lib/pq"
+	"github.com/travis-ci/cloud-brain/cloudbrain"
+	"github.com/travis-ci/cloud-brain/database"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:      "cloudbrain-token",
+		Version:   cloudbrain.VersionString,
+		Copyright: cloudbrain.CopyrightString,
+		Usage:     "Manage the tokens used with the Cloud Brain HTTP API",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "database-url",
+				Usage:   "The URL for the PostgreSQL database to use",
+				EnvVars: []string{"CLOUDBRAIN_DATABASE_URL", "DATABASE_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-url",
+				Usage:   "The URL for the Redis server cloudbrain-http uses, to remove revoked and rotated tokens from its token cache. They keep working for up to --token-cache-ttl if not given",
+				EnvVars: []string{"CLOUDBRAIN_REDIS_URL", "REDIS_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-worker-prefix",
+				Value:   "cloud-brain:worker",
+				Usage:   "The Redis key prefix cloudbrain-http uses",
+				EnvVars: []string{"CLOUDBRAIN_REDIS_WORKER_PREFIX"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Create a token",
+				ArgsUsage: "<description>",
+				Action:    createAction,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "scope",
+						Usage: "A scope to give the token, can be given multiple times. One of " + strings.Join(cloudbrain.Scopes, ", "),
+						Value: cli.NewStringSlice(cloudbrain.ScopeInstancesRead, cloudbrain.ScopeInstancesWrite),
+					},
+					&cli.StringSliceFlag{
+						Name:  "provider",
+						Usage: "The name of a provider the token can be used with, can be given multiple times. The token can be used with all providers if not given",
+					},
+					&cli.StringFlag{
+						Name:  "tenant",
+						Usage: "The tenant the token belongs to, e.g. the Travis site. Tokens with the same tenant share their instances. The token only has access to the instances it created if not given",
+					},
+					&cli.DurationFlag{
+						Name:  "expires-in",
+						Usage: "How long the token can be used for. The token doesn't expire if not given",
+					},
+					&cli.IntFlag{
+						Name:  "max-instances",
+						Usage: "How many instances that aren't terminated the token, or its tenant if given, can have at the same time, 0 for no limit",
+					},
+					&cli.IntFlag{
+						Name:  "max-premium-instances",
+						Usage: "Like --max-instances, but only counting premium instances",
+					},
+					&cli.IntFlag{
+						Name:  "max-creates-per-minute",
+						Usage: "How many instances the token, or its tenant if given, can create in a minute, 0 for no limit",
+					},
+				},
+			},
+			{
+				Name:   "list",
+				Usage:  "List all tokens",
+				Action: listAction,
+			},
+			{
+				Name:      "revoke",
+				Usage:     "Revoke a token, so it can't be used anymore",
+				ArgsUsage: "<token ID>",
+				Action:    revokeAction,
+			},
+			{
+				Name:      "rotate",
+				Usage:     "Generate a new secret for a token, keeping its scopes, providers and expiry",
+				ArgsUsage: "<token ID>",
+				Action:    rotateAction,
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func createAction(c *cli.Context) error {
+	core, err := newCore(c)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt time.Time
+	if c.Duration("expires-in") > 0 {
+		expiresAt = time.Now().UTC().Add(c.Duration("expires-in"))
+	}
+
+	_, token, err := core.CreateToken(context.Background(), cloudbrain.CreateTokenAttributes{
+		Description: c.Args().Get(0),
+		Scopes:      c.StringSlice("scope"),
+		Providers:   c.StringSlice("provider"),
+		Tenant:      c.String("tenant"),
+		Quota: cloudbrain.Quota{
+			MaxInstances:        c.Int("max-instances"),
+			MaxPremiumInstances: c.Int("max-premium-instances"),
+			MaxCreatesPerMinute: c.Int("max-creates-per-minute"),
+		},
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return fmt.Errorf("error: couldn't create the token: %v", err)
+	}
+
+	fmt.Printf("generated token: %s\n", token)
+
+	return nil
+}
+
+func listAction(c *cli.Context) error {
+	core, err := newCore(c)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := core.ListTokens(context.Background())
+	if err != nil {
+		return fmt.Errorf("error: couldn't list the tokens: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDESCRIPTION\tSCOPES\tPROVIDERS\tTENANT\tEXPIRES AT\tLAST USED AT\tREVOKED")
+	for _, token := range tokens {
+		providers := strings.Join(token.Providers, ",")
+		if providers == "" {
+			providers = "all"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%v\n",
+			token.ID,
+			token.Description,
+			strings.Join(token.Scopes, ","),
+			providers,
+			token.Tenant,
+			formatTime(token.ExpiresAt),
+			formatTime(token.LastUsedAt),
+			token.Revoked,
+		)
+	}
+
+	return w.Flush()
+}
+
+func revokeAction(c *cli.Context) error {
+	core, err := newCore(c)
+	if err != nil {
+		return err
+	}
+
+	tokenID, err := strconv.ParseUint(c.Args().Get(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error: the token ID must be numerical")
+	}
+
+	err = core.RevokeToken(context.Background(), tokenID)
+	if err != nil {
+		return fmt.Errorf("error: couldn't revoke the token: %v", err)
+	}
+
+	fmt.Printf("revoked token %d\n", tokenID)
+
+	return nil
+}
+
+func rotateAction(c *cli.Context) error {
+	core, err := newCore(c)
+	if err != nil {
+		return err
+	}
+
+	tokenID, err := strconv.ParseUint(c.Args().Get(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error: the token ID must be numerical")
+	}
+
+	token, err := core.RotateToken(context.Background(), tokenID)
+	if err != nil {
+		return fmt.Errorf("error: couldn't rotate the token: %v", err)
+	}
+
+	fmt.Printf("generated token: %s\n", token)
+
+	return nil
+}
+
+// newCore returns a Core backed by the database given by the database-url
+// flag, which publishes token invalidations to the Redis server given by the
+// redis-url flag, if any. Tokens aren't encrypted, so no encryption key is
+// needed.
+func newCore(c *cli.Context) (*cloudbrain.Core, error) {
+	if c.String("database-url") == "" {
+		return nil, fmt.Errorf("error: the DATABASE_URL environment variable must be set")
+	}
+	pgdb, err := sql.Open("postgres", c.String("database-url"))
+	if err != nil {
+		return nil, fmt.Errorf("error: could not connect to the database: %v", err)
+	}
+
+	var redisPool *redis.Pool
+	if c.String("redis-url") != "" {
+		redisURL := c.String("redis-url")
+		redisPool = &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(redisURL)
+			},
+		}
+	}
+
+	return cloudbrain.NewCore(database.NewPostgresDB([32]byte{}, pgdb), redisPool, c.String("redis-worker-prefix")), nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -1,35 +1,98 @@
 // Package database implements a database to store instance information in
 package database
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // ErrInstanceNotFound is returned from DB methods when an instance with the
 // given ID could not be found.
 var ErrInstanceNotFound = errors.New("instance not found")
 
+// ErrInstanceVersionConflict is returned from UpdateInstance when the instance
+// was updated by someone else since it was fetched.
+var ErrInstanceVersionConflict = errors.New("instance was updated concurrently")
+
+// ErrDuplicateIdempotencyKey is returned from CreateInstance when an instance
+// with the same owner and idempotency key already exists.
+var ErrDuplicateIdempotencyKey = errors.New("an instance with the given idempotency key already exists")
+
+// ErrTokenNotFound is returned from DB methods when a token with the given ID
+// could not be found.
+var ErrTokenNotFound = errors.New("token not found")
+
 // DB is implemented by the supported database backends.
 type DB interface {
 	// Inserts the instance into the database, returns the id or an error.
 	CreateInstance(instance Instance) (string, error)
 
+	// Inserts the instance into the database together with the outbox job,
+	// atomically. The payload of the job is set to the instance ID. Returns
+	// the id or an error, or a *QuotaExceededError if the instance would
+	// exceed one of the limits.
+	CreateInstanceWithOutboxJob(instance Instance, job OutboxJob, limits []QuotaLimit) (string, error)
+
+	// Inserts a job into the outbox
+	CreateOutboxJob(job OutboxJob) error
+
+	// Passes up to limit outbox jobs to enqueue, oldest first, and removes
+	// them from the outbox if enqueue succeeds. Returns the number of jobs
+	// removed.
+	RelayOutboxJobs(limit int, enqueue func(OutboxJob) error) (int, error)
+
 	// Removes the instance from the database, returns the id or an error.
 	RemoveInstance(instance Instance) (string, error)
 
 	// Retrieves the instance by its ID, or returns an error
 	GetInstance(id string) (Instance, error)
 
+	// Retrieves the instance created with the given idempotency key by the
+	// given token or tenant, or returns an error. If tenant is set, the token
+	// ID is ignored.
+	GetInstanceByIdempotencyKey(key string, ownerTokenID uint64, tenant string) (Instance, error)
+
 	// Retrieves all instances by State
 	GetInstancesByState(state string) ([]Instance, error)
 
-	// Updates the instance with the given ID
+	// Retrieves the instances matching the filter, ordered by creation time
+	// and then ID
+	ListInstances(filter InstanceFilter) ([]Instance, error)
+
+	// Counts the instances by provider and state
+	CountInstances() ([]InstanceCount, error)
+
+	// Updates the instance with the given ID, if its version still matches
+	// the one in the database
 	UpdateInstance(instance Instance) error
 
-	// GetHashedToken gets the salt and the hashed token for a given token ID.
-	// The returned attributes are salt, hash and an error.
-	GetSaltAndHashForTokenID(tokenID uint64) ([]byte, []byte, error)
+	// Appends the event to the history of the instance it refers to
+	CreateInstanceEvent(event InstanceEvent) error
+
+	// Retrieves the history of the instance with the given ID, oldest first
+	ListInstanceEvents(instanceID string) ([]InstanceEvent, error)
+
+	// Retrieves the token with the given ID, including its salt and hash.
+	// Returns ErrTokenNotFound if there's no such token.
+	GetToken(tokenID uint64) (Token, error)
 
 	// Insert a token into the database, returns the ID of the token
-	InsertToken(description string, hash, salt []byte) (uint64, error)
+	InsertToken(token Token) (uint64, error)
+
+	// Records when the token with the given ID was last used
+	UpdateTokenLastUsed(tokenID uint64, lastUsedAt time.Time) error
+
+	// Lists all the tokens, ordered by ID
+	ListTokens() ([]Token, error)
+
+	// Marks the token with the given ID as revoked. Returns ErrTokenNotFound
+	// if there's no such token.
+	RevokeToken(tokenID uint64) error
+
+	// Replaces the salt and hash of the token with the given ID. Returns
+	// ErrTokenNotFound if there's no such token.
+	UpdateTokenSecret(tokenID uint64, salt, hash []byte) error
 
 	// List all the providers in the database
 	ListProviders() ([]Provider, error)
@@ -37,6 +100,17 @@ type DB interface {
 	// Inserts the provider into the database, returns the id or an error. The
 	// id will be automatically generated if one is not supplied.
 	CreateProvider(provider Provider) (string, error)
+
+	// Retrieves the quota of the provider with the given name, without
+	// decrypting its config. A provider that doesn't exist has no quota.
+	GetProviderQuota(name string) (Quota, error)
+
+	// Retrieves the type of every provider by name, without decrypting
+	// their configs
+	ListProviderTypes() (map[string]string, error)
+
+	// Checks that the database is reachable
+	Ping() error
 }
 
 // Instance contains the data stored about a compute instance in the database.
@@ -50,6 +124,190 @@ type Instance struct {
 	IPAddress    string
 	UpstreamID   string
 	ErrorReason  string
+	Zone         string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+
+	// IdempotencyKey is supplied by the client creating the instance, and is
+	// unique across the instances of the same owner if set, see
+	// idempotencyScope. It's used to detect retried requests.
+	IdempotencyKey string
+
+	// OwnerTokenID is the ID of the token that created the instance, and
+	// Tenant is the tenant of that token. Both are empty for instances
+	// created before ownership was recorded.
+	OwnerTokenID uint64
+	Tenant       string
+
+	// CreateJobID is the ID of the create job that claimed the instance, so
+	// that a duplicate of the job doesn't create it on the provider again.
+	CreateJobID string
+
+	// Version is incremented on every update, and is used to detect
+	// concurrent updates to the same instance.
+	Version int64
+
+	// The last time the instance entered each of these states, or the zero
+	// time if it never has.
+	StartingAt    time.Time
+	RunningAt     time.Time
+	TerminatingAt time.Time
+	TerminatedAt  time.Time
+	ErroredAt     time.Time
+}
+
+// InstanceEvent is an entry in the history of an instance, recording a change
+// of its state.
+type InstanceEvent struct {
+	ID            uint64
+	InstanceID    string
+	State         string
+	PreviousState string
+	Reason        string
+	CreatedAt     time.Time
+}
+
+// OutboxJob is a background job that has been committed to the database, but
+// not yet enqueued.
+type OutboxJob struct {
+	ID        uint64
+	JobName   string
+	Payload   string
+	CreatedAt time.Time
+
+	// Metadata is passed on to the job as extra arguments, and is used to
+	// carry information about the request that created the job.
+	Metadata map[string]string
+}
+
+// Token contains the data stored about an API token in the database. The token
+// itself isn't stored, only a salt and its scrypt hash.
+type Token struct {
+	ID          uint64
+	Description string
+	Salt        []byte
+	Hash        []byte
+
+	// Scopes are the operations the token can be used for
+	Scopes []string
+
+	// Providers are the names of the providers the token can be used with. If
+	// empty, the token can be used with all providers.
+	Providers []string
+
+	// ExpiresAt is when the token stops working, or the zero time if it
+	// doesn't expire.
+	ExpiresAt time.Time
+
+	// Tenant is the tenant the token belongs to, such as a Travis site or a
+	// team. Tokens with the same tenant share their instances. If empty,
+	// the token only has access to the instances it created.
+	Tenant string
+
+	// Quota limits the instances the token can create
+	Quota Quota
+
+	Revoked    bool
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
+
+// Quota limits the instances that can be created by a token or on a provider.
+// Zero values mean there's no limit.
+type Quota struct {
+	// MaxInstances is the number of instances that can exist at the same
+	// time, counting every instance that isn't terminated.
+	MaxInstances int
+
+	// MaxPremiumInstances is like MaxInstances, but only counts premium
+	// instances.
+	MaxPremiumInstances int
+
+	// MaxCreatesPerMinute is the number of instances that can be created in
+	// a minute.
+	MaxCreatesPerMinute int
+}
+
+// QuotaLimit is checked by CreateInstanceWithOutboxJob before inserting an
+// instance. If Max or more instances already match the filter, the instance
+// isn't created.
+type QuotaLimit struct {
+	// Key identifies what the limit applies to, e.g. "tenant:org". Creates
+	// checking limits with the same key don't run concurrently.
+	Key string
+
+	Filter InstanceFilter
+	Max    int
+
+	// Description is used in the error if the limit is exceeded, e.g. "at
+	// most 10 instances for tenant org".
+	Description string
+}
+
+// QuotaExceededError is returned from CreateInstanceWithOutboxJob when the
+// instance would exceed a QuotaLimit.
+type QuotaExceededError struct {
+	Limit QuotaLimit
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", e.Limit.Description)
+}
+
+// idempotencyScope returns the scope idempotency keys are unique in for
+// instances with the given owner: the tenant if there is one, and otherwise the
+// token. This matches the expression of the unique index in Postgres.
+func idempotencyScope(ownerTokenID uint64, tenant string) string {
+	if tenant != "" {
+		return "tenant:" + tenant
+	}
+	if ownerTokenID != 0 {
+		return fmt.Sprintf("token:%d", ownerTokenID)
+	}
+	return ""
+}
+
+// InstanceCount is the number of instances on a provider in a given state.
+type InstanceCount struct {
+	ProviderName string
+	State        string
+	Count        int
+}
+
+// InstanceFilter is used to select which instances ListInstances returns. Zero
+// values match all instances.
+type InstanceFilter struct {
+	State         string
+	ProviderName  string
+	Image         string
+	InstanceType  string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// ExcludeStates, if not empty, only matches instances in none of the
+	// given states.
+	ExcludeStates []string
+
+	// ProviderNames, if not empty, only matches instances on one of the given
+	// providers.
+	ProviderNames []string
+
+	// OwnerTokenID and Tenant, if set, only match instances owned by the
+	// given token or tenant. If IncludeUnowned is also set, instances with no
+	// owner match too.
+	OwnerTokenID   uint64
+	Tenant         string
+	IncludeUnowned bool
+
+	// AfterCreatedAt and AfterID are used for pagination. If AfterID is set,
+	// only instances ordered after the instance with the given creation time
+	// and ID are returned.
+	AfterCreatedAt time.Time
+	AfterID        string
+
+	// Limit is the maximum number of instances to return. If zero, all
+	// matching instances are returned.
+	Limit int
 }
 
 // Provider contains the data stored about a cloud provider in the database.
@@ -66,4 +324,11 @@ type Provider struct {
 
 	// Config is a provider-specific configuration, passed to cloud.NewProvider.
 	Config []byte
+
+	// MaxLifetime is how long instances on this provider are allowed to live
+	// before they're removed. Zero means there's no limit.
+	MaxLifetime time.Duration
+
+	// Quota limits the instances that can be created on this provider
+	Quota Quota
 }
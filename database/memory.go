@@ -2,7 +2,9 @@ package database
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 )
@@ -12,36 +14,117 @@ import (
 type MemoryDatabase struct {
 	mutex     sync.Mutex
 	instances map[string]Instance
-	tokens    []memoryToken
-}
-
-type memoryToken struct {
-	Hash        []byte
-	Salt        []byte
-	Description string
+	events    []InstanceEvent
+	outbox    []OutboxJob
+	outboxID  uint64
+	tokens    map[uint64]Token
+	tokenID   uint64
+	providers []Provider
 }
 
 // NewMemoryDatabase creates and returns an empty MemoryDatabase.
 func NewMemoryDatabase() *MemoryDatabase {
 	return &MemoryDatabase{
 		instances: make(map[string]Instance),
+		tokens:    make(map[uint64]Token),
 	}
 }
 
 // CreateInstance stores the instance in the database and returns the ID it
-// generated for it. Never returns an error.
+// generated for it. Returns ErrDuplicateIdempotencyKey if another instance of
+// the same owner has the same idempotency key.
 func (db *MemoryDatabase) CreateInstance(instance Instance) (string, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	return db.createInstance(instance)
+}
+
+func (db *MemoryDatabase) createInstance(instance Instance) (string, error) {
+	if instance.IdempotencyKey != "" {
+		scope := idempotencyScope(instance.OwnerTokenID, instance.Tenant)
+		for _, existing := range db.instances {
+			if existing.IdempotencyKey == instance.IdempotencyKey && idempotencyScope(existing.OwnerTokenID, existing.Tenant) == scope {
+				return "", ErrDuplicateIdempotencyKey
+			}
+		}
+	}
+
 	id := uuid.New()
 	instance.ID = id
+	if instance.CreatedAt.IsZero() {
+		instance.CreatedAt = time.Now().UTC()
+	}
+	instance.UpdatedAt = instance.CreatedAt
 	db.instances[id] = instance
 
 	//TODO(emdantrim): log this action
 	return id, nil
 }
 
+// CreateInstanceWithOutboxJob stores the instance and the outbox job for it,
+// and returns the ID it generated for the instance. Returns a
+// *QuotaExceededError if the instance would exceed one of the limits.
+func (db *MemoryDatabase) CreateInstanceWithOutboxJob(instance Instance, job OutboxJob, limits []QuotaLimit) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, limit := range limits {
+		if len(db.listInstances(limit.Filter)) >= limit.Max {
+			return "", &QuotaExceededError{Limit: limit}
+		}
+	}
+
+	id, err := db.createInstance(instance)
+	if err != nil {
+		return "", err
+	}
+
+	job.Payload = id
+	return id, db.createOutboxJob(job)
+}
+
+// CreateOutboxJob stores the job in the outbox. Never returns an error.
+func (db *MemoryDatabase) CreateOutboxJob(job OutboxJob) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.createOutboxJob(job)
+}
+
+func (db *MemoryDatabase) createOutboxJob(job OutboxJob) error {
+	db.outboxID++
+	job.ID = db.outboxID
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now().UTC()
+	}
+	db.outbox = append(db.outbox, job)
+
+	return nil
+}
+
+// RelayOutboxJobs passes up to limit jobs from the outbox to enqueue, oldest
+// first, and removes the ones enqueue succeeds for. It stops at the first job
+// enqueue fails for, and returns the number of jobs relayed and that error.
+func (db *MemoryDatabase) RelayOutboxJobs(limit int, enqueue func(OutboxJob) error) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	relayed := 0
+	for relayed < limit && relayed < len(db.outbox) {
+		err := enqueue(db.outbox[relayed])
+		if err != nil {
+			db.outbox = db.outbox[relayed:]
+			return relayed, err
+		}
+
+		relayed++
+	}
+
+	db.outbox = db.outbox[relayed:]
+	return relayed, nil
+}
+
 // RemoveInstance removes the instance from the database.
 func (db *MemoryDatabase) RemoveInstance(instance Instance) (string, error) {
 	db.mutex.Lock()
@@ -71,6 +154,46 @@ func (db *MemoryDatabase) GetInstance(id string) (Instance, error) {
 	return instance, nil
 }
 
+// GetInstanceByIdempotencyKey returns the instance created with the given
+// idempotency key by the given owner, or ErrInstanceNotFound if there is none.
+func (db *MemoryDatabase) GetInstanceByIdempotencyKey(key string, ownerTokenID uint64, tenant string) (Instance, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	scope := idempotencyScope(ownerTokenID, tenant)
+	for _, instance := range db.instances {
+		if key != "" && instance.IdempotencyKey == key && idempotencyScope(instance.OwnerTokenID, instance.Tenant) == scope {
+			return instance, nil
+		}
+	}
+
+	return Instance{}, ErrInstanceNotFound
+}
+
+// CountInstances returns the number of instances by provider and state, in no
+// particular order.
+func (db *MemoryDatabase) CountInstances() ([]InstanceCount, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	type countKey struct{ providerName, state string }
+	countsByKey := make(map[countKey]int)
+	for _, instance := range db.instances {
+		countsByKey[countKey{instance.ProviderName, instance.State}]++
+	}
+
+	counts := make([]InstanceCount, 0, len(countsByKey))
+	for key, count := range countsByKey {
+		counts = append(counts, InstanceCount{
+			ProviderName: key.providerName,
+			State:        key.state,
+			Count:        count,
+		})
+	}
+
+	return counts, nil
+}
+
 // GetInstancesByState returns a slice of instances for a given state
 func (db *MemoryDatabase) GetInstancesByState(state string) ([]Instance, error) {
 	db.mutex.Lock()
@@ -86,58 +209,306 @@ func (db *MemoryDatabase) GetInstancesByState(state string) ([]Instance, error)
 	return instances, nil
 }
 
-// UpdateInstance updates the instance with the given ID, or returns
-// ErrInstanceNotFound if no instance with that ID exists.
+// ListInstances returns the instances matching the given filter, ordered by
+// creation time and then ID.
+func (db *MemoryDatabase) ListInstances(filter InstanceFilter) ([]Instance, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.listInstances(filter), nil
+}
+
+func (db *MemoryDatabase) listInstances(filter InstanceFilter) []Instance {
+	var instances []Instance
+	for _, instance := range db.instances {
+		if filter.State != "" && instance.State != filter.State {
+			continue
+		}
+		if filter.ProviderName != "" && instance.ProviderName != filter.ProviderName {
+			continue
+		}
+		if filter.Image != "" && instance.Image != filter.Image {
+			continue
+		}
+		if filter.InstanceType != "" && instance.InstanceType != filter.InstanceType {
+			continue
+		}
+		if len(filter.ExcludeStates) > 0 && containsString(filter.ExcludeStates, instance.State) {
+			continue
+		}
+		if len(filter.ProviderNames) > 0 && !containsString(filter.ProviderNames, instance.ProviderName) {
+			continue
+		}
+		unowned := filter.IncludeUnowned && instance.OwnerTokenID == 0 && instance.Tenant == ""
+		if filter.OwnerTokenID != 0 && instance.OwnerTokenID != filter.OwnerTokenID && !unowned {
+			continue
+		}
+		if filter.Tenant != "" && instance.Tenant != filter.Tenant && !unowned {
+			continue
+		}
+		if !filter.CreatedAfter.IsZero() && !instance.CreatedAt.After(filter.CreatedAfter) {
+			continue
+		}
+		if !filter.CreatedBefore.IsZero() && !instance.CreatedAt.Before(filter.CreatedBefore) {
+			continue
+		}
+		if filter.AfterID != "" && !instanceOrderedAfter(instance, filter.AfterCreatedAt, filter.AfterID) {
+			continue
+		}
+
+		instances = append(instances, instance)
+	}
+
+	sort.Sort(instancesByCreation(instances))
+
+	if filter.Limit > 0 && len(instances) > filter.Limit {
+		instances = instances[:filter.Limit]
+	}
+
+	return instances
+}
+
+func instanceOrderedAfter(instance Instance, createdAt time.Time, id string) bool {
+	if instance.CreatedAt.Equal(createdAt) {
+		return instance.ID > id
+	}
+
+	return instance.CreatedAt.After(createdAt)
+}
+
+type instancesByCreation []Instance
+
+func (s instancesByCreation) Len() int      { return len(s) }
+func (s instancesByCreation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s instancesByCreation) Less(i, j int) bool {
+	return instanceOrderedAfter(s[j], s[i].CreatedAt, s[i].ID)
+}
+
+// UpdateInstance updates the instance with the given ID and increments its
+// version. Returns ErrInstanceNotFound if no instance with that ID exists, or
+// ErrInstanceVersionConflict if the stored version doesn't match.
 func (db *MemoryDatabase) UpdateInstance(instance Instance) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	_, ok := db.instances[instance.ID]
+	existing, ok := db.instances[instance.ID]
 	if !ok {
 		return ErrInstanceNotFound
 		//TODO(emdantrim): log this action
 	}
+	if existing.Version != instance.Version {
+		return ErrInstanceVersionConflict
+	}
 
+	instance.Version++
+	instance.UpdatedAt = time.Now().UTC()
 	db.instances[instance.ID] = instance
 
 	//TODO(emdantrim): log this action
 	return nil
 }
 
-// GetSaltAndHashForTokenID returns the salt and hash for a token with the given
-// ID. Panics if the token doesn't exist.
-func (db *MemoryDatabase) GetSaltAndHashForTokenID(tokenID uint64) ([]byte, []byte, error) {
-	// TODO(sarahhodne): return an error if token doesn't exist
-	token := db.tokens[tokenID]
+// CreateInstanceEvent appends the event to the history of the instance it
+// refers to. Never returns an error.
+func (db *MemoryDatabase) CreateInstanceEvent(event InstanceEvent) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-	return token.Salt, token.Hash, nil
+	event.ID = uint64(len(db.events) + 1)
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+	db.events = append(db.events, event)
+
+	return nil
 }
 
-// InsertToken stores a token with the given description, hash and salt in the
-// database. Never returns an error.
-func (db *MemoryDatabase) InsertToken(description string, hash, salt []byte) (uint64, error) {
+// ListInstanceEvents returns the history of the instance with the given ID,
+// oldest event first. Never returns an error.
+func (db *MemoryDatabase) ListInstanceEvents(instanceID string) ([]InstanceEvent, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	id := uint64(len(db.tokens))
+	var events []InstanceEvent
+	for _, event := range db.events {
+		if event.InstanceID == instanceID {
+			events = append(events, event)
+		}
+	}
 
-	db.tokens = append(db.tokens, memoryToken{
-		Description: description,
-		Hash:        hash,
-		Salt:        salt,
-	})
+	return events, nil
+}
 
-	return id, nil
+// GetToken returns the token with the given ID, or ErrTokenNotFound if it
+// doesn't exist.
+func (db *MemoryDatabase) GetToken(tokenID uint64) (Token, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	token, ok := db.tokens[tokenID]
+	if !ok {
+		return Token{}, ErrTokenNotFound
+	}
+
+	return token, nil
+}
+
+// InsertToken stores the token in the database and returns the ID it generated
+// for it. Never returns an error.
+func (db *MemoryDatabase) InsertToken(token Token) (uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.tokenID++
+	token.ID = db.tokenID
+	token.CreatedAt = time.Now().UTC()
+	db.tokens[token.ID] = token
+
+	return token.ID, nil
+}
+
+// UpdateTokenLastUsed records when the token with the given ID was last used.
+// Returns ErrTokenNotFound if it doesn't exist.
+func (db *MemoryDatabase) UpdateTokenLastUsed(tokenID uint64, lastUsedAt time.Time) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	token, ok := db.tokens[tokenID]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	token.LastUsedAt = lastUsedAt
+	db.tokens[tokenID] = token
+
+	return nil
+}
+
+// ListTokens returns all the tokens, ordered by ID. Never returns an error.
+func (db *MemoryDatabase) ListTokens() ([]Token, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	tokens := make([]Token, 0, len(db.tokens))
+	for _, token := range db.tokens {
+		tokens = append(tokens, token)
+	}
+
+	sort.Sort(tokensByID(tokens))
+
+	return tokens, nil
+}
+
+// RevokeToken marks the token with the given ID as revoked. Returns
+// ErrTokenNotFound if it doesn't exist.
+func (db *MemoryDatabase) RevokeToken(tokenID uint64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	token, ok := db.tokens[tokenID]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	token.Revoked = true
+	db.tokens[tokenID] = token
+
+	return nil
 }
 
-// ListProviders always returns an error. It's not implemented yet, it's just
-// here to implement the database.DB interface.
+// UpdateTokenSecret replaces the salt and hash of the token with the given ID.
+// Returns ErrTokenNotFound if it doesn't exist.
+func (db *MemoryDatabase) UpdateTokenSecret(tokenID uint64, salt, hash []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	token, ok := db.tokens[tokenID]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	token.Salt = salt
+	token.Hash = hash
+	db.tokens[tokenID] = token
+
+	return nil
+}
+
+type tokensByID []Token
+
+func (s tokensByID) Len() int           { return len(s) }
+func (s tokensByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s tokensByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// ListProviders returns the providers in the order they were created. Never
+// returns an error.
 func (db *MemoryDatabase) ListProviders() ([]Provider, error) {
-	return nil, fmt.Errorf("provider listing not implemented for MemoryDatabase")
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return append([]Provider(nil), db.providers...), nil
 }
 
-// CreateProvider always returns an error. It's not implemented yet, it's just
-// here to implement the database.DB interface.
+// CreateProvider stores the provider, generating an ID for it if it doesn't
+// have one. Returns an error if a provider with the same name exists.
 func (db *MemoryDatabase) CreateProvider(provider Provider) (string, error) {
-	return "", fmt.Errorf("provider creation not implemented for MemoryDatabase")
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, existing := range db.providers {
+		if existing.Name == provider.Name {
+			return "", fmt.Errorf("a provider named %s already exists", provider.Name)
+		}
+	}
+
+	if provider.ID == "" {
+		provider.ID = uuid.New()
+	}
+	db.providers = append(db.providers, provider)
+
+	return provider.ID, nil
+}
+
+// GetProviderQuota returns the quota of the provider with the given name, or
+// no quota if there's no such provider. Never returns an error.
+func (db *MemoryDatabase) GetProviderQuota(name string) (Quota, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, provider := range db.providers {
+		if provider.Name == name {
+			return provider.Quota, nil
+		}
+	}
+
+	return Quota{}, nil
+}
+
+// ListProviderTypes returns the type of every provider by name. Never returns
+// an error.
+func (db *MemoryDatabase) ListProviderTypes() (map[string]string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	types := make(map[string]string)
+	for _, provider := range db.providers {
+		types[provider.Name] = provider.Type
+	}
+
+	return types, nil
+}
+
+// Ping always returns nil, since the memory database is always reachable.
+func (db *MemoryDatabase) Ping() error {
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
 }
@@ -1,4 +1,228 @@
 package database
 
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
 // Ensure that MemoryDatabase implements the DB interface
 var _ DB = &MemoryDatabase{}
+
+func TestMemoryDatabaseListInstances(t *testing.T) {
+	db := NewMemoryDatabase()
+	start := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		state := "running"
+		if i == 2 {
+			state = "terminated"
+		}
+
+		id, err := db.CreateInstance(Instance{
+			ProviderName: "gce-staging",
+			Image:        "standard-image",
+			State:        state,
+			CreatedAt:    start.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	instances, err := db.ListInstances(InstanceFilter{State: "running", Limit: 2})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 2 || instances[0].ID != ids[0] || instances[1].ID != ids[1] {
+		t.Fatalf("unexpected first page: %+v", instances)
+	}
+
+	last := instances[len(instances)-1]
+	instances, err = db.ListInstances(InstanceFilter{
+		State:          "running",
+		AfterCreatedAt: last.CreatedAt,
+		AfterID:        last.ID,
+		Limit:          2,
+	})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 2 || instances[0].ID != ids[3] || instances[1].ID != ids[4] {
+		t.Fatalf("unexpected second page: %+v", instances)
+	}
+
+	instances, err = db.ListInstances(InstanceFilter{CreatedBefore: start.Add(90 * time.Second)})
+	if err != nil {
+		t.Fatalf("ListInstances returned error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Errorf("expected 2 instances created before the cutoff, got %d", len(instances))
+	}
+}
+
+func TestMemoryDatabaseUpdateInstanceVersionConflict(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	id, err := db.CreateInstance(Instance{State: "creating"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := db.GetInstance(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance.State = "starting"
+	if err := db.UpdateInstance(instance); err != nil {
+		t.Fatalf("UpdateInstance returned error: %v", err)
+	}
+
+	instance.State = "running"
+	if err := db.UpdateInstance(instance); err != ErrInstanceVersionConflict {
+		t.Errorf("expected ErrInstanceVersionConflict for a stale update, got %v", err)
+	}
+}
+
+func TestMemoryDatabaseCreateInstanceIdempotencyKey(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	id, err := db.CreateInstance(Instance{State: "creating", IdempotencyKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.CreateInstance(Instance{State: "creating", IdempotencyKey: "key"}); err != ErrDuplicateIdempotencyKey {
+		t.Errorf("expected ErrDuplicateIdempotencyKey for a reused key, got %v", err)
+	}
+
+	instance, err := db.GetInstanceByIdempotencyKey("key", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.ID != id {
+		t.Errorf("expected instance %s for the key, got %s", id, instance.ID)
+	}
+}
+
+func TestMemoryDatabaseIdempotencyKeyScope(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	tenantID, err := db.CreateInstance(Instance{State: "creating", IdempotencyKey: "key", OwnerTokenID: 1, Tenant: "org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenID, err := db.CreateInstance(Instance{State: "creating", IdempotencyKey: "key", OwnerTokenID: 2})
+	if err != nil {
+		t.Errorf("expected the key to be reusable by another owner, got %v", err)
+	}
+	if _, err := db.CreateInstance(Instance{State: "creating", IdempotencyKey: "key", OwnerTokenID: 3, Tenant: "org"}); err != ErrDuplicateIdempotencyKey {
+		t.Errorf("expected ErrDuplicateIdempotencyKey for a key reused within a tenant, got %v", err)
+	}
+
+	for _, c := range []struct {
+		ownerTokenID uint64
+		tenant       string
+		id           string
+	}{
+		{3, "org", tenantID},
+		{2, "", tokenID},
+	} {
+		instance, err := db.GetInstanceByIdempotencyKey("key", c.ownerTokenID, c.tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instance.ID != c.id {
+			t.Errorf("expected instance %s for token %d and tenant %q, got %s", c.id, c.ownerTokenID, c.tenant, instance.ID)
+		}
+	}
+
+	if _, err := db.GetInstanceByIdempotencyKey("key", 4, ""); err != ErrInstanceNotFound {
+		t.Errorf("expected ErrInstanceNotFound for another owner, got %v", err)
+	}
+}
+
+func TestMemoryDatabaseRelayOutboxJobs(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	id, err := db.CreateInstanceWithOutboxJob(Instance{State: "creating"}, OutboxJob{JobName: "create"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateOutboxJob(OutboxJob{JobName: "remove", Payload: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	errEnqueue := errors.New("enqueue failed")
+	relayed, err := db.RelayOutboxJobs(10, func(job OutboxJob) error {
+		if job.JobName == "remove" {
+			return errEnqueue
+		}
+		return nil
+	})
+	if err != errEnqueue {
+		t.Errorf("expected the enqueue error, got %v", err)
+	}
+	if relayed != 1 {
+		t.Errorf("expected 1 job to be relayed, got %d", relayed)
+	}
+
+	var jobs []OutboxJob
+	relayed, err = db.RelayOutboxJobs(10, func(job OutboxJob) error {
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed != 1 || len(jobs) != 1 || jobs[0].JobName != "remove" || jobs[0].Payload != id {
+		t.Errorf("expected the failed remove job to be relayed again, got %+v", jobs)
+	}
+}
+
+func TestMemoryDatabaseTokens(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	if _, err := db.GetToken(1); err != ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound for an unknown token, got %v", err)
+	}
+	if err := db.RevokeToken(1); err != ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound when revoking an unknown token, got %v", err)
+	}
+	if err := db.UpdateTokenSecret(1, nil, nil); err != ErrTokenNotFound {
+		t.Errorf("expected ErrTokenNotFound when rotating an unknown token, got %v", err)
+	}
+
+	first, err := db.InsertToken(Token{Description: "first", Salt: []byte("salt"), Hash: []byte("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.InsertToken(Token{Description: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.RevokeToken(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateTokenSecret(first, []byte("new salt"), []byte("new hash")); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := db.ListTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].ID != first || tokens[1].ID != second {
+		t.Fatalf("expected tokens %d and %d in order, got %+v", first, second, tokens)
+	}
+	if !tokens[0].Revoked || string(tokens[0].Hash) != "new hash" {
+		t.Errorf("expected the first token to be revoked and rotated, got %+v", tokens[0])
+	}
+	if tokens[1].Revoked {
+		t.Errorf("expected the second token not to be revoked")
+	}
+}
@@ -3,11 +3,16 @@ package database
 import (
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
 
+	"github.com/lib/pq"
 	"github.com/pborman/uuid"
 )
 
@@ -27,17 +32,202 @@ func NewPostgresDB(encryptionKey [32]byte, db *sql.DB) *PostgresDB {
 	}
 }
 
+// pqUniqueViolation is the PostgreSQL error code for a unique constraint
+// violation.
+const pqUniqueViolation = "23505"
+
+// instanceColumns are the columns selected by the instance queries, in the
+// order expected by scanInstance.
+const instanceColumns = "id, provider_name, image, instance_type, state, ip_address, ssh_key, upstream_id, error_reason, zone, created_at, updated_at, starting_at, running_at, terminating_at, terminated_at, errored_at, version, idempotency_key, owner_token_id, tenant, create_job_id"
+
+// idempotencyScopeExpression is the SQL version of idempotencyScope. It must
+// match the expression of the instances_owner_idempotency_key_idx index, so
+// that the index is used.
+const idempotencyScopeExpression = "COALESCE('tenant:' || tenant, 'token:' || owner_token_id, '')"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanInstance scans a row containing the instanceColumns into an Instance.
+func scanInstance(row rowScanner) (Instance, error) {
+	var instance Instance
+	var ipAddress, sshKey, upstreamID, errorReason, zone, idempotencyKey, tenant, createJobID sql.NullString
+	var startingAt, runningAt, terminatingAt, terminatedAt, erroredAt pq.NullTime
+	var ownerTokenID sql.NullInt64
+	err := row.Scan(
+		&instance.ID,
+		&instance.ProviderName,
+		&instance.Image,
+		&instance.InstanceType,
+		&instance.State,
+		&ipAddress,
+		&sshKey,
+		&upstreamID,
+		&errorReason,
+		&zone,
+		&instance.CreatedAt,
+		&instance.UpdatedAt,
+		&startingAt,
+		&runningAt,
+		&terminatingAt,
+		&terminatedAt,
+		&erroredAt,
+		&instance.Version,
+		&idempotencyKey,
+		&ownerTokenID,
+		&tenant,
+		&createJobID,
+	)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	instance.IPAddress = ipAddress.String
+	instance.PublicSSHKey = sshKey.String
+	instance.UpstreamID = upstreamID.String
+	instance.ErrorReason = errorReason.String
+	instance.Zone = zone.String
+	instance.IdempotencyKey = idempotencyKey.String
+	instance.OwnerTokenID = uint64(ownerTokenID.Int64)
+	instance.Tenant = tenant.String
+	instance.CreateJobID = createJobID.String
+	instance.StartingAt = startingAt.Time
+	instance.RunningAt = runningAt.Time
+	instance.TerminatingAt = terminatingAt.Time
+	instance.TerminatedAt = terminatedAt.Time
+	instance.ErroredAt = erroredAt.Time
+
+	return instance, nil
+}
+
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// quotaColumns are the columns a Quota is stored in, on both the tokens and
+// the providers. They're NULL if there's no limit.
+const quotaColumns = "max_instances, max_premium_instances, max_creates_per_minute"
+
+func nullInt(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v > 0}
+}
+
+// nullQuota is used to scan the quotaColumns.
+type nullQuota struct {
+	maxInstances        sql.NullInt64
+	maxPremiumInstances sql.NullInt64
+	maxCreatesPerMinute sql.NullInt64
+}
+
+func (q *nullQuota) quota() Quota {
+	return Quota{
+		MaxInstances:        int(q.maxInstances.Int64),
+		MaxPremiumInstances: int(q.maxPremiumInstances.Int64),
+		MaxCreatesPerMinute: int(q.maxCreatesPerMinute.Int64),
+	}
+}
+
 // CreateInstance stores the given instance in teh database. A new UUID is
 // generated for it and returned. If an error occurrs, the empty string and the
 // error is returned.
 func (db *PostgresDB) CreateInstance(instance Instance) (string, error) {
+	return insertInstance(db.db, instance)
+}
+
+// CreateInstanceWithOutboxJob stores the given instance in the database
+// together with the outbox job for it, in a single transaction. The generated
+// UUID of the instance is returned. The limits are checked in the same
+// transaction, and a *QuotaExceededError is returned if one is exceeded.
+func (db *PostgresDB) CreateInstanceWithOutboxJob(instance Instance, job OutboxJob, limits []QuotaLimit) (string, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	err = checkQuotaLimits(tx, limits)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	id, err := insertInstance(tx, instance)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	job.Payload = id
+	err = insertOutboxJob(tx, job)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// checkQuotaLimits counts the instances matching each limit, and returns a
+// *QuotaExceededError if there are too many. An advisory lock is taken for the
+// key of each limit first, so concurrent creates can't both pass the check.
+// The locks are released when the transaction ends.
+func checkQuotaLimits(tx *sql.Tx, limits []QuotaLimit) error {
+	var keys []string
+	for _, limit := range limits {
+		if !containsString(keys, limit.Key) {
+			keys = append(keys, limit.Key)
+		}
+	}
+
+	// Always lock in the same order to avoid deadlocks
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "cloudbrain.quota:"+key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, limit := range limits {
+		where, args := instanceConditions(limit.Filter)
+
+		var count int
+		err := tx.QueryRow("SELECT count(*) FROM cloudbrain.instances"+where, args...).Scan(&count)
+		if err != nil {
+			return err
+		}
+
+		if count >= limit.Max {
+			return &QuotaExceededError{Limit: limit}
+		}
+	}
+
+	return nil
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertInstance(db execer, instance Instance) (string, error) {
 	instance.ID = uuid.New()
+	if instance.CreatedAt.IsZero() {
+		instance.CreatedAt = time.Now().UTC()
+	}
+	instance.UpdatedAt = instance.CreatedAt
 
-	_, err := db.db.Exec(
-		"INSERT INTO cloudbrain.instances (id, provider_name, image, state, ip_address, ssh_key, upstream_id, error_reason) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+	_, err := db.Exec(
+		"INSERT INTO cloudbrain.instances ("+instanceColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)",
 		instance.ID,
 		instance.ProviderName,
 		instance.Image,
+		instance.InstanceType,
 		instance.State,
 		sql.NullString{
 			String: instance.IPAddress,
@@ -55,7 +245,38 @@ func (db *PostgresDB) CreateInstance(instance Instance) (string, error) {
 			String: instance.ErrorReason,
 			Valid:  instance.ErrorReason != "",
 		},
+		sql.NullString{
+			String: instance.Zone,
+			Valid:  instance.Zone != "",
+		},
+		instance.CreatedAt,
+		instance.UpdatedAt,
+		nullTime(instance.StartingAt),
+		nullTime(instance.RunningAt),
+		nullTime(instance.TerminatingAt),
+		nullTime(instance.TerminatedAt),
+		nullTime(instance.ErroredAt),
+		instance.Version,
+		sql.NullString{
+			String: instance.IdempotencyKey,
+			Valid:  instance.IdempotencyKey != "",
+		},
+		sql.NullInt64{
+			Int64: int64(instance.OwnerTokenID),
+			Valid: instance.OwnerTokenID != 0,
+		},
+		sql.NullString{
+			String: instance.Tenant,
+			Valid:  instance.Tenant != "",
+		},
+		sql.NullString{
+			String: instance.CreateJobID,
+			Valid:  instance.CreateJobID != "",
+		},
 	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation && pqErr.Constraint == "instances_owner_idempotency_key_idx" {
+		return "", ErrDuplicateIdempotencyKey
+	}
 	if err != nil {
 		return "", err
 	}
@@ -63,6 +284,99 @@ func (db *PostgresDB) CreateInstance(instance Instance) (string, error) {
 	return instance.ID, nil
 }
 
+// CreateOutboxJob stores a job in the outbox, to be enqueued by RelayOutboxJobs.
+func (db *PostgresDB) CreateOutboxJob(job OutboxJob) error {
+	return insertOutboxJob(db.db, job)
+}
+
+func insertOutboxJob(db execer, job OutboxJob) error {
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now().UTC()
+	}
+
+	metadata, err := json.Marshal(job.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO cloudbrain.outbox_jobs (job_name, payload, created_at, metadata) VALUES ($1, $2, $3, $4)",
+		job.JobName,
+		job.Payload,
+		job.CreatedAt,
+		string(metadata),
+	)
+	return err
+}
+
+// RelayOutboxJobs passes up to limit jobs from the outbox to enqueue, oldest
+// first, and deletes the ones enqueue succeeds for. It stops at the first job
+// enqueue fails for, and returns the number of jobs relayed and that error.
+// The jobs are locked while they're being relayed, so several relays can run
+// at the same time. If the deletes fail to commit, the jobs that were already
+// passed to enqueue are relayed again, so the jobs must be safe to run more
+// than once.
+func (db *PostgresDB) RelayOutboxJobs(limit int, enqueue func(OutboxJob) error) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(
+		"SELECT id, job_name, payload, created_at, metadata FROM cloudbrain.outbox_jobs ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED",
+		limit,
+	)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	var jobs []OutboxJob
+	for rows.Next() {
+		var job OutboxJob
+		var metadata []byte
+		err := rows.Scan(&job.ID, &job.JobName, &job.Payload, &job.CreatedAt, &metadata)
+		if err == nil {
+			err = json.Unmarshal(metadata, &job.Metadata)
+		}
+		if err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	relayed := 0
+	var enqueueErr error
+	for _, job := range jobs {
+		enqueueErr = enqueue(job)
+		if enqueueErr != nil {
+			break
+		}
+
+		_, err := tx.Exec("DELETE FROM cloudbrain.outbox_jobs WHERE id = $1", job.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		relayed++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return relayed, enqueueErr
+}
+
 // RemoveInstance deletes the given instance from the database. If an
 // error occurs, the empty string and the error is returned.
 func (db *PostgresDB) RemoveInstance(instance Instance) (string, error) {
@@ -82,20 +396,10 @@ func (db *PostgresDB) RemoveInstance(instance Instance) (string, error) {
 // instance with the given ID exists, ErrInstanceNotFound is returned. If an
 // error occurs, then an empty Instance struct and the error is returned.
 func (db *PostgresDB) GetInstance(id string) (Instance, error) {
-	instance := Instance{ID: id}
-	var ipAddress, sshKey, upstreamID, errorReason sql.NullString
-	err := db.db.QueryRow(
-		"SELECT provider_name, image, state, ip_address, ssh_key, upstream_id, error_reason FROM cloudbrain.instances WHERE id = $1",
+	instance, err := scanInstance(db.db.QueryRow(
+		"SELECT "+instanceColumns+" FROM cloudbrain.instances WHERE id = $1",
 		id,
-	).Scan(
-		&instance.ProviderName,
-		&instance.Image,
-		&instance.State,
-		&ipAddress,
-		&sshKey,
-		&upstreamID,
-		&errorReason,
-	)
+	))
 	if err == sql.ErrNoRows {
 		return Instance{}, ErrInstanceNotFound
 	}
@@ -103,48 +407,102 @@ func (db *PostgresDB) GetInstance(id string) (Instance, error) {
 		return Instance{}, err
 	}
 
-	instance.IPAddress = ipAddress.String
-	instance.PublicSSHKey = sshKey.String
-	instance.UpstreamID = upstreamID.String
-	instance.ErrorReason = errorReason.String
+	return instance, nil
+}
+
+// GetInstanceByIdempotencyKey returns the instance created with the given
+// idempotency key by the given owner from the database. If no such instance
+// exists, ErrInstanceNotFound is returned.
+func (db *PostgresDB) GetInstanceByIdempotencyKey(key string, ownerTokenID uint64, tenant string) (Instance, error) {
+	instance, err := scanInstance(db.db.QueryRow(
+		"SELECT "+instanceColumns+" FROM cloudbrain.instances WHERE "+idempotencyScopeExpression+" = $1 AND idempotency_key = $2",
+		idempotencyScope(ownerTokenID, tenant),
+		key,
+	))
+	if err == sql.ErrNoRows {
+		return Instance{}, ErrInstanceNotFound
+	}
+	if err != nil {
+		return Instance{}, err
+	}
 
 	return instance, nil
 }
 
+// CountInstances returns the number of instances by provider and state.
+func (db *PostgresDB) CountInstances() ([]InstanceCount, error) {
+	rows, err := db.db.Query("SELECT provider_name, state, count(*) FROM cloudbrain.instances GROUP BY provider_name, state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []InstanceCount
+	for rows.Next() {
+		var count InstanceCount
+		err := rows.Scan(&count.ProviderName, &count.State, &count.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
 // GetInstancesByState returns a slice of instances for a given state
 func (db *PostgresDB) GetInstancesByState(state string) ([]Instance, error) {
 	var instances []Instance
 
-	rows, err := db.db.Query("SELECT id, provider_name, image, state, ip_address, ssh_key, upstream_id, error_reason FROM cloudbrain.instances WHERE state = $1", state)
+	rows, err := db.db.Query("SELECT "+instanceColumns+" FROM cloudbrain.instances WHERE state = $1", state)
 	if err != nil {
 		return instances, err
 	}
+	defer rows.Close()
+
 	for rows.Next() {
-		instance := &Instance{}
-		var ipAddress, sshKey, upstreamID, errorReason sql.NullString
-		err := rows.Scan(
-			&instance.ID,
-			&instance.ProviderName,
-			&instance.Image,
-			&instance.State,
-			&ipAddress,
-			&sshKey,
-			&upstreamID,
-			&errorReason,
-		)
-		if err == sql.ErrNoRows {
-			return instances, ErrInstanceNotFound
-		}
+		instance, err := scanInstance(rows)
 		if err != nil {
 			return instances, err
 		}
 
-		instance.IPAddress = ipAddress.String
-		instance.PublicSSHKey = sshKey.String
-		instance.UpstreamID = upstreamID.String
-		instance.ErrorReason = errorReason.String
+		instances = append(instances, instance)
+	}
+	if err := rows.Err(); err != nil {
+		return instances, err
+	}
+
+	return instances, nil
+}
+
+// ListInstances returns the instances matching the given filter, ordered by
+// creation time and then ID.
+func (db *PostgresDB) ListInstances(filter InstanceFilter) ([]Instance, error) {
+	where, args := instanceConditions(filter)
 
-		instances = append(instances, *instance)
+	query := "SELECT " + instanceColumns + " FROM cloudbrain.instances" + where + " ORDER BY created_at, id"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var instances []Instance
+	for rows.Next() {
+		instance, err := scanInstance(rows)
+		if err != nil {
+			return instances, err
+		}
+
+		instances = append(instances, instance)
 	}
 	if err := rows.Err(); err != nil {
 		return instances, err
@@ -153,17 +511,77 @@ func (db *PostgresDB) GetInstancesByState(state string) ([]Instance, error) {
 	return instances, nil
 }
 
+// instanceConditions returns the WHERE clause selecting the instances that
+// match the filter, or an empty string if it matches all instances, and the
+// arguments for its placeholders. The limit of the filter isn't included.
+func instanceConditions(filter InstanceFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, values ...interface{}) {
+		placeholders := make([]interface{}, len(values))
+		for i, value := range values {
+			args = append(args, value)
+			placeholders[i] = len(args)
+		}
+		conditions = append(conditions, fmt.Sprintf(condition, placeholders...))
+	}
+
+	if filter.State != "" {
+		addCondition("state = $%d", filter.State)
+	}
+	if filter.ProviderName != "" {
+		addCondition("provider_name = $%d", filter.ProviderName)
+	}
+	if filter.Image != "" {
+		addCondition("image = $%d", filter.Image)
+	}
+	if filter.InstanceType != "" {
+		addCondition("instance_type = $%d", filter.InstanceType)
+	}
+	if len(filter.ExcludeStates) > 0 {
+		addCondition("state <> ALL($%d)", pq.StringArray(filter.ExcludeStates))
+	}
+	if len(filter.ProviderNames) > 0 {
+		addCondition("provider_name = ANY($%d)", pq.StringArray(filter.ProviderNames))
+	}
+	unowned := ""
+	if filter.IncludeUnowned {
+		unowned = " OR (owner_token_id IS NULL AND tenant IS NULL)"
+	}
+	if filter.OwnerTokenID != 0 {
+		addCondition("(owner_token_id = $%d"+unowned+")", filter.OwnerTokenID)
+	}
+	if filter.Tenant != "" {
+		addCondition("(tenant = $%d"+unowned+")", filter.Tenant)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		addCondition("created_at > $%d", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		addCondition("created_at < $%d", filter.CreatedBefore)
+	}
+	if filter.AfterID != "" {
+		addCondition("(created_at, id) > ($%d, $%d)", filter.AfterCreatedAt, filter.AfterID)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
 // UpdateInstance updates the instane with the given ID in the database to match
-// the given attributes. Returns ErrInstanceNotFound if an instance with the
-// given ID isn't found.
-//
-// BUG(sarahhodne): ErrInstanceNotFound is not returned when an instance with
-// the given ID doesn't exist.
+// the given attributes, and increments its version. Returns
+// ErrInstanceNotFound if an instance with the given ID isn't found, or
+// ErrInstanceVersionConflict if the version in the database doesn't match the
+// version of the given instance.
 func (db *PostgresDB) UpdateInstance(instance Instance) error {
-	_, err := db.db.Exec(
-		"UPDATE cloudbrain.instances SET provider_name = $1, image = $2, state = $3, ip_address = $4, ssh_key = $5, upstream_id = $6, error_reason = $7 WHERE id = $8",
+	result, err := db.db.Exec(
+		"UPDATE cloudbrain.instances SET provider_name = $1, image = $2, instance_type = $3, state = $4, ip_address = $5, ssh_key = $6, upstream_id = $7, error_reason = $8, zone = $9, updated_at = now(), starting_at = $10, running_at = $11, terminating_at = $12, terminated_at = $13, errored_at = $14, create_job_id = $15, version = version + 1 WHERE id = $16 AND version = $17",
 		instance.ProviderName,
 		instance.Image,
+		instance.InstanceType,
 		instance.State,
 		sql.NullString{
 			String: instance.IPAddress,
@@ -181,41 +599,255 @@ func (db *PostgresDB) UpdateInstance(instance Instance) error {
 			String: instance.ErrorReason,
 			Valid:  instance.ErrorReason != "",
 		},
+		sql.NullString{
+			String: instance.Zone,
+			Valid:  instance.Zone != "",
+		},
+		nullTime(instance.StartingAt),
+		nullTime(instance.RunningAt),
+		nullTime(instance.TerminatingAt),
+		nullTime(instance.TerminatedAt),
+		nullTime(instance.ErroredAt),
+		sql.NullString{
+			String: instance.CreateJobID,
+			Valid:  instance.CreateJobID != "",
+		},
 		instance.ID,
+		instance.Version,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = db.db.QueryRow("SELECT EXISTS(SELECT 1 FROM cloudbrain.instances WHERE id = $1)", instance.ID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrInstanceNotFound
+	}
+
+	return ErrInstanceVersionConflict
+}
+
+// CreateInstanceEvent appends the given event to the history of the instance
+// it refers to. If the event has no creation time, the current time is used.
+func (db *PostgresDB) CreateInstanceEvent(event InstanceEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	_, err := db.db.Exec(
+		"INSERT INTO cloudbrain.instance_events (instance_id, state, previous_state, reason, created_at) VALUES ($1, $2, $3, $4, $5)",
+		event.InstanceID,
+		event.State,
+		sql.NullString{
+			String: event.PreviousState,
+			Valid:  event.PreviousState != "",
+		},
+		sql.NullString{
+			String: event.Reason,
+			Valid:  event.Reason != "",
+		},
+		event.CreatedAt,
 	)
 	return err
 }
 
-// GetSaltAndHashForTokenID returns the salt and hash for the token with the
-// given ID.
-//
-// BUG(sarahhodne): Should return a special error if no token with the given
-// ID exists.
-func (db *PostgresDB) GetSaltAndHashForTokenID(tokenID uint64) (salt []byte, hash []byte, err error) {
-	err = db.db.QueryRow(
-		"SELECT token_salt, token_hash FROM cloudbrain.auth_tokens WHERE id = $1",
+// ListInstanceEvents returns the history of the instance with the given ID,
+// oldest event first.
+func (db *PostgresDB) ListInstanceEvents(instanceID string) ([]InstanceEvent, error) {
+	rows, err := db.db.Query(
+		"SELECT id, instance_id, state, previous_state, reason, created_at FROM cloudbrain.instance_events WHERE instance_id = $1 ORDER BY created_at, id",
+		instanceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []InstanceEvent
+	for rows.Next() {
+		var event InstanceEvent
+		var previousState, reason sql.NullString
+		err := rows.Scan(
+			&event.ID,
+			&event.InstanceID,
+			&event.State,
+			&previousState,
+			&reason,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return events, err
+		}
+
+		event.PreviousState = previousState.String
+		event.Reason = reason.String
+
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return events, err
+	}
+
+	return events, nil
+}
+
+// tokenColumns are the columns scanned by scanToken, in order.
+const tokenColumns = "id, description, token_salt, token_hash, scopes, providers, expires_at, revoked, last_used_at, created_at, tenant, " + quotaColumns
+
+func scanToken(row rowScanner) (Token, error) {
+	var token Token
+	var expiresAt, lastUsedAt pq.NullTime
+	var tenant sql.NullString
+	var quota nullQuota
+	err := row.Scan(
+		&token.ID,
+		&token.Description,
+		&token.Salt,
+		&token.Hash,
+		(*pq.StringArray)(&token.Scopes),
+		(*pq.StringArray)(&token.Providers),
+		&expiresAt,
+		&token.Revoked,
+		&lastUsedAt,
+		&token.CreatedAt,
+		&tenant,
+		&quota.maxInstances,
+		&quota.maxPremiumInstances,
+		&quota.maxCreatesPerMinute,
+	)
+	if err != nil {
+		return Token{}, err
+	}
+
+	token.ExpiresAt = expiresAt.Time
+	token.LastUsedAt = lastUsedAt.Time
+	token.Tenant = tenant.String
+	token.Quota = quota.quota()
+
+	return token, nil
+}
+
+// GetToken returns the token with the given ID, or ErrTokenNotFound if it
+// doesn't exist.
+func (db *PostgresDB) GetToken(tokenID uint64) (Token, error) {
+	token, err := scanToken(db.db.QueryRow(
+		"SELECT "+tokenColumns+" FROM cloudbrain.auth_tokens WHERE id = $1",
 		tokenID,
-	).Scan(&salt, &hash)
+	))
+	if err == sql.ErrNoRows {
+		return Token{}, ErrTokenNotFound
+	}
 
-	return salt, hash, err
+	return token, err
 }
 
-// InsertToken inserts a token into the database with the given description, hash
-// and salt.
-func (db *PostgresDB) InsertToken(description string, hash, salt []byte) (uint64, error) {
+// InsertToken inserts the token into the database and returns the ID it was
+// given.
+func (db *PostgresDB) InsertToken(token Token) (uint64, error) {
 	var id uint64
 	err := db.db.QueryRow(
-		"INSERT INTO cloudbrain.auth_tokens (description, token_hash, token_salt) VALUES ($1, $2, $3) RETURNING id",
-		description,
-		hash,
-		salt,
+		"INSERT INTO cloudbrain.auth_tokens (description, token_hash, token_salt, scopes, providers, expires_at, tenant, "+quotaColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		token.Description,
+		token.Hash,
+		token.Salt,
+		stringArray(token.Scopes),
+		stringArray(token.Providers),
+		nullTime(token.ExpiresAt),
+		sql.NullString{
+			String: token.Tenant,
+			Valid:  token.Tenant != "",
+		},
+		nullInt(token.Quota.MaxInstances),
+		nullInt(token.Quota.MaxPremiumInstances),
+		nullInt(token.Quota.MaxCreatesPerMinute),
 	).Scan(&id)
-	// TODO: how bout some dates?
 	if err != nil {
 		return 0, err
 	}
 
-	return id, err
+	return id, nil
+}
+
+// UpdateTokenLastUsed records when the token with the given ID was last used.
+// Returns ErrTokenNotFound if it doesn't exist.
+func (db *PostgresDB) UpdateTokenLastUsed(tokenID uint64, lastUsedAt time.Time) error {
+	return db.updateToken("UPDATE cloudbrain.auth_tokens SET last_used_at = $2 WHERE id = $1", tokenID, lastUsedAt)
+}
+
+// ListTokens returns all the tokens, ordered by ID.
+func (db *PostgresDB) ListTokens() ([]Token, error) {
+	rows, err := db.db.Query("SELECT " + tokenColumns + " FROM cloudbrain.auth_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return tokens, err
+		}
+
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return tokens, err
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken marks the token with the given ID as revoked. Returns
+// ErrTokenNotFound if it doesn't exist.
+func (db *PostgresDB) RevokeToken(tokenID uint64) error {
+	return db.updateToken("UPDATE cloudbrain.auth_tokens SET revoked = true WHERE id = $1", tokenID)
+}
+
+// UpdateTokenSecret replaces the salt and hash of the token with the given ID.
+// Returns ErrTokenNotFound if it doesn't exist.
+func (db *PostgresDB) UpdateTokenSecret(tokenID uint64, salt, hash []byte) error {
+	return db.updateToken("UPDATE cloudbrain.auth_tokens SET token_salt = $2, token_hash = $3 WHERE id = $1", tokenID, salt, hash)
+}
+
+// updateToken runs the update query for the token with the ID given as the
+// first argument, and returns ErrTokenNotFound if there's no such token.
+func (db *PostgresDB) updateToken(query string, tokenID uint64, args ...interface{}) error {
+	result, err := db.db.Exec(query, append([]interface{}{tokenID}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// stringArray returns the value for a TEXT[] column, using an empty array
+// rather than NULL for a nil slice.
+func stringArray(values []string) pq.StringArray {
+	if values == nil {
+		return pq.StringArray{}
+	}
+	return pq.StringArray(values)
 }
 
 // ListProviders returns a list of all the providers and their configurations.
@@ -223,7 +855,7 @@ func (db *PostgresDB) InsertToken(description string, hash, salt []byte) (uint64
 // A valid encryption key must have been provided to NewPostgresDB for this to
 // work, or an error will always be returned.
 func (db *PostgresDB) ListProviders() ([]Provider, error) {
-	rows, err := db.db.Query("SELECT id, type, name, config FROM cloudbrain.providers")
+	rows, err := db.db.Query("SELECT id, type, name, config, max_lifetime_seconds, " + quotaColumns + " FROM cloudbrain.providers")
 	if err != nil {
 		return nil, err
 	}
@@ -233,10 +865,14 @@ func (db *PostgresDB) ListProviders() ([]Provider, error) {
 	for rows.Next() {
 		var provider Provider
 		var encryptedConfig []byte
-		err := rows.Scan(&provider.ID, &provider.Type, &provider.Name, &encryptedConfig)
+		var maxLifetimeSeconds sql.NullInt64
+		var quota nullQuota
+		err := rows.Scan(&provider.ID, &provider.Type, &provider.Name, &encryptedConfig, &maxLifetimeSeconds, &quota.maxInstances, &quota.maxPremiumInstances, &quota.maxCreatesPerMinute)
 		if err != nil {
 			return nil, err
 		}
+		provider.MaxLifetime = time.Duration(maxLifetimeSeconds.Int64) * time.Second
+		provider.Quota = quota.quota()
 
 		var ok bool
 		provider.Config, ok = db.decrypt(encryptedConfig)
@@ -266,11 +902,18 @@ func (db *PostgresDB) CreateProvider(provider Provider) (string, error) {
 	encryptedConfig := db.encrypt(provider.Config)
 
 	_, err := db.db.Exec(
-		"INSERT INTO cloudbrain.providers (id, type, name, config) VALUES ($1, $2, $3, $4)",
+		"INSERT INTO cloudbrain.providers (id, type, name, config, max_lifetime_seconds, "+quotaColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
 		provider.ID,
 		provider.Type,
 		provider.Name,
 		encryptedConfig,
+		sql.NullInt64{
+			Int64: int64(provider.MaxLifetime / time.Second),
+			Valid: provider.MaxLifetime > 0,
+		},
+		nullInt(provider.Quota.MaxInstances),
+		nullInt(provider.Quota.MaxPremiumInstances),
+		nullInt(provider.Quota.MaxCreatesPerMinute),
 	)
 	if err != nil {
 		return "", err
@@ -279,23 +922,75 @@ func (db *PostgresDB) CreateProvider(provider Provider) (string, error) {
 	return provider.ID, nil
 }
 
+// GetProviderQuota returns the quota of the provider with the given name, or no
+// quota if there's no such provider. The config isn't decrypted, so this works
+// without an encryption key.
+func (db *PostgresDB) GetProviderQuota(name string) (Quota, error) {
+	var quota nullQuota
+	err := db.db.QueryRow(
+		"SELECT "+quotaColumns+" FROM cloudbrain.providers WHERE name = $1",
+		name,
+	).Scan(&quota.maxInstances, &quota.maxPremiumInstances, &quota.maxCreatesPerMinute)
+	if err == sql.ErrNoRows {
+		return Quota{}, nil
+	}
+	if err != nil {
+		return Quota{}, err
+	}
+
+	return quota.quota(), nil
+}
+
+// ListProviderTypes returns the type of every provider by name. The configs
+// aren't decrypted, so this works without an encryption key.
+func (db *PostgresDB) ListProviderTypes() (map[string]string, error) {
+	rows, err := db.db.Query("SELECT name, type FROM cloudbrain.providers")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, providerType string
+		if err := rows.Scan(&name, &providerType); err != nil {
+			return nil, err
+		}
+		types[name] = providerType
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return types, nil
+}
+
 // GetProviderByName fetches a provider and decrypts the config
 func (db *PostgresDB) GetProviderByName(id string) (*Provider, error) {
 	provider := &Provider{}
 	var config []byte
+	var maxLifetimeSeconds sql.NullInt64
+	var quota nullQuota
 
 	err := db.db.QueryRow(
-		"SELECT id, name, type, config FROM cloudbrain.providers WHERE name = $1",
+		"SELECT id, name, type, config, max_lifetime_seconds, "+quotaColumns+" FROM cloudbrain.providers WHERE name = $1",
 		id,
 	).Scan(
 		&provider.ID,
 		&provider.Name,
 		&provider.Type,
 		&config,
+		&maxLifetimeSeconds,
+		&quota.maxInstances,
+		&quota.maxPremiumInstances,
+		&quota.maxCreatesPerMinute,
 	)
 	if err != nil {
 		return nil, err
 	}
+	provider.MaxLifetime = time.Duration(maxLifetimeSeconds.Int64) * time.Second
+	provider.Quota = quota.quota()
 
 	config, valid := db.decrypt(config)
 	if !valid {
@@ -338,3 +1033,9 @@ func (db *PostgresDB) encrypt(plaintext []byte) []byte {
 
 	return append(nonce[:], out...)
 }
+
+// Ping checks that the database is reachable, establishing a connection if
+// needed.
+func (db *PostgresDB) Ping() error {
+	return db.db.Ping()
+}
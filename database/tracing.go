@@ -0,0 +1,240 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/tracing"
+)
+
+// WithTracing returns a DB that records a span for every call to the given DB,
+// as a child of the current span in the given context.
+func WithTracing(ctx context.Context, db DB) DB {
+	return &tracedDB{DB: db, ctx: ctx}
+}
+
+type tracedDB struct {
+	DB
+	ctx context.Context
+}
+
+func (db *tracedDB) startSpan(name string) *tracing.Span {
+	_, span := tracing.StartSpan(db.ctx, "db."+name)
+	return span
+}
+
+func (db *tracedDB) CreateInstance(instance Instance) (string, error) {
+	span := db.startSpan("CreateInstance")
+	defer span.End()
+
+	result, err := db.DB.CreateInstance(instance)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) CreateInstanceWithOutboxJob(instance Instance, job OutboxJob, limits []QuotaLimit) (string, error) {
+	span := db.startSpan("CreateInstanceWithOutboxJob")
+	defer span.End()
+
+	result, err := db.DB.CreateInstanceWithOutboxJob(instance, job, limits)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) CreateOutboxJob(job OutboxJob) error {
+	span := db.startSpan("CreateOutboxJob")
+	defer span.End()
+
+	err := db.DB.CreateOutboxJob(job)
+	span.SetError(err)
+	return err
+}
+
+func (db *tracedDB) RelayOutboxJobs(limit int, enqueue func(OutboxJob) error) (int, error) {
+	span := db.startSpan("RelayOutboxJobs")
+	defer span.End()
+
+	relayed, err := db.DB.RelayOutboxJobs(limit, enqueue)
+	span.SetError(err)
+	return relayed, err
+}
+
+func (db *tracedDB) RemoveInstance(instance Instance) (string, error) {
+	span := db.startSpan("RemoveInstance")
+	defer span.End()
+
+	result, err := db.DB.RemoveInstance(instance)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) GetInstance(id string) (Instance, error) {
+	span := db.startSpan("GetInstance")
+	defer span.End()
+
+	result, err := db.DB.GetInstance(id)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) GetInstanceByIdempotencyKey(key string, ownerTokenID uint64, tenant string) (Instance, error) {
+	span := db.startSpan("GetInstanceByIdempotencyKey")
+	defer span.End()
+
+	result, err := db.DB.GetInstanceByIdempotencyKey(key, ownerTokenID, tenant)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) GetInstancesByState(state string) ([]Instance, error) {
+	span := db.startSpan("GetInstancesByState")
+	defer span.End()
+
+	result, err := db.DB.GetInstancesByState(state)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) ListInstances(filter InstanceFilter) ([]Instance, error) {
+	span := db.startSpan("ListInstances")
+	defer span.End()
+
+	result, err := db.DB.ListInstances(filter)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) CountInstances() ([]InstanceCount, error) {
+	span := db.startSpan("CountInstances")
+	defer span.End()
+
+	result, err := db.DB.CountInstances()
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) UpdateInstance(instance Instance) error {
+	span := db.startSpan("UpdateInstance")
+	defer span.End()
+
+	err := db.DB.UpdateInstance(instance)
+	span.SetError(err)
+	return err
+}
+
+func (db *tracedDB) CreateInstanceEvent(event InstanceEvent) error {
+	span := db.startSpan("CreateInstanceEvent")
+	defer span.End()
+
+	err := db.DB.CreateInstanceEvent(event)
+	span.SetError(err)
+	return err
+}
+
+func (db *tracedDB) ListInstanceEvents(instanceID string) ([]InstanceEvent, error) {
+	span := db.startSpan("ListInstanceEvents")
+	defer span.End()
+
+	result, err := db.DB.ListInstanceEvents(instanceID)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) GetToken(tokenID uint64) (Token, error) {
+	span := db.startSpan("GetToken")
+	defer span.End()
+
+	token, err := db.DB.GetToken(tokenID)
+	span.SetError(err)
+	return token, err
+}
+
+func (db *tracedDB) InsertToken(token Token) (uint64, error) {
+	span := db.startSpan("InsertToken")
+	defer span.End()
+
+	id, err := db.DB.InsertToken(token)
+	span.SetError(err)
+	return id, err
+}
+
+func (db *tracedDB) UpdateTokenLastUsed(tokenID uint64, lastUsedAt time.Time) error {
+	span := db.startSpan("UpdateTokenLastUsed")
+	defer span.End()
+
+	err := db.DB.UpdateTokenLastUsed(tokenID, lastUsedAt)
+	span.SetError(err)
+	return err
+}
+
+func (db *tracedDB) ListTokens() ([]Token, error) {
+	span := db.startSpan("ListTokens")
+	defer span.End()
+
+	tokens, err := db.DB.ListTokens()
+	span.SetError(err)
+	return tokens, err
+}
+
+func (db *tracedDB) RevokeToken(tokenID uint64) error {
+	span := db.startSpan("RevokeToken")
+	defer span.End()
+
+	err := db.DB.RevokeToken(tokenID)
+	span.SetError(err)
+	return err
+}
+
+func (db *tracedDB) UpdateTokenSecret(tokenID uint64, salt, hash []byte) error {
+	span := db.startSpan("UpdateTokenSecret")
+	defer span.End()
+
+	err := db.DB.UpdateTokenSecret(tokenID, salt, hash)
+	span.SetError(err)
+	return err
+}
+
+func (db *tracedDB) ListProviders() ([]Provider, error) {
+	span := db.startSpan("ListProviders")
+	defer span.End()
+
+	result, err := db.DB.ListProviders()
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) GetProviderQuota(name string) (Quota, error) {
+	span := db.startSpan("GetProviderQuota")
+	defer span.End()
+
+	result, err := db.DB.GetProviderQuota(name)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) ListProviderTypes() (map[string]string, error) {
+	span := db.startSpan("ListProviderTypes")
+	defer span.End()
+
+	result, err := db.DB.ListProviderTypes()
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) CreateProvider(provider Provider) (string, error) {
+	span := db.startSpan("CreateProvider")
+	defer span.End()
+
+	result, err := db.DB.CreateProvider(provider)
+	span.SetError(err)
+	return result, err
+}
+
+func (db *tracedDB) Ping() error {
+	span := db.startSpan("Ping")
+	defer span.End()
+
+	err := db.DB.Ping()
+	span.SetError(err)
+	return err
+}
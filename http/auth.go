@@ -2,13 +2,18 @@ package http
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/travis-ci/cloud-brain/cbcontext"
 	"github.com/travis-ci/cloud-brain/cloudbrain"
 )
 
+// authWrapper authenticates requests with a token, and checks that the token
+// has the scope needed for the request. The token is stored in the request
+// context for the wrapped handler.
 type authWrapper struct {
 	core    *cloudbrain.Core
 	handler http.Handler
@@ -45,16 +50,40 @@ func (aw *authWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	validToken, err := aw.core.CheckToken(tokenID, components[1])
-	if err != nil {
-		respondError(aw.ctx, w, http.StatusUnauthorized, errInvalidToken)
+	token, err := aw.core.CheckToken(r.Context(), tokenID, components[1])
+	switch err {
+	case nil:
+	case cloudbrain.ErrInvalidToken, cloudbrain.ErrTokenRevoked, cloudbrain.ErrTokenExpired:
+		respondError(aw.ctx, w, http.StatusUnauthorized, err)
+		return
+	default:
+		cbcontext.CaptureError(aw.ctx, err)
+		respondError(aw.ctx, w, http.StatusInternalServerError, errFetchingToken)
 		return
 	}
 
-	if !validToken {
-		respondError(aw.ctx, w, http.StatusUnauthorized, errInvalidToken)
+	if scope := requiredScope(r); scope != "" && !token.HasScope(scope) {
+		respondError(aw.ctx, w, http.StatusForbidden, fmt.Errorf("token doesn't have the %s scope", scope))
 		return
 	}
 
-	aw.handler.ServeHTTP(w, r)
+	aw.handler.ServeHTTP(w, r.WithContext(cloudbrain.FromToken(r.Context(), token)))
+}
+
+// requiredScope returns the scope a token needs to make the request. The
+// providers a token can be used with are checked by the Core, since it knows
+// which provider an instance is on.
+func requiredScope(r *http.Request) string {
+	if r.URL.Path == "/instances" || strings.HasPrefix(r.URL.Path, "/instances/") {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return cloudbrain.ScopeInstancesRead
+		}
+		return cloudbrain.ScopeInstancesWrite
+	}
+
+	if r.URL.Path == "/tokens" || strings.HasPrefix(r.URL.Path, "/tokens/") {
+		return cloudbrain.ScopeTokensAdmin
+	}
+
+	return ""
 }
@@ -6,29 +6,130 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/travis-ci/cloud-brain/cbcontext"
 	"github.com/travis-ci/cloud-brain/cloudbrain"
+	"github.com/travis-ci/cloud-brain/metrics"
+	"github.com/travis-ci/cloud-brain/tracing"
 )
 
 var (
 	errAuthorizationHeaderRequired = fmt.Errorf("authorization header required")
-	errInvalidToken                = fmt.Errorf("invalid token")
 	errNonNumericalTokenID         = fmt.Errorf("invalid token (token ID must be numerical)")
 	errFetchingToken               = fmt.Errorf("error fetching token")
 )
 
-// Handler returns an http.Handler for the API.
+// Handler returns an http.Handler for the API. Everything but /healthz and
+// /readyz requires authentication. The metrics aren't served here, since the
+// API is public, see ListenAndServeStatus.
 func Handler(ctx context.Context, core *cloudbrain.Core, authTokens []string) http.Handler {
 	mux := http.NewServeMux()
 	mux.Handle("/instances/", handleInstances(ctx, core))
 	mux.Handle("/instances", handleInstances(ctx, core))
+	mux.Handle("/tokens/", handleTokens(ctx, core))
+	mux.Handle("/tokens", handleTokens(ctx, core))
 
-	return &authWrapper{
+	rootMux := http.NewServeMux()
+	rootMux.Handle("/healthz", handleHealthz(ctx, nil))
+	rootMux.Handle("/readyz", handleReadyz(ctx, core, false))
+	rootMux.Handle("/", &authWrapper{
 		core:    core,
 		handler: mux,
 		ctx:     ctx,
+	})
+
+	return instrumentHandler(rootMux)
+}
+
+// instrumentHandler wraps the handler so that the duration and status of every
+// request is recorded in the request metrics, and every request is traced. A
+// traceparent header on the request is used as the parent of the trace.
+func instrumentHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := metricsRoute(r.URL.Path)
+
+		ctx := tracing.FromTraceparent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := tracing.StartSpan(ctx, r.Method+" "+route)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+
+		metrics.HTTPRequestDuration.WithLabelValues(
+			route,
+			r.Method,
+			strconv.Itoa(sw.status),
+		).Observe(time.Since(start).Seconds())
+
+		span.SetAttribute("http.status_code", strconv.Itoa(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("request failed with status %d", sw.status))
+		}
+		span.End()
+	})
+}
+
+// metricsRoute returns the route pattern matching the path, so that instance IDs
+// don't end up in the metric labels.
+func metricsRoute(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1 && (parts[0] == "instances" || parts[0] == "healthz" || parts[0] == "readyz"):
+		return "/" + parts[0]
+	case len(parts) == 2 && parts[0] == "instances":
+		return "/instances/:id"
+	case len(parts) == 3 && parts[0] == "instances" && parts[2] == "events":
+		return "/instances/:id/events"
+	case len(parts) == 1 && parts[0] == "tokens":
+		return "/tokens"
+	case len(parts) == 2 && parts[0] == "tokens":
+		return "/tokens/:id"
+	case len(parts) == 3 && parts[0] == "tokens" && parts[2] == "rotate":
+		return "/tokens/:id/rotate"
+	}
+
+	return "other"
+}
+
+// statusResponseWriter records the status code written to it.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// requestContext returns a context with the given context as its parent, that
+// contains the request ID, the authenticated token, the caller and the
+// trace span of the request.
+func requestContext(ctx context.Context, r *http.Request) context.Context {
+	ctx = cbcontext.FromRequestID(ctx, r.Header.Get("X-Request-ID"))
+
+	if token, ok := cloudbrain.TokenFromContext(r.Context()); ok {
+		ctx = cloudbrain.FromToken(ctx, token)
 	}
+	if sc, ok := tracing.SpanContextFromContext(r.Context()); ok {
+		ctx = tracing.ContextWithSpanContext(ctx, sc)
+	}
+
+	remoteAddr := r.RemoteAddr
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		remoteAddr = strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+
+	return cbcontext.FromCaller(ctx, cbcontext.Caller{
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: remoteAddr,
+	})
 }
 
 func parseRequest(ctx context.Context, r *http.Request, out interface{}) error {
@@ -0,0 +1,23 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/travis-ci/cloud-brain/cloudbrain"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+func TestHandlerDoesntServeMetrics(t *testing.T) {
+	core := cloudbrain.NewCore(database.NewMemoryDatabase(), nil, "")
+	handler := Handler(context.TODO(), core, nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected /metrics to require authentication on the API, got %d", w.Code)
+	}
+}
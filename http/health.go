@@ -0,0 +1,108 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/cloudbrain"
+	"github.com/travis-ci/cloud-brain/metrics"
+)
+
+// A HealthResponse is returned by /healthz and /readyz. Checks maps the name
+// of each check to "ok" or the error it failed with.
+type HealthResponse struct {
+	Status    string            `json:"status"`
+	Checks    map[string]string `json:"checks,omitempty"`
+	Providers []string          `json:"providers,omitempty"`
+}
+
+// handleHealthz reports whether the process is alive. The API is alive as long
+// as it can respond, the workers are alive as long as their heartbeat is
+// recent.
+func handleHealthz(ctx context.Context, heartbeat *cloudbrain.Heartbeat) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := &HealthResponse{Status: "ok"}
+
+		if err := heartbeat.Check(); err != nil {
+			cbcontext.LoggerFromContext(ctx).WithField("err", err).Warn("liveness check failed")
+
+			resp.Status = "unavailable"
+			resp.Checks = map[string]string{"heartbeat": err.Error()}
+			respondHealth(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+
+		respondHealth(w, http.StatusOK, resp)
+	})
+}
+
+// handleReadyz reports whether the database, Redis and the providers are
+// available. If loadProviders is true, the providers must have been loaded
+// with their configurations, see Core.Ready.
+func handleReadyz(ctx context.Context, core *cloudbrain.Core, loadProviders bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := core.Ready(r.Context(), loadProviders)
+
+		resp := &HealthResponse{
+			Status:    "ok",
+			Checks:    make(map[string]string),
+			Providers: readiness.Providers,
+		}
+		for _, check := range readiness.Checks {
+			if check.Err != nil {
+				cbcontext.LoggerFromContext(ctx).WithFields(logrus.Fields{
+					"err":   check.Err,
+					"check": check.Name,
+				}).Warn("readiness check failed")
+
+				resp.Checks[check.Name] = check.Err.Error()
+				continue
+			}
+
+			resp.Checks[check.Name] = "ok"
+		}
+
+		if !readiness.Ready() {
+			resp.Status = "unavailable"
+			respondHealth(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+
+		respondHealth(w, http.StatusOK, resp)
+	})
+}
+
+// respondHealth writes the response without logging it, since load balancers
+// probe the health endpoints every few seconds.
+func respondHealth(w http.ResponseWriter, status int, resp *HealthResponse) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ListenAndServeStatus serves the metrics on /metrics, the liveness check
+// backed by the heartbeat on /healthz and, if core isn't nil, the readiness
+// check on /readyz on the given address in the background. It's used by the
+// workers, which don't have an HTTP server of their own, and by the API to
+// keep the metrics off its public address. Does nothing if the address is
+// empty.
+func ListenAndServeStatus(ctx context.Context, addr string, core *cloudbrain.Core, heartbeat *cloudbrain.Heartbeat) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", handleHealthz(ctx, heartbeat))
+	if core != nil {
+		mux.Handle("/readyz", handleReadyz(ctx, core, true))
+	}
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		cbcontext.LoggerFromContext(ctx).WithField("err", err).Error("status listener stopped")
+	}()
+}
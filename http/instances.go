@@ -2,27 +2,46 @@ package http
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/cloud"
 	"github.com/travis-ci/cloud-brain/cloudbrain"
 )
 
 var (
-	errCouldntGetInstance = fmt.Errorf("couldn't get instance")
-	errNoURLPrefix        = fmt.Errorf("no url prefix")
-	errNoURLPath          = fmt.Errorf("no path in url")
-	errInstanceIsNil      = fmt.Errorf("instance is nil")
+	errCouldntGetInstance  = fmt.Errorf("couldn't get instance")
+	errNoURLPrefix         = fmt.Errorf("no url prefix")
+	errNoURLPath           = fmt.Errorf("no path in url")
+	errInstanceIsNil       = fmt.Errorf("instance is nil")
+	errInvalidInstanceType = fmt.Errorf("invalid instance type, must be %q or %q", cloud.InstanceTypeStandard, cloud.InstanceTypePremium)
+	errInvalidCursor       = fmt.Errorf("invalid cursor")
+	errInvalidLimit        = fmt.Errorf("invalid limit, must be between 1 and %d", maxListLimit)
+	errIdempotencyKeyLong  = fmt.Errorf("idempotency key can be at most %d characters", maxIdempotencyKeyLength)
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	maxIdempotencyKeyLength = 255
 )
 
 func handleInstances(ctx context.Context, core *cloudbrain.Core) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx = cbcontext.FromRequestID(ctx, r.Header.Get("X-Request-ID"))
+		ctx := requestContext(ctx, r)
 
 		switch r.Method {
 		case "GET":
+			if r.URL.Path == "/instances" || r.URL.Path == "/instances/" {
+				handleInstancesList(ctx, core, w, r)
+				return
+			}
 			handleInstancesGet(ctx, core, w, r)
 		case "POST":
 			handleInstancesPost(ctx, core, w, r)
@@ -47,7 +66,9 @@ func handleInstancesGet(ctx context.Context, core *cloudbrain.Core, w http.Respo
 		return
 	}
 
-	instance, err := core.GetInstance(ctx, path)
+	id := strings.TrimSuffix(path, "/events")
+
+	instance, err := core.GetInstance(ctx, id)
 	if err != nil {
 		cbcontext.CaptureError(ctx, err)
 		respondError(ctx, w, http.StatusInternalServerError, err)
@@ -58,7 +79,12 @@ func handleInstancesGet(ctx context.Context, core *cloudbrain.Core, w http.Respo
 		return
 	}
 
-	if instance.State == "terminated" {
+	if id != path {
+		handleInstanceEventsGet(ctx, core, w, instance)
+		return
+	}
+
+	if instance.State == cloudbrain.InstanceStateTerminated {
 		respondStatus(ctx, w, http.StatusGone, instanceToResponse(instance))
 		return
 	}
@@ -66,6 +92,125 @@ func handleInstancesGet(ctx context.Context, core *cloudbrain.Core, w http.Respo
 	respondOk(ctx, w, instanceToResponse(instance))
 }
 
+func handleInstanceEventsGet(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter, instance *cloudbrain.Instance) {
+	events, err := core.ListInstanceEvents(ctx, instance.ID)
+	if err != nil {
+		cbcontext.CaptureError(ctx, err)
+		respondError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body := &InstanceEventsResponse{Events: make([]*InstanceEventResponse, 0, len(events))}
+	for _, event := range events {
+		eventResponse := &InstanceEventResponse{
+			State:     event.State,
+			CreatedAt: event.CreatedAt,
+		}
+		if event.PreviousState != "" {
+			eventResponse.PreviousState = &event.PreviousState
+		}
+		if event.Reason != "" {
+			eventResponse.Reason = &event.Reason
+		}
+
+		body.Events = append(body.Events, eventResponse)
+	}
+
+	respondOk(ctx, w, body)
+}
+
+// handleInstancesList lists the instances matching the filters in the query
+// string. Pages are chained together with the opaque next_cursor value.
+func handleInstancesList(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	attr := cloudbrain.ListInstancesAttributes{
+		State:        query.Get("state"),
+		ProviderName: query.Get("provider"),
+		Image:        query.Get("image"),
+		Limit:        defaultListLimit,
+	}
+
+	var err error
+	if v := query.Get("created_after"); v != "" {
+		attr.CreatedAfter, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid created_after, must be an RFC 3339 time"))
+			return
+		}
+	}
+	if v := query.Get("created_before"); v != "" {
+		attr.CreatedBefore, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondError(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid created_before, must be an RFC 3339 time"))
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		attr.Limit, err = strconv.Atoi(v)
+		if err != nil || attr.Limit < 1 || attr.Limit > maxListLimit {
+			respondError(ctx, w, http.StatusBadRequest, errInvalidLimit)
+			return
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		attr.AfterCreatedAt, attr.AfterID, err = decodeCursor(v)
+		if err != nil {
+			respondError(ctx, w, http.StatusBadRequest, errInvalidCursor)
+			return
+		}
+	}
+
+	limit := attr.Limit
+	// Fetch one extra instance to know whether there's another page
+	attr.Limit++
+
+	instances, err := core.ListInstances(ctx, attr)
+	if err != nil {
+		cbcontext.CaptureError(ctx, err)
+		respondError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body := &InstanceListResponse{Instances: make([]*InstanceResponse, 0, len(instances))}
+	if len(instances) > limit {
+		instances = instances[:limit]
+		last := instances[len(instances)-1]
+		cursor := encodeCursor(last.CreatedAt, last.ID)
+		body.NextCursor = &cursor
+	}
+	for _, instance := range instances {
+		body.Instances = append(body.Instances, instanceToResponse(instance))
+	}
+
+	respondOk(ctx, w, body)
+}
+
+// encodeCursor returns an opaque cursor pointing after the instance with the
+// given creation time and ID.
+func encodeCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "," + id))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	parts := strings.SplitN(string(decoded), ",", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return time.Time{}, "", errInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	return createdAt, parts[1], nil
+}
+
 func handleInstancesPost(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter, r *http.Request) {
 	var req CreateInstanceRequest
 
@@ -74,11 +219,34 @@ func handleInstancesPost(ctx context.Context, core *cloudbrain.Core, w http.Resp
 		return
 	}
 
+	if req.InstanceType != "" && !cloud.InstanceType(req.InstanceType).Valid() {
+		respondError(ctx, w, http.StatusBadRequest, errInvalidInstanceType)
+		return
+	}
+
+	if len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+		respondError(ctx, w, http.StatusBadRequest, errIdempotencyKeyLong)
+		return
+	}
+
 	instance, err := core.CreateInstance(ctx, req.Provider, cloudbrain.CreateInstanceAttributes{
-		ImageName:    req.Image,
-		InstanceType: req.InstanceType,
-		PublicSSHKey: req.PublicSSHKey,
+		ImageName:      req.Image,
+		InstanceType:   req.InstanceType,
+		PublicSSHKey:   req.PublicSSHKey,
+		IdempotencyKey: req.IdempotencyKey,
 	})
+	if err == cloudbrain.ErrIdempotencyKeyReused {
+		respondError(ctx, w, http.StatusConflict, err)
+		return
+	}
+	if err == cloudbrain.ErrProviderNotAllowed {
+		respondError(ctx, w, http.StatusForbidden, err)
+		return
+	}
+	if _, ok := err.(*cloudbrain.QuotaExceededError); ok {
+		respondError(ctx, w, http.StatusTooManyRequests, err)
+		return
+	}
 	if err != nil {
 		cbcontext.CaptureError(ctx, err)
 		respondError(ctx, w, http.StatusInternalServerError, err)
@@ -114,6 +282,10 @@ func handleInstancesDelete(ctx context.Context, core *cloudbrain.Core, w http.Re
 	err = core.RemoveInstance(ctx, cloudbrain.DeleteInstanceAttributes{
 		InstanceID: instance.ID,
 	})
+	if err == cloudbrain.ErrNotInstanceOwner || err == cloudbrain.ErrProviderNotAllowed {
+		respondError(ctx, w, http.StatusNotFound, errInstanceIsNil)
+		return
+	}
 	if err != nil {
 		cbcontext.CaptureError(ctx, err)
 		respondError(ctx, w, http.StatusInternalServerError, err)
@@ -128,7 +300,16 @@ func instanceToResponse(instance *cloudbrain.Instance) *InstanceResponse {
 		ID:           instance.ID,
 		ProviderName: instance.ProviderName,
 		Image:        instance.Image,
-		State:        instance.State,
+		InstanceType: instance.InstanceType,
+		State:        string(instance.State),
+		CreatedAt:    instance.CreatedAt,
+		UpdatedAt:    instance.UpdatedAt,
+
+		StartingAt:    timeOrNil(instance.StartingAt),
+		RunningAt:     timeOrNil(instance.RunningAt),
+		TerminatingAt: timeOrNil(instance.TerminatingAt),
+		TerminatedAt:  timeOrNil(instance.TerminatedAt),
+		ErroredAt:     timeOrNil(instance.ErroredAt),
 	}
 	if instance.IPAddress != "" {
 		body.IPAddress = &instance.IPAddress
@@ -139,20 +320,70 @@ func instanceToResponse(instance *cloudbrain.Instance) *InstanceResponse {
 	if instance.ErrorReason != "" {
 		body.ErrorReason = &instance.ErrorReason
 	}
+	if instance.Zone != "" {
+		body.Zone = &instance.Zone
+	}
+	if instance.OwnerTokenID != 0 {
+		body.OwnerTokenID = &instance.OwnerTokenID
+	}
+	if instance.Tenant != "" {
+		body.Tenant = &instance.Tenant
+	}
 
 	return body
 }
 
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
 // An InstanceResponse is returned by the HTTP API that contains information
 // about an instance.
 type InstanceResponse struct {
-	ID           string  `json:"id"`
-	ProviderName string  `json:"provider"`
-	Image        string  `json:"image"`
-	IPAddress    *string `json:"ip_address"`
-	UpstreamID   *string `json:"upstream_id"`
-	ErrorReason  *string `json:"error_reason"`
-	State        string  `json:"state"`
+	ID           string    `json:"id"`
+	ProviderName string    `json:"provider"`
+	Image        string    `json:"image"`
+	InstanceType string    `json:"instance_type"`
+	IPAddress    *string   `json:"ip_address"`
+	UpstreamID   *string   `json:"upstream_id"`
+	ErrorReason  *string   `json:"error_reason"`
+	Zone         *string   `json:"zone"`
+	OwnerTokenID *uint64   `json:"owner_token_id"`
+	Tenant       *string   `json:"tenant"`
+	State        string    `json:"state"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	StartingAt    *time.Time `json:"starting_at"`
+	RunningAt     *time.Time `json:"running_at"`
+	TerminatingAt *time.Time `json:"terminating_at"`
+	TerminatedAt  *time.Time `json:"terminated_at"`
+	ErroredAt     *time.Time `json:"errored_at"`
+}
+
+// An InstanceEventsResponse is returned by the HTTP API when getting the
+// history of an instance.
+type InstanceEventsResponse struct {
+	Events []*InstanceEventResponse `json:"events"`
+}
+
+// An InstanceEventResponse is a single state change in the history of an
+// instance.
+type InstanceEventResponse struct {
+	State         string    `json:"state"`
+	PreviousState *string   `json:"previous_state"`
+	Reason        *string   `json:"reason"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// An InstanceListResponse is returned by the HTTP API when listing instances.
+// NextCursor is null on the last page.
+type InstanceListResponse struct {
+	Instances  []*InstanceResponse `json:"instances"`
+	NextCursor *string             `json:"next_cursor"`
 }
 
 // CreateInstanceRequest contains the data in the request body for a create
@@ -162,4 +393,8 @@ type CreateInstanceRequest struct {
 	Image        string `json:"image"`
 	InstanceType string `json:"instance_type"`
 	PublicSSHKey string `json:"public_ssh_key"`
+
+	// IdempotencyKey is optional. Retrying a request with the same key
+	// returns the instance created by the first request.
+	IdempotencyKey string `json:"idempotency_key"`
 }
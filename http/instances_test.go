@@ -0,0 +1,199 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/travis-ci/cloud-brain/cloudbrain"
+	"github.com/travis-ci/cloud-brain/database"
+)
+
+// serveInstances makes a request to the instances handler, authenticated with
+// the given token, and decodes the JSON response into out.
+func serveInstances(t *testing.T, core *cloudbrain.Core, token *cloudbrain.Token, method, target string, out interface{}) int {
+	r := httptest.NewRequest(method, target, nil)
+	r = r.WithContext(cloudbrain.FromToken(r.Context(), token))
+	w := httptest.NewRecorder()
+
+	handleInstances(context.TODO(), core).ServeHTTP(w, r)
+
+	if out != nil {
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			t.Fatalf("couldn't decode the response to %s %s: %v", method, target, err)
+		}
+	}
+
+	return w.Code
+}
+
+func TestHandleInstancesListPages(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := cloudbrain.NewCore(db, nil, "")
+	token := &cloudbrain.Token{ID: 1, Scopes: []string{cloudbrain.ScopeInstancesRead, cloudbrain.ScopeInstancesAdmin}}
+
+	// Two instances share a creation time, so the cursor has to use the ID to
+	// tell them apart
+	createdAt := time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+	offsets := []time.Duration{0, time.Second, time.Second, 2 * time.Second, 3 * time.Second}
+	var expected []string
+	for _, offset := range offsets {
+		id, err := db.CreateInstance(database.Instance{
+			ProviderName: "fake",
+			Image:        "standard-image",
+			State:        "running",
+			CreatedAt:    createdAt.Add(offset),
+		})
+		if err != nil {
+			t.Fatalf("CreateInstance returned error: %v", err)
+		}
+		expected = append(expected, id)
+	}
+	if expected[1] > expected[2] {
+		expected[1], expected[2] = expected[2], expected[1]
+	}
+
+	var ids []string
+	pages := 0
+	target := "/instances?limit=2"
+	for {
+		var body InstanceListResponse
+		if status := serveInstances(t, core, token, "GET", target, &body); status != http.StatusOK {
+			t.Fatalf("expected 200 OK for %s, got %d", target, status)
+		}
+		pages++
+
+		for _, instance := range body.Instances {
+			ids = append(ids, instance.ID)
+		}
+		if body.NextCursor == nil {
+			break
+		}
+		if pages == len(offsets) {
+			t.Fatal("expected the pages to end")
+		}
+		target = "/instances?limit=2&cursor=" + url.QueryEscape(*body.NextCursor)
+	}
+
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected %d instances, got %v", len(expected), ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("expected the instances in the order %v, got %v", expected, ids)
+			break
+		}
+	}
+}
+
+func TestHandleInstancesListBadRequest(t *testing.T) {
+	core := cloudbrain.NewCore(database.NewMemoryDatabase(), nil, "")
+	token := &cloudbrain.Token{ID: 1, Scopes: []string{cloudbrain.ScopeInstancesRead}}
+
+	for _, query := range []string{
+		"limit=0",
+		"limit=1001",
+		"limit=ten",
+		"cursor=not-base64!",
+		"cursor=" + url.QueryEscape(encodeCursor(time.Now(), "")),
+		"cursor=" + url.QueryEscape(encodeCursor(time.Now(), "id")[2:]),
+	} {
+		var body ErrorResponse
+		status := serveInstances(t, core, token, "GET", "/instances?"+query, &body)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected 400 Bad Request for %s, got %d", query, status)
+		}
+		if len(body.Errors) != 1 {
+			t.Errorf("expected an error message for %s, got %v", query, body.Errors)
+		}
+	}
+}
+
+func TestInstanceLifecycleEvents(t *testing.T) {
+	db := database.NewMemoryDatabase()
+	core := cloudbrain.NewCore(db, nil, "")
+	token := &cloudbrain.Token{ID: 1, Tenant: "org", Scopes: []string{cloudbrain.ScopeInstancesRead, cloudbrain.ScopeInstancesWrite}}
+	ctx := cloudbrain.FromToken(context.TODO(), token)
+
+	_, err := db.CreateProvider(database.Provider{
+		Type:   "fake",
+		Name:   "fake-lifecycle",
+		Config: []byte(`{"namespace": "http-lifecycle-test"}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateProvider returned error: %v", err)
+	}
+
+	instance, err := core.CreateInstance(ctx, "fake-lifecycle", cloudbrain.CreateInstanceAttributes{ImageName: "standard-image"})
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	job := &work.Job{Args: map[string]interface{}{"payload": instance.ID}}
+	if err := core.ProviderCreateInstance(job); err != nil {
+		t.Fatalf("ProviderCreateInstance returned error: %v", err)
+	}
+	if err := core.RemoveInstance(ctx, cloudbrain.DeleteInstanceAttributes{InstanceID: instance.ID}); err != nil {
+		t.Fatalf("RemoveInstance returned error: %v", err)
+	}
+	if err := core.ProviderRemoveInstance(job); err != nil {
+		t.Fatalf("ProviderRemoveInstance returned error: %v", err)
+	}
+
+	var body InstanceResponse
+	if status := serveInstances(t, core, token, "GET", "/instances/"+instance.ID, &body); status != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", status)
+	}
+	if body.State != "terminating" {
+		t.Errorf("expected the instance to be terminating, got %s", body.State)
+	}
+	if body.StartingAt == nil || body.StartingAt.Before(body.CreatedAt) {
+		t.Errorf("expected starting_at to be set after created_at %v, got %v", body.CreatedAt, body.StartingAt)
+	}
+	if body.TerminatingAt == nil || body.StartingAt != nil && body.TerminatingAt.Before(*body.StartingAt) {
+		t.Errorf("expected terminating_at to be set after starting_at %v, got %v", body.StartingAt, body.TerminatingAt)
+	}
+	if body.RunningAt != nil || body.TerminatedAt != nil || body.ErroredAt != nil {
+		t.Errorf("expected only the timestamps of the states the instance was in to be set, got %+v", body)
+	}
+
+	var events InstanceEventsResponse
+	if status := serveInstances(t, core, token, "GET", "/instances/"+instance.ID+"/events", &events); status != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", status)
+	}
+
+	expected := []struct {
+		state, previousState, reason string
+		at                           *time.Time
+	}{
+		{"creating", "", "", &body.CreatedAt},
+		{"starting", "creating", "created on provider", body.StartingAt},
+		{"terminating", "starting", "removed on provider", body.TerminatingAt},
+	}
+	if len(events.Events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events.Events))
+	}
+	for i, e := range expected {
+		event := events.Events[i]
+		if event.State != e.state || stringOrEmpty(event.PreviousState) != e.previousState || stringOrEmpty(event.Reason) != e.reason {
+			t.Errorf("expected event %d to be %s -> %s (%q), got %s -> %s (%q)", i, e.previousState, e.state, e.reason, stringOrEmpty(event.PreviousState), event.State, stringOrEmpty(event.Reason))
+		}
+		if e.at != nil && !event.CreatedAt.Equal(*e.at) {
+			t.Errorf("expected event %d to be recorded at %v, got %v", i, *e.at, event.CreatedAt)
+		}
+	}
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
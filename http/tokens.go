@@ -0,0 +1,219 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/cbcontext"
+	"github.com/travis-ci/cloud-brain/cloudbrain"
+)
+
+var (
+	errInvalidTokenID = fmt.Errorf("invalid token ID, must be numerical")
+)
+
+func handleTokens(ctx context.Context, core *cloudbrain.Core) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := requestContext(ctx, r)
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "" && r.Method == "GET":
+			handleTokensList(ctx, core, w)
+		case path == "" && r.Method == "POST":
+			handleTokensPost(ctx, core, w, r)
+		case len(parts) == 1 && r.Method == "DELETE":
+			handleTokensDelete(ctx, core, w, parts[0])
+		case len(parts) == 2 && parts[1] == "rotate" && r.Method == "POST":
+			handleTokensRotate(ctx, core, w, parts[0])
+		case len(parts) <= 2:
+			respondError(ctx, w, http.StatusMethodNotAllowed, nil)
+		default:
+			respondError(ctx, w, http.StatusNotFound, nil)
+		}
+	})
+}
+
+func handleTokensList(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter) {
+	tokens, err := core.ListTokens(ctx)
+	if err != nil {
+		cbcontext.CaptureError(ctx, err)
+		respondError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body := &TokenListResponse{Tokens: make([]*TokenResponse, 0, len(tokens))}
+	for _, token := range tokens {
+		body.Tokens = append(body.Tokens, tokenToResponse(token))
+	}
+
+	respondOk(ctx, w, body)
+}
+
+func handleTokensPost(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter, r *http.Request) {
+	var req CreateTokenRequest
+
+	if err := parseRequest(ctx, r, &req); err != nil {
+		respondError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+
+	attr := cloudbrain.CreateTokenAttributes{
+		Description: req.Description,
+		Scopes:      req.Scopes,
+		Providers:   req.Providers,
+		Tenant:      req.Tenant,
+		Quota: cloudbrain.Quota{
+			MaxInstances:        req.MaxInstances,
+			MaxPremiumInstances: req.MaxPremiumInstances,
+			MaxCreatesPerMinute: req.MaxCreatesPerMinute,
+		},
+	}
+	if req.ExpiresAt != nil {
+		attr.ExpiresAt = *req.ExpiresAt
+	}
+
+	token, value, err := core.CreateToken(ctx, attr)
+	if err == cloudbrain.ErrInvalidScope || err == cloudbrain.ErrInvalidQuota {
+		respondError(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		cbcontext.CaptureError(ctx, err)
+		respondError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body := tokenToResponse(token)
+	body.Token = &value
+
+	respondStatus(ctx, w, http.StatusCreated, body)
+}
+
+func handleTokensDelete(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter, id string) {
+	tokenID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		respondError(ctx, w, http.StatusNotFound, errInvalidTokenID)
+		return
+	}
+
+	err = core.RevokeToken(ctx, tokenID)
+	if err == cloudbrain.ErrTokenNotFound {
+		respondError(ctx, w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		cbcontext.CaptureError(ctx, err)
+		respondError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondOk(ctx, w, nil)
+}
+
+func handleTokensRotate(ctx context.Context, core *cloudbrain.Core, w http.ResponseWriter, id string) {
+	tokenID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		respondError(ctx, w, http.StatusNotFound, errInvalidTokenID)
+		return
+	}
+
+	value, err := core.RotateToken(ctx, tokenID)
+	if err == cloudbrain.ErrTokenNotFound {
+		respondError(ctx, w, http.StatusNotFound, err)
+		return
+	}
+	if err == cloudbrain.ErrTokenRevoked {
+		respondError(ctx, w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		cbcontext.CaptureError(ctx, err)
+		respondError(ctx, w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondOk(ctx, w, &RotateTokenResponse{Token: value})
+}
+
+func tokenToResponse(token *cloudbrain.Token) *TokenResponse {
+	body := &TokenResponse{
+		ID:          token.ID,
+		Description: token.Description,
+		Scopes:      token.Scopes,
+		Providers:   token.Providers,
+		ExpiresAt:   timeOrNil(token.ExpiresAt),
+
+		MaxInstances:        token.Quota.MaxInstances,
+		MaxPremiumInstances: token.Quota.MaxPremiumInstances,
+		MaxCreatesPerMinute: token.Quota.MaxCreatesPerMinute,
+
+		Revoked:    token.Revoked,
+		LastUsedAt: timeOrNil(token.LastUsedAt),
+		CreatedAt:  token.CreatedAt,
+	}
+	if token.Tenant != "" {
+		body.Tenant = &token.Tenant
+	}
+	if body.Scopes == nil {
+		body.Scopes = []string{}
+	}
+	if body.Providers == nil {
+		body.Providers = []string{}
+	}
+
+	return body
+}
+
+// A TokenResponse is returned by the HTTP API that contains information about
+// a token. Token is only set when the token is created, since the secret
+// isn't stored.
+type TokenResponse struct {
+	ID          uint64     `json:"id"`
+	Description string     `json:"description"`
+	Scopes      []string   `json:"scopes"`
+	Providers   []string   `json:"providers"`
+	Tenant      *string    `json:"tenant"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+
+	// The limits of the quota of the token, zero if there's no limit
+	MaxInstances        int `json:"max_instances"`
+	MaxPremiumInstances int `json:"max_premium_instances"`
+	MaxCreatesPerMinute int `json:"max_creates_per_minute"`
+
+	Revoked    bool       `json:"revoked"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      *string    `json:"token,omitempty"`
+}
+
+// A TokenListResponse is returned by the HTTP API when listing tokens.
+type TokenListResponse struct {
+	Tokens []*TokenResponse `json:"tokens"`
+}
+
+// A RotateTokenResponse is returned by the HTTP API when rotating a token, and
+// contains the new value of the token.
+type RotateTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// CreateTokenRequest contains the data in the request body for a create token
+// request.
+type CreateTokenRequest struct {
+	Description string     `json:"description"`
+	Scopes      []string   `json:"scopes"`
+	Providers   []string   `json:"providers"`
+	Tenant      string     `json:"tenant"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+
+	MaxInstances        int `json:"max_instances"`
+	MaxPremiumInstances int `json:"max_premium_instances"`
+	MaxCreatesPerMinute int `json:"max_creates_per_minute"`
+}
@@ -0,0 +1,111 @@
+// Package metrics contains the Prometheus metrics exported by the Cloud Brain
+// API and workers.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "cloudbrain"
+
+var (
+	// HTTPRequestDuration is the time taken to serve HTTP API requests.
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "The time taken to serve HTTP API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// JobDuration is the time taken to run background jobs.
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "job",
+		Name:      "duration_seconds",
+		Help:      "The time taken to run background jobs.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"job"})
+
+	// JobFailures is the number of background jobs that returned an error.
+	JobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "job",
+		Name:      "failures_total",
+		Help:      "The number of background jobs that returned an error.",
+	}, []string{"job"})
+
+	// ProviderCallDuration is the time taken by calls to the cloud providers.
+	ProviderCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "provider",
+		Name:      "call_duration_seconds",
+		Help:      "The time taken by calls to the cloud providers.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"provider", "operation"})
+
+	// ProviderCallErrors is the number of calls to the cloud providers that
+	// returned an error.
+	ProviderCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "provider",
+		Name:      "call_errors_total",
+		Help:      "The number of calls to the cloud providers that returned an error.",
+	}, []string{"provider", "operation"})
+
+	// Instances is the number of instances in the database, as of the last
+	// refresh.
+	Instances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instances",
+		Help:      "The number of instances in the database, as of the last refresh.",
+	}, []string{"provider", "state"})
+
+	// RefreshDuration is the time taken by a refresh of all the providers.
+	RefreshDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "refresh",
+		Name:      "duration_seconds",
+		Help:      "The time taken by a refresh of all the providers.",
+		Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	})
+
+	// StuckInstances is the number of instances that stayed in a state for
+	// longer than its timeout.
+	StuckInstances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stuck_instances_total",
+		Help:      "The number of instances that stayed in a state for longer than its timeout.",
+	}, []string{"provider", "state"})
+
+	// TokenCacheLookups is the number of lookups in the cache of verified
+	// tokens, by whether the token was cached.
+	TokenCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "token_cache",
+		Name:      "lookups_total",
+		Help:      "The number of lookups in the cache of verified tokens, by whether the token was cached.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequestDuration,
+		JobDuration,
+		JobFailures,
+		ProviderCallDuration,
+		ProviderCallErrors,
+		Instances,
+		RefreshDuration,
+		StuckInstances,
+		TokenCacheLookups,
+	)
+}
+
+// Handler returns an http.Handler that serves the metrics in the Prometheus
+// exposition format.
+func Handler() http.Handler {
+	return prometheus.Handler()
+}
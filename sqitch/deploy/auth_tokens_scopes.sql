@@ -0,0 +1,15 @@
+-- Deploy cloudbrain:auth_tokens_scopes to pg
+-- requires: auth_tokens
+
+BEGIN;
+
+-- Existing tokens keep access to all instances on all providers
+ALTER TABLE cloudbrain.auth_tokens
+	ADD COLUMN scopes       TEXT[] NOT NULL DEFAULT '{instances:read,instances:write}',
+	ADD COLUMN providers    TEXT[] NOT NULL DEFAULT '{}',
+	ADD COLUMN expires_at   TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN revoked      BOOLEAN NOT NULL DEFAULT false,
+	ADD COLUMN last_used_at TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:auth_tokens_tenant to pg
+-- requires: auth_tokens_scopes
+
+BEGIN;
+
+ALTER TABLE cloudbrain.auth_tokens ADD COLUMN tenant TEXT;
+
+COMMIT;
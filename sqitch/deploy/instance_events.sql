@@ -0,0 +1,17 @@
+-- Deploy cloudbrain:instance_events to pg
+-- requires: instances
+
+BEGIN;
+
+CREATE TABLE cloudbrain.instance_events (
+	id             BIGSERIAL                 PRIMARY KEY,
+	instance_id    uuid                      NOT NULL REFERENCES cloudbrain.instances(id) ON DELETE CASCADE,
+	state          TEXT                      NOT NULL,
+	previous_state TEXT,
+	reason         TEXT,
+	created_at     TIMESTAMP WITH TIME ZONE  NOT NULL DEFAULT now()
+);
+
+CREATE INDEX instance_events_instance_id_idx ON cloudbrain.instance_events (instance_id, created_at);
+
+COMMIT;
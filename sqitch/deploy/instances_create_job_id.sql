@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:instances_create_job_id to pg
+-- requires: instances
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances ADD COLUMN create_job_id TEXT;
+
+COMMIT;
@@ -0,0 +1,10 @@
+-- Deploy cloudbrain:instances_created_at to pg
+-- requires: instances
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+
+CREATE INDEX instances_created_at_id_idx ON cloudbrain.instances (created_at, id);
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Deploy cloudbrain:instances_idempotency_key to pg
+-- requires: instances
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances ADD COLUMN idempotency_key TEXT;
+ALTER TABLE cloudbrain.instances ADD CONSTRAINT instances_idempotency_key_key UNIQUE (idempotency_key);
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:instances_instance_type to pg
+-- requires: instances
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances ADD COLUMN instance_type TEXT NOT NULL DEFAULT 'standard';
+
+COMMIT;
@@ -0,0 +1,13 @@
+-- Deploy cloudbrain:instances_owner to pg
+-- requires: instances auth_tokens
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances
+	ADD COLUMN owner_token_id INTEGER REFERENCES cloudbrain.auth_tokens (id),
+	ADD COLUMN tenant         TEXT;
+
+CREATE INDEX instances_owner_token_id_idx ON cloudbrain.instances (owner_token_id);
+CREATE INDEX instances_tenant_idx ON cloudbrain.instances (tenant);
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Deploy cloudbrain:instances_owner_idempotency_key to pg
+-- requires: instances_idempotency_key instances_owner
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances DROP CONSTRAINT instances_idempotency_key_key;
+CREATE UNIQUE INDEX instances_owner_idempotency_key_idx ON cloudbrain.instances ((COALESCE('tenant:' || tenant, 'token:' || owner_token_id, '')), idempotency_key);
+
+COMMIT;
@@ -0,0 +1,14 @@
+-- Deploy cloudbrain:instances_timestamps to pg
+-- requires: instances_created_at
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances
+	ADD COLUMN updated_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	ADD COLUMN starting_at    TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN running_at     TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN terminating_at TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN terminated_at  TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN errored_at     TIMESTAMP WITH TIME ZONE;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:instances_version to pg
+-- requires: instances
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+
+COMMIT;
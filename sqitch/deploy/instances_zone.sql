@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:instances_zone to pg
+-- requires: instances
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances ADD COLUMN zone TEXT;
+
+COMMIT;
@@ -0,0 +1,13 @@
+-- Deploy cloudbrain:outbox_jobs to pg
+-- requires: appschema
+
+BEGIN;
+
+CREATE TABLE cloudbrain.outbox_jobs (
+	id         BIGSERIAL                 PRIMARY KEY,
+	job_name   TEXT                      NOT NULL,
+	payload    TEXT                      NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE  NOT NULL DEFAULT now()
+);
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:outbox_jobs_metadata to pg
+-- requires: outbox_jobs
+
+BEGIN;
+
+ALTER TABLE cloudbrain.outbox_jobs ADD COLUMN metadata JSON NOT NULL DEFAULT '{}';
+
+COMMIT;
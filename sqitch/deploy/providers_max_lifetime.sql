@@ -0,0 +1,8 @@
+-- Deploy cloudbrain:providers_max_lifetime to pg
+-- requires: providers
+
+BEGIN;
+
+ALTER TABLE cloudbrain.providers ADD COLUMN max_lifetime_seconds BIGINT;
+
+COMMIT;
@@ -0,0 +1,14 @@
+-- Deploy cloudbrain:quotas to pg
+-- requires: auth_tokens_tenant providers_max_lifetime
+
+BEGIN;
+
+ALTER TABLE cloudbrain.auth_tokens ADD COLUMN max_instances INTEGER;
+ALTER TABLE cloudbrain.auth_tokens ADD COLUMN max_premium_instances INTEGER;
+ALTER TABLE cloudbrain.auth_tokens ADD COLUMN max_creates_per_minute INTEGER;
+
+ALTER TABLE cloudbrain.providers ADD COLUMN max_instances INTEGER;
+ALTER TABLE cloudbrain.providers ADD COLUMN max_premium_instances INTEGER;
+ALTER TABLE cloudbrain.providers ADD COLUMN max_creates_per_minute INTEGER;
+
+COMMIT;
@@ -0,0 +1,13 @@
+-- Revert cloudbrain:auth_tokens_scopes from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.auth_tokens
+	DROP COLUMN scopes,
+	DROP COLUMN providers,
+	DROP COLUMN expires_at,
+	DROP COLUMN revoked,
+	DROP COLUMN last_used_at,
+	DROP COLUMN created_at;
+
+COMMIT;
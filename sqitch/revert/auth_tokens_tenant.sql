@@ -0,0 +1,7 @@
+-- Revert cloudbrain:auth_tokens_tenant from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.auth_tokens DROP COLUMN tenant;
+
+COMMIT;
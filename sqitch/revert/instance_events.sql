@@ -0,0 +1,7 @@
+-- Revert cloudbrain:instance_events from pg
+
+BEGIN;
+
+DROP TABLE cloudbrain.instance_events;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert cloudbrain:instances_create_job_id from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances DROP COLUMN create_job_id;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Revert cloudbrain:instances_created_at from pg
+
+BEGIN;
+
+DROP INDEX cloudbrain.instances_created_at_id_idx;
+
+ALTER TABLE cloudbrain.instances DROP COLUMN created_at;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert cloudbrain:instances_idempotency_key from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances DROP COLUMN idempotency_key;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert cloudbrain:instances_instance_type from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances DROP COLUMN instance_type;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Revert cloudbrain:instances_owner from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances
+	DROP COLUMN owner_token_id,
+	DROP COLUMN tenant;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Revert cloudbrain:instances_owner_idempotency_key from pg
+
+BEGIN;
+
+DROP INDEX cloudbrain.instances_owner_idempotency_key_idx;
+ALTER TABLE cloudbrain.instances ADD CONSTRAINT instances_idempotency_key_key UNIQUE (idempotency_key);
+
+COMMIT;
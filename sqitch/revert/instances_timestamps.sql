@@ -0,0 +1,13 @@
+-- Revert cloudbrain:instances_timestamps from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances
+	DROP COLUMN updated_at,
+	DROP COLUMN starting_at,
+	DROP COLUMN running_at,
+	DROP COLUMN terminating_at,
+	DROP COLUMN terminated_at,
+	DROP COLUMN errored_at;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert cloudbrain:instances_version from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances DROP COLUMN version;
+
+COMMIT;
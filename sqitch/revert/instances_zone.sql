@@ -0,0 +1,7 @@
+-- Revert cloudbrain:instances_zone from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.instances DROP COLUMN zone;
+
+COMMIT;
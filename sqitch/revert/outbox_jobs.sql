@@ -0,0 +1,7 @@
+-- Revert cloudbrain:outbox_jobs from pg
+
+BEGIN;
+
+DROP TABLE cloudbrain.outbox_jobs;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert cloudbrain:outbox_jobs_metadata from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.outbox_jobs DROP COLUMN metadata;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert cloudbrain:providers_max_lifetime from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.providers DROP COLUMN max_lifetime_seconds;
+
+COMMIT;
@@ -0,0 +1,13 @@
+-- Revert cloudbrain:quotas from pg
+
+BEGIN;
+
+ALTER TABLE cloudbrain.auth_tokens DROP COLUMN max_instances;
+ALTER TABLE cloudbrain.auth_tokens DROP COLUMN max_premium_instances;
+ALTER TABLE cloudbrain.auth_tokens DROP COLUMN max_creates_per_minute;
+
+ALTER TABLE cloudbrain.providers DROP COLUMN max_instances;
+ALTER TABLE cloudbrain.providers DROP COLUMN max_premium_instances;
+ALTER TABLE cloudbrain.providers DROP COLUMN max_creates_per_minute;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:auth_tokens_scopes on pg
+
+BEGIN;
+
+SELECT scopes, providers, expires_at, revoked, last_used_at, created_at
+FROM cloudbrain.auth_tokens
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:auth_tokens_tenant on pg
+
+BEGIN;
+
+SELECT tenant
+FROM cloudbrain.auth_tokens
+WHERE false;
+
+ROLLBACK;
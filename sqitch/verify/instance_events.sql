@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instance_events on pg
+
+BEGIN;
+
+SELECT id, instance_id, state, previous_state, reason, created_at
+FROM cloudbrain.instance_events
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_create_job_id on pg
+
+BEGIN;
+
+SELECT create_job_id
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_created_at on pg
+
+BEGIN;
+
+SELECT created_at
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_idempotency_key on pg
+
+BEGIN;
+
+SELECT idempotency_key
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
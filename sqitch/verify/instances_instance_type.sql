@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_instance_type on pg
+
+BEGIN;
+
+SELECT instance_type
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_owner on pg
+
+BEGIN;
+
+SELECT owner_token_id, tenant
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_owner_idempotency_key on pg
+
+BEGIN;
+
+SELECT 1/COUNT(*)
+FROM pg_catalog.pg_indexes
+WHERE schemaname = 'cloudbrain' AND indexname = 'instances_owner_idempotency_key_idx';
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_timestamps on pg
+
+BEGIN;
+
+SELECT updated_at, starting_at, running_at, terminating_at, terminated_at, errored_at
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
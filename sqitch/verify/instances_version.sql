@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_version on pg
+
+BEGIN;
+
+SELECT version
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:instances_zone on pg
+
+BEGIN;
+
+SELECT zone
+FROM cloudbrain.instances
+WHERE false;
+
+ROLLBACK;
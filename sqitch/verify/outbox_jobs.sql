@@ -0,0 +1,9 @@
+-- Verify cloudbrain:outbox_jobs on pg
+
+BEGIN;
+
+SELECT id, job_name, payload, created_at
+FROM cloudbrain.outbox_jobs
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify cloudbrain:outbox_jobs_metadata on pg
+
+BEGIN;
+
+SELECT metadata
+FROM cloudbrain.outbox_jobs
+WHERE false;
+
+ROLLBACK;
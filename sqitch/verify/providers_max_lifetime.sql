@@ -0,0 +1,9 @@
+-- Verify cloudbrain:providers_max_lifetime on pg
+
+BEGIN;
+
+SELECT max_lifetime_seconds
+FROM cloudbrain.providers
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,13 @@
+-- Verify cloudbrain:quotas on pg
+
+BEGIN;
+
+SELECT max_instances, max_premium_instances, max_creates_per_minute
+FROM cloudbrain.auth_tokens
+WHERE false;
+
+SELECT max_instances, max_premium_instances, max_creates_per_minute
+FROM cloudbrain.providers
+WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,239 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travis-ci/cloud-brain/cbcontext"
+)
+
+const (
+	otlpMaxBatchSize = 512
+	otlpQueueSize    = 4096
+	otlpFlushPeriod  = 5 * time.Second
+)
+
+// OTLPExporter batches spans and sends them to an OpenTelemetry collector
+// using OTLP over HTTP, with JSON encoding. Spans are dropped if the collector
+// can't keep up.
+type OTLPExporter struct {
+	ctx         context.Context
+	url         string
+	serviceName string
+	client      *http.Client
+
+	spans   chan *Span
+	flushes chan chan struct{}
+}
+
+// NewOTLPExporter creates an OTLPExporter that sends spans to the collector at
+// the given endpoint, e.g. "http://localhost:4318", tagged with the given
+// service name. Errors are logged using the logger from the given context.
+func NewOTLPExporter(ctx context.Context, endpoint, serviceName string) *OTLPExporter {
+	e := &OTLPExporter{
+		ctx:         ctx,
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *Span, otlpQueueSize),
+		flushes:     make(chan chan struct{}),
+	}
+
+	go e.run()
+
+	return e
+}
+
+// ExportSpan queues the span to be sent with the next batch.
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		cbcontext.LoggerFromContext(e.ctx).WithField("span", span.name).Warn("span queue is full, dropping span")
+	}
+}
+
+// Flush sends the spans queued so far, and waits for them to be sent.
+func (e *OTLPExporter) Flush() {
+	done := make(chan struct{})
+	e.flushes <- done
+	<-done
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpFlushPeriod)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) < otlpMaxBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-e.flushes:
+		drain:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					break drain
+				}
+			}
+			e.send(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+
+		e.send(batch)
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		cbcontext.LoggerFromContext(e.ctx).WithField("err", err).Error("couldn't encode spans")
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		cbcontext.LoggerFromContext(e.ctx).WithField("err", err).Error("couldn't send spans to collector")
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		cbcontext.LoggerFromContext(e.ctx).WithField("err", fmt.Errorf("collector returned status %d", resp.StatusCode)).Error("couldn't send spans to collector")
+	}
+}
+
+func (e *OTLPExporter) request(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, otlpSpanFromSpan(span))
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{otlpStringAttribute("service.name", e.serviceName)},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "github.com/travis-ci/cloud-brain/tracing"},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpSpanFromSpan(span *Span) otlpSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(span.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.context.SpanID[:]),
+		Name:              span.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusCodeOK},
+	}
+
+	if span.parentSpanID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(span.parentSpanID[:])
+	}
+
+	for key, value := range span.attributes {
+		s.Attributes = append(s.Attributes, otlpStringAttribute(key, value))
+	}
+
+	if span.err != nil {
+		s.Status = otlpStatus{Code: otlpStatusCodeError, Message: span.err.Error()}
+	}
+
+	return s
+}
+
+// The types below are the parts of the OTLP trace export request used by
+// OTLPExporter, as defined by the OTLP JSON encoding.
+
+const (
+	otlpSpanKindInternal = 1
+
+	otlpStatusCodeOK    = 1
+	otlpStatusCodeError = 2
+)
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpStringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
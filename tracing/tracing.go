@@ -0,0 +1,205 @@
+// Package tracing implements a minimal tracer that records spans and exports
+// them to an OpenTelemetry collector. Trace context is propagated between
+// processes in the W3C traceparent format.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const spanContextKey contextKey = iota
+
+// An Exporter sends finished spans somewhere.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+var (
+	exporterMutex sync.RWMutex
+	exporter      Exporter
+)
+
+// SetExporter sets the exporter that spans are sent to when they end. Until an
+// exporter is set, StartSpan doesn't record anything.
+func SetExporter(e Exporter) {
+	exporterMutex.Lock()
+	defer exporterMutex.Unlock()
+
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterMutex.RLock()
+	defer exporterMutex.RUnlock()
+
+	return exporter
+}
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid returns true if both the trace and span ID are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the span context in the W3C traceparent format.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// ParseTraceparent parses a span context in the W3C traceparent format. The
+// second return value is false if the value couldn't be parsed.
+func ParseTraceparent(traceparent string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return SpanContext{}, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return SpanContext{}, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+
+	return sc, sc.IsValid()
+}
+
+// ContextWithSpanContext returns a context with the given context as its
+// parent, in which spans started become children of the given span context.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey, sc)
+}
+
+// SpanContextFromContext returns the span context of the current span in the
+// context. If there is none, the second argument is false.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey).(SpanContext)
+	return sc, ok
+}
+
+// FromTraceparent returns a context with the given context as its parent, in
+// which spans started become children of the span in the given traceparent.
+// The context is returned unchanged if the traceparent is empty or invalid.
+func FromTraceparent(ctx context.Context, traceparent string) context.Context {
+	sc, ok := ParseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// TraceparentFromContext returns the current span in the context in the W3C
+// traceparent format, or the empty string if there is none.
+func TraceparentFromContext(ctx context.Context) string {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	return sc.Traceparent()
+}
+
+// A Span is a timed operation within a trace. A nil *Span is valid, and is
+// returned by StartSpan when no exporter is set.
+type Span struct {
+	mutex sync.Mutex
+
+	context      SpanContext
+	parentSpanID [8]byte
+	name         string
+	start        time.Time
+	end          time.Time
+	attributes   map[string]string
+	err          error
+	exporter     Exporter
+}
+
+// StartSpan starts a span with the given name, as a child of the current span
+// in the context if there is one. The returned context has the new span as its
+// current span. The span must be ended with End.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+		exporter:   e,
+	}
+
+	if parent, ok := SpanContextFromContext(ctx); ok && parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.parentSpanID = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.context.TraceID[:])
+	}
+	_, _ = rand.Read(span.context.SpanID[:])
+
+	return ContextWithSpanContext(ctx, span.context), span
+}
+
+// SetAttribute sets an attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed with the given error. Does nothing if err
+// is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err
+}
+
+// End ends the span and sends it to the exporter. Calling End more than once
+// has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	s.exporter.ExportSpan(s)
+}
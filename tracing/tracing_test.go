@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+type recordingExporter struct {
+	spans []*Span
+}
+
+func (e *recordingExporter) ExportSpan(span *Span) {
+	e.spans = append(e.spans, span)
+}
+
+func TestStartSpanContinuesTraceparent(t *testing.T) {
+	exporter := &recordingExporter{}
+	SetExporter(exporter)
+	defer SetExporter(nil)
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := FromTraceparent(context.Background(), traceparent)
+
+	ctx, span := StartSpan(ctx, "test")
+	span.End()
+	span.End()
+
+	if len(exporter.spans) != 1 {
+		t.Fatalf("expected 1 exported span, got %d", len(exporter.spans))
+	}
+
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		t.Fatal("expected a span context in the returned context")
+	}
+
+	parent, _ := ParseTraceparent(traceparent)
+	if sc.TraceID != parent.TraceID {
+		t.Errorf("expected trace ID %x, got %x", parent.TraceID, sc.TraceID)
+	}
+	if span.parentSpanID != parent.SpanID {
+		t.Errorf("expected parent span ID %x, got %x", parent.SpanID, span.parentSpanID)
+	}
+
+	restored, ok := ParseTraceparent(TraceparentFromContext(ctx))
+	if !ok || restored != sc {
+		t.Errorf("expected traceparent to round-trip to %+v, got %+v", sc, restored)
+	}
+}